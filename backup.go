@@ -0,0 +1,398 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/fileutil"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+)
+
+const backupManifestFilename = "manifest.json"
+
+// BackupManifest describes the state of a DB at the time of a backup.
+// A backup directory only holds the blocks and WAL files that were new or
+// changed compared to the manifest the backup was based on.
+type BackupManifest struct {
+	Blocks []BackupBlock `json:"blocks"`
+	WAL    []BackupFile  `json:"wal"`
+}
+
+// BackupBlock identifies a block in a backup.
+type BackupBlock struct {
+	ULID ulid.ULID `json:"ulid"`
+	// Checksum of the tombstones file, which is the only part of a
+	// block that may change.
+	Tombstones uint32 `json:"tombstones"`
+}
+
+// BackupFile is a file within the WAL directory.
+type BackupFile struct {
+	// Path relative to the WAL directory using slashes as separators.
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// ReadBackupManifest reads the manifest of the backup in the given directory.
+func ReadBackupManifest(dir string) (BackupManifest, error) {
+	var m BackupManifest
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, backupManifestFilename))
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(b, &m)
+}
+
+func writeBackupManifest(dir string, m BackupManifest) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Make the manifest appear atomically as it marks the backup as complete.
+	tmp := filepath.Join(dir, backupManifestFilename+".tmp")
+
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return fileutil.Rename(tmp, filepath.Join(dir, backupManifestFilename))
+}
+
+// Backup copies all blocks and WAL files into dir that are new or changed since the
+// backup described by the given manifest. An empty manifest results in a full backup.
+// The returned manifest describes the backup and can be passed to the next call.
+func (db *DB) Backup(dir string, since BackupManifest) (BackupManifest, error) {
+	var m BackupManifest
+
+	if dir == db.dir {
+		return m, errors.Errorf("cannot backup into base directory")
+	}
+	if _, err := ulid.Parse(filepath.Base(dir)); err == nil {
+		return m, errors.Errorf("dir must not be a valid ULID")
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return m, errors.Wrap(err, "create backup dir")
+	}
+
+	// Prevent compactions, reloads and deletions from changing the data while copying it.
+	db.cmtx.Lock()
+	defer db.cmtx.Unlock()
+
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	prevBlocks := map[ulid.ULID]BackupBlock{}
+	for _, b := range since.Blocks {
+		prevBlocks[b.ULID] = b
+	}
+	prevWAL := map[string]BackupFile{}
+	for _, f := range since.WAL {
+		prevWAL[f.Name] = f
+	}
+
+	for _, b := range db.blocks {
+		crc, err := tombstonesChecksum(b.Dir())
+		if err != nil {
+			return m, errors.Wrapf(err, "checksum tombstones of block %s", b)
+		}
+		bb := BackupBlock{ULID: b.Meta().ULID, Tombstones: crc}
+		m.Blocks = append(m.Blocks, bb)
+
+		if prev, ok := prevBlocks[bb.ULID]; ok && prev == bb {
+			continue
+		}
+		level.Info(db.logger).Log("msg", "backing up block", "block", b)
+
+		if err := copyBlock(b.Dir(), filepath.Join(dir, bb.ULID.String())); err != nil {
+			return m, errors.Wrapf(err, "backup block %s", b)
+		}
+	}
+
+	walDir := filepath.Join(db.dir, "wal")
+
+	err := filepath.Walk(walDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(walDir, path)
+		if err != nil {
+			return err
+		}
+		f := BackupFile{Name: filepath.ToSlash(rel), Size: fi.Size()}
+		m.WAL = append(m.WAL, f)
+
+		// WAL files only ever grow. Unchanged sizes imply unchanged contents.
+		if prev, ok := prevWAL[f.Name]; ok && prev == f {
+			return nil
+		}
+		return copyFileN(path, filepath.Join(dir, "wal", rel), f.Size)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return m, errors.Wrap(err, "backup WAL")
+	}
+
+	return m, errors.Wrap(writeBackupManifest(dir, m), "write manifest")
+}
+
+func tombstonesChecksum(dir string) (uint32, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, tombstoneFilename))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	h := newCRC32()
+	h.Write(b)
+	return h.Sum32(), nil
+}
+
+// copyBlock copies the block directory src to dst. The block is copied into a
+// temporary directory first so that dst only appears once it is complete.
+func copyBlock(src, dst string) error {
+	tmp := dst + ".tmp"
+
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := fileutil.CopyDirs(src, tmp); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	return fileutil.Rename(tmp, dst)
+}
+
+// copyFileN copies the first n bytes of the file src to dst.
+func copyFileN(src, dst string, n int64) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, in, n); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Restore rebuilds a DB directory from a chain of backups, which must be given
+// in the order they were taken. The first backup must be a full backup. The
+// resulting directory holds the state described by the last backup's manifest.
+// All restored blocks are verified.
+func Restore(dir string, backups ...string) error {
+	if len(backups) == 0 {
+		return errors.New("no backups given")
+	}
+	if files, err := ioutil.ReadDir(dir); err == nil && len(files) > 0 {
+		return errors.Errorf("restore directory %s is not empty", dir)
+	}
+	walDir := filepath.Join(dir, "wal")
+
+	if err := os.MkdirAll(walDir, 0777); err != nil {
+		return errors.Wrap(err, "create restore dir")
+	}
+
+	var m BackupManifest
+
+	for _, bdir := range backups {
+		var err error
+		if m, err = ReadBackupManifest(bdir); err != nil {
+			return errors.Wrapf(err, "read manifest of backup %s", bdir)
+		}
+		for _, b := range m.Blocks {
+			src := filepath.Join(bdir, b.ULID.String())
+
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				continue
+			}
+			if err := copyBlock(src, filepath.Join(dir, b.ULID.String())); err != nil {
+				return errors.Wrapf(err, "restore block %s from %s", b.ULID, bdir)
+			}
+		}
+		for _, f := range m.WAL {
+			src := filepath.Join(bdir, "wal", filepath.FromSlash(f.Name))
+
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				continue
+			}
+			if err := copyFileN(src, filepath.Join(walDir, filepath.FromSlash(f.Name)), f.Size); err != nil {
+				return errors.Wrapf(err, "restore WAL file %s from %s", f.Name, bdir)
+			}
+		}
+	}
+
+	// Drop all data that was removed from the DB between backups.
+	blocks := map[string]struct{}{}
+	for _, b := range m.Blocks {
+		blocks[b.ULID.String()] = struct{}{}
+	}
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if _, ok := blocks[filepath.Base(d)]; ok {
+			continue
+		}
+		if err := os.RemoveAll(d); err != nil {
+			return err
+		}
+	}
+	if err := pruneWAL(walDir, m.WAL); err != nil {
+		return errors.Wrap(err, "prune WAL")
+	}
+
+	for _, b := range m.Blocks {
+		bdir := filepath.Join(dir, b.ULID.String())
+
+		if _, err := os.Stat(bdir); err != nil {
+			return errors.Wrapf(err, "block %s missing from backups", b.ULID)
+		}
+		crc, err := tombstonesChecksum(bdir)
+		if err != nil {
+			return errors.Wrapf(err, "checksum tombstones of block %s", b.ULID)
+		}
+		if crc != b.Tombstones {
+			return errors.Errorf("tombstones of block %s do not match manifest", b.ULID)
+		}
+		if err := VerifyBlock(bdir); err != nil {
+			return errors.Wrapf(err, "verify block %s", b.ULID)
+		}
+	}
+	return nil
+}
+
+// pruneWAL removes all files from the WAL directory that are not in the list.
+func pruneWAL(dir string, keep []BackupFile) error {
+	files := map[string]struct{}{}
+	for _, f := range keep {
+		files[f.Name] = struct{}{}
+	}
+	var dirs []string
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path != dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if _, ok := files[filepath.ToSlash(rel)]; ok {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	if err != nil {
+		return err
+	}
+	// Remove directories that became empty, deepest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	for _, d := range dirs {
+		if fs, err := ioutil.ReadDir(d); err == nil && len(fs) == 0 {
+			if err := os.Remove(d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyBlock checks that all series and chunks of the block in the given
+// directory can be read and match the statistics of its meta file.
+func VerifyBlock(dir string) error {
+	b, err := OpenBlock(dir, nil)
+	if err != nil {
+		return errors.Wrap(err, "open block")
+	}
+	defer b.Close()
+
+	ir, err := b.Index()
+	if err != nil {
+		return err
+	}
+	defer ir.Close()
+
+	cr, err := b.Chunks()
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return errors.Wrap(err, "get all postings")
+	}
+	var (
+		lset                 labels.Labels
+		chks                 []chunks.Meta
+		numSeries, numChunks uint64
+	)
+	for p.Next() {
+		if err := ir.Series(p.At(), &lset, &chks); err != nil {
+			return errors.Wrapf(err, "read series %d", p.At())
+		}
+		for _, c := range chks {
+			if _, err := cr.Chunk(c.Ref); err != nil {
+				return errors.Wrapf(err, "read chunk %d of series %s", c.Ref, lset)
+			}
+		}
+		numSeries++
+		numChunks += uint64(len(chks))
+	}
+	if p.Err() != nil {
+		return errors.Wrap(p.Err(), "iterate postings")
+	}
+	stats := b.Meta().Stats
+
+	if numSeries != stats.NumSeries {
+		return errors.Errorf("found %d series but meta file reports %d", numSeries, stats.NumSeries)
+	}
+	if numChunks != stats.NumChunks {
+		return errors.Errorf("found %d chunks but meta file reports %d", numChunks, stats.NumChunks)
+	}
+	return nil
+}
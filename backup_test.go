@@ -0,0 +1,110 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestBackupRestore(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	dbDir := filepath.Join(tmpdir, "db")
+	testutil.Ok(t, os.MkdirAll(dbDir, 0777))
+	id := writeTestBlock(t, dbDir, 10, 100)
+
+	db, err := Open(dbDir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	appendSamples := func(ts int64) {
+		app := db.Appender()
+		for i := 0; i < 10; i++ {
+			_, err := app.Add(labels.FromStrings("a", "head", "i", string(rune('a'+i))), ts, float64(i))
+			testutil.Ok(t, err)
+		}
+		testutil.Ok(t, app.Commit())
+	}
+	appendSamples(200000)
+
+	var (
+		b1 = filepath.Join(tmpdir, "backup1")
+		b2 = filepath.Join(tmpdir, "backup2")
+		b3 = filepath.Join(tmpdir, "backup3")
+	)
+	m1, err := db.Backup(b1, BackupManifest{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(m1.Blocks))
+	testutil.Assert(t, len(m1.WAL) > 0, "expected WAL files in manifest")
+
+	_, err = os.Stat(filepath.Join(b1, id.String(), indexFilename))
+	testutil.Ok(t, err)
+
+	// Nothing changed, so the incremental backup must not contain any data.
+	m2, err := db.Backup(b2, m1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, m1, m2)
+
+	files, err := ioutil.ReadDir(b2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(files))
+	testutil.Equals(t, backupManifestFilename, files[0].Name())
+
+	// Deletions change the tombstones of the block and new samples grow the WAL.
+	testutil.Ok(t, db.Delete(0, 10000, labels.NewEqualMatcher("series", "series-00001")))
+	appendSamples(201000)
+
+	m3, err := db.Backup(b3, m2)
+	testutil.Ok(t, err)
+	testutil.Assert(t, m3.Blocks[0] != m2.Blocks[0], "expected block to change")
+
+	_, err = os.Stat(filepath.Join(b3, id.String()))
+	testutil.Ok(t, err)
+	_, err = os.Stat(filepath.Join(b3, "wal"))
+	testutil.Ok(t, err)
+
+	// An incomplete chain of backups cannot be restored.
+	testutil.NotOk(t, Restore(filepath.Join(tmpdir, "incomplete"), b2))
+
+	restoreDir := filepath.Join(tmpdir, "restored")
+	testutil.Ok(t, Restore(restoreDir, b1, b2, b3))
+
+	restored, err := Open(restoreDir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer restored.Close()
+
+	for _, m := range []labels.Matcher{
+		labels.NewEqualMatcher("a", "b"),
+		labels.NewEqualMatcher("a", "head"),
+	} {
+		q, err := db.Querier(0, math.MaxInt64)
+		testutil.Ok(t, err)
+		exp := query(t, q, m)
+		testutil.Ok(t, q.Close())
+
+		q, err = restored.Querier(0, math.MaxInt64)
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp, query(t, q, m))
+		testutil.Ok(t, q.Close())
+	}
+}
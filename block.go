@@ -15,7 +15,6 @@
 package tsdb
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"io/ioutil"
 	"os"
@@ -183,6 +182,9 @@ type BlockMetaCompaction struct {
 	// this block.
 	Parents []BlockDesc `json:"parents,omitempty"`
 	Failed  bool        `json:"failed,omitempty"`
+	// Retention rules whose horizon had passed the end of the block
+	// when it was written.
+	ExpiredRules []string `json:"expiredRules,omitempty"`
 }
 
 const indexFilename = "index"
@@ -195,6 +197,10 @@ func readMetaFile(dir string) (*BlockMeta, error) {
 	if err != nil {
 		return nil, err
 	}
+	return decodeMeta(b)
+}
+
+func decodeMeta(b []byte) (*BlockMeta, error) {
 	var m BlockMeta
 
 	if err := json.Unmarshal(b, &m); err != nil {
@@ -250,11 +256,30 @@ type Block struct {
 	chunkr     ChunkReader
 	indexr     IndexReader
 	tombstones TombstoneReader
+
+	// Optional cache for decoded postings and series, shared with other blocks.
+	cache *indexCache
+}
+
+// BlockOptions are parameters for opening a block.
+type BlockOptions struct {
+	// LazyIndex reads symbols and postings offsets of the index from disk on
+	// demand rather than loading them into memory upfront.
+	LazyIndex bool
 }
 
 // OpenBlock opens the block in the directory. It can be passed a chunk pool, which is used
 // to instantiate chunk structs.
 func OpenBlock(dir string, pool chunkenc.Pool) (*Block, error) {
+	return OpenBlockWithOptions(dir, pool, nil)
+}
+
+// OpenBlockWithOptions opens the block in the directory like OpenBlock with
+// the given options. Nil options open the block like OpenBlock.
+func OpenBlockWithOptions(dir string, pool chunkenc.Pool, opts *BlockOptions) (*Block, error) {
+	if opts == nil {
+		opts = &BlockOptions{}
+	}
 	meta, err := readMetaFile(dir)
 	if err != nil {
 		return nil, err
@@ -264,7 +289,12 @@ func OpenBlock(dir string, pool chunkenc.Pool) (*Block, error) {
 	if err != nil {
 		return nil, err
 	}
-	ir, err := index.NewFileReader(filepath.Join(dir, "index"))
+	var ir *index.Reader
+	if opts.LazyIndex {
+		ir, err = index.NewLazyFileReader(filepath.Join(dir, "index"))
+	} else {
+		ir, err = index.NewFileReader(filepath.Join(dir, "index"))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -274,23 +304,13 @@ func OpenBlock(dir string, pool chunkenc.Pool) (*Block, error) {
 		return nil, err
 	}
 
-	// Calculating symbol table size.
-	tmp := make([]byte, 8)
-	symTblSize := uint64(0)
-	for _, v := range ir.SymbolTable() {
-		// Size of varint length of the symbol.
-		symTblSize += uint64(binary.PutUvarint(tmp, uint64(len(v))))
-		// Size of the symbol.
-		symTblSize += uint64(len(v))
-	}
-
 	pb := &Block{
 		dir:             dir,
 		meta:            *meta,
 		chunkr:          cr,
 		indexr:          ir,
 		tombstones:      tr,
-		symbolTableSize: symTblSize,
+		symbolTableSize: ir.SymbolTableSize(),
 	}
 	return pb, nil
 }
@@ -309,6 +329,9 @@ func (pb *Block) Close() error {
 	merr.Add(pb.indexr.Close())
 	merr.Add(pb.tombstones.Close())
 
+	if pb.cache != nil {
+		pb.cache.dropBlock(pb.meta.ULID)
+	}
 	return merr.Err()
 }
 
@@ -341,7 +364,11 @@ func (pb *Block) Index() (IndexReader, error) {
 	if err := pb.startRead(); err != nil {
 		return nil, err
 	}
-	return blockIndexReader{ir: pb.indexr, b: pb}, nil
+	r := blockIndexReader{ir: pb.indexr, b: pb}
+	if pb.cache != nil {
+		return cachingIndexReader{r}, nil
+	}
+	return r, nil
 }
 
 // Chunks returns a new ChunkReader against the block data.
@@ -395,11 +422,24 @@ func (r blockIndexReader) SortedPostings(p index.Postings) index.Postings {
 }
 
 func (r blockIndexReader) Series(ref uint64, lset *labels.Labels, chks *[]chunks.Meta) error {
-	return errors.Wrapf(
-		r.ir.Series(ref, lset, chks),
-		"block: %s",
-		r.b.Meta().ULID,
-	)
+	c := r.b.cache
+	if c == nil {
+		return errors.Wrapf(
+			r.ir.Series(ref, lset, chks),
+			"block: %s",
+			r.b.Meta().ULID,
+		)
+	}
+	if s, ok := c.series(r.b.meta.ULID, ref); ok {
+		*lset = append((*lset)[:0], s.lset...)
+		*chks = append((*chks)[:0], s.chks...)
+		return nil
+	}
+	if err := r.ir.Series(ref, lset, chks); err != nil {
+		return errors.Wrapf(err, "block: %s", r.b.Meta().ULID)
+	}
+	c.setSeries(r.b.meta.ULID, ref, *lset, *chks)
+	return nil
 }
 
 func (r blockIndexReader) LabelIndices() ([][]string, error) {
@@ -412,6 +452,28 @@ func (r blockIndexReader) Close() error {
 	return nil
 }
 
+// cachingIndexReader is the index reader of blocks with an index cache.
+// Unlike blockIndexReader, it caches the postings lists of queries.
+type cachingIndexReader struct {
+	blockIndexReader
+}
+
+// cachedPostings returns the cached postings list for the given matchers.
+func (r cachingIndexReader) cachedPostings(ms []labels.Matcher) ([]uint64, bool) {
+	key, ok := matchersCacheKey(ms)
+	if !ok {
+		return nil, false
+	}
+	return r.b.cache.postings(r.b.meta.ULID, key)
+}
+
+// cachePostings stores the postings list for the given matchers in the cache.
+func (r cachingIndexReader) cachePostings(ms []labels.Matcher, refs []uint64) {
+	if key, ok := matchersCacheKey(ms); ok {
+		r.b.cache.setPostings(r.b.meta.ULID, key, refs)
+	}
+}
+
 type blockTombstoneReader struct {
 	TombstoneReader
 	b *Block
@@ -147,7 +147,7 @@ func Checkpoint(w *wal.WAL, from, to int, keep func(id uint64) bool, mint int64)
 	if err := os.MkdirAll(cpdirtmp, 0777); err != nil {
 		return nil, errors.Wrap(err, "create checkpoint dir")
 	}
-	cp, err := wal.New(nil, nil, cpdirtmp)
+	cp, err := wal.NewWithOptions(nil, nil, cpdirtmp, wal.Options{Compression: w.Compression()})
 	if err != nil {
 		return nil, errors.Wrap(err, "open checkpoint")
 	}
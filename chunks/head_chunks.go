@@ -0,0 +1,404 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+const (
+	// MagicHeadChunks is 4 bytes at the beginning of a head chunk file.
+	MagicHeadChunks = 0x0130BC91
+
+	headChunksFormatV1 = 1
+
+	// MaxHeadChunkFileSize is the size up to which a head chunk file is filled.
+	MaxHeadChunkFileSize = 128 * 1024 * 1024
+
+	headChunkFileHeaderSize = 8
+	// Series reference, min time and max time of a chunk.
+	headChunkMetaSize = 8 + 8 + 8
+)
+
+// CorruptionErr is returned if a head chunk file cannot be read.
+type CorruptionErr struct {
+	File   int
+	Offset int
+	Err    error
+}
+
+func (e *CorruptionErr) Error() string {
+	return fmt.Sprintf("corruption in head chunk file %d at %d: %s", e.File, e.Offset, e.Err)
+}
+
+// headChunkFile is a memory-mapped head chunk file.
+type headChunkFile struct {
+	*fileutil.MmapFile
+	path string
+	maxt int64 // Highest max time of all chunks in the file.
+}
+
+// headChunk is a chunk record within a head chunk file.
+type headChunk struct {
+	seriesRef  uint64
+	mint, maxt int64
+	enc        chunkenc.Encoding
+	data       []byte
+	size       int // Size of the record in bytes.
+}
+
+// ChunkDiskMapper writes completed chunks of the head block to append-only files
+// and memory-maps them for reading. Chunks are referenced by the sequence number
+// of their file in the upper 4 bytes and their offset within it in the lower 4 bytes.
+//
+// Files are preallocated to MaxHeadChunkFileSize. The unused remainder is zeroed,
+// which marks the end of the written data.
+type ChunkDiskMapper struct {
+	dir string
+
+	mtx     sync.RWMutex
+	files   map[int]*headChunkFile
+	cur     *os.File // File currently being written to.
+	curSeq  int
+	curSize int
+
+	buf   []byte
+	crc32 hash.Hash
+}
+
+// NewChunkDiskMapper returns a new ChunkDiskMapper against the given directory.
+// Existing files are opened for reading and validated. A *CorruptionErr is returned
+// if any of them cannot be read entirely. New chunks are always written to a new file.
+func NewChunkDiskMapper(dir string) (*ChunkDiskMapper, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	w := &ChunkDiskMapper{
+		dir:   dir,
+		files: map[int]*headChunkFile{},
+		crc32: newCRC32(),
+	}
+	fns, err := sequenceFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range fns {
+		seq, err := strconv.Atoi(filepath.Base(fn))
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		mf, err := fileutil.OpenMmapFile(fn)
+		if err != nil {
+			w.Close()
+			return nil, errors.Wrapf(err, "mmap head chunk file %d", seq)
+		}
+		f := &headChunkFile{MmapFile: mf, path: fn, maxt: math.MinInt64}
+		w.files[seq] = f
+
+		err = w.iterateFile(seq, f, func(c headChunk, _ uint64) error {
+			if c.maxt > f.maxt {
+				f.maxt = c.maxt
+			}
+			return nil
+		})
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.curSeq = seq
+	}
+	return w, nil
+}
+
+// Dir returns the directory of the head chunk files.
+func (w *ChunkDiskMapper) Dir() string {
+	return w.dir
+}
+
+// WriteChunk writes the chunk of the given series and returns its reference.
+// Series references must not be zero.
+func (w *ChunkDiskMapper) WriteChunk(seriesRef uint64, mint, maxt int64, chk chunkenc.Chunk) (uint64, error) {
+	if seriesRef == 0 {
+		return 0, errors.New("invalid series reference 0")
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	var b [binary.MaxVarintLen64]byte
+
+	rec := w.buf[:0]
+
+	binary.BigEndian.PutUint64(b[:], seriesRef)
+	rec = append(rec, b[:8]...)
+	binary.BigEndian.PutUint64(b[:], uint64(mint))
+	rec = append(rec, b[:8]...)
+	binary.BigEndian.PutUint64(b[:], uint64(maxt))
+	rec = append(rec, b[:8]...)
+
+	rec = append(rec, byte(chk.Encoding()))
+	n := binary.PutUvarint(b[:], uint64(len(chk.Bytes())))
+	rec = append(rec, b[:n]...)
+	rec = append(rec, chk.Bytes()...)
+
+	w.crc32.Reset()
+	if _, err := w.crc32.Write(rec); err != nil {
+		return 0, err
+	}
+	rec = w.crc32.Sum(rec)
+	w.buf = rec
+
+	if w.cur == nil || w.curSize+len(rec) > MaxHeadChunkFileSize {
+		if err := w.cut(); err != nil {
+			return 0, errors.Wrap(err, "cut head chunk file")
+		}
+	}
+	ref := uint64(w.curSeq)<<32 | uint64(w.curSize)
+
+	if _, err := w.cur.WriteAt(rec, int64(w.curSize)); err != nil {
+		return 0, err
+	}
+	w.curSize += len(rec)
+
+	if f := w.files[w.curSeq]; maxt > f.maxt {
+		f.maxt = maxt
+	}
+	return ref, nil
+}
+
+// cut finalizes the current file and starts a new one.
+func (w *ChunkDiskMapper) cut() error {
+	if err := w.finalizeCur(); err != nil {
+		return err
+	}
+	seq := w.curSeq + 1
+	fn := filepath.Join(w.dir, fmt.Sprintf("%0.6d", seq))
+
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if err := fileutil.Preallocate(f, MaxHeadChunkFileSize, true); err != nil {
+		f.Close()
+		return err
+	}
+	metab := make([]byte, headChunkFileHeaderSize)
+	binary.BigEndian.PutUint32(metab[:4], MagicHeadChunks)
+	metab[4] = headChunksFormatV1
+
+	if _, err := f.WriteAt(metab, 0); err != nil {
+		f.Close()
+		return err
+	}
+	mf, err := fileutil.OpenMmapFile(fn)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.files[seq] = &headChunkFile{MmapFile: mf, path: fn, maxt: math.MinInt64}
+	w.cur, w.curSeq, w.curSize = f, seq, headChunkFileHeaderSize
+
+	return nil
+}
+
+// finalizeCur syncs and closes the file currently being written to.
+func (w *ChunkDiskMapper) finalizeCur() error {
+	if w.cur == nil {
+		return nil
+	}
+	f := w.cur
+	w.cur = nil
+
+	if err := fileutil.Fsync(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Chunk returns the chunk for the reference. The returned chunk holds a copy
+// of the data, which stays valid after its file was truncated.
+func (w *ChunkDiskMapper) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	var (
+		seq = int(ref >> 32)
+		off = int((ref << 32) >> 32)
+	)
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+
+	f, ok := w.files[seq]
+	if !ok {
+		return nil, errors.Errorf("head chunk file %d does not exist", seq)
+	}
+	c, err := readHeadChunk(f.Bytes(), off)
+	if err != nil {
+		return nil, &CorruptionErr{File: seq, Offset: off, Err: err}
+	}
+	if c.seriesRef == 0 {
+		return nil, errors.Errorf("no chunk at offset %d in head chunk file %d", off, seq)
+	}
+	return chunkenc.FromData(c.enc, append([]byte(nil), c.data...))
+}
+
+// IterateAllChunks calls f for all chunks in the order they were written.
+func (w *ChunkDiskMapper) IterateAllChunks(f func(seriesRef, chunkRef uint64, mint, maxt int64) error) error {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+
+	seqs := make([]int, 0, len(w.files))
+	for seq := range w.files {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	for _, seq := range seqs {
+		err := w.iterateFile(seq, w.files[seq], func(c headChunk, ref uint64) error {
+			return f(c.seriesRef, ref, c.mint, c.maxt)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iterateFile calls f for all chunks in the file with the given sequence number.
+func (w *ChunkDiskMapper) iterateFile(seq int, f *headChunkFile, fn func(c headChunk, ref uint64) error) error {
+	b := f.Bytes()
+
+	if len(b) < headChunkFileHeaderSize {
+		return &CorruptionErr{File: seq, Err: errInvalidSize}
+	}
+	if m := binary.BigEndian.Uint32(b[:4]); m != MagicHeadChunks {
+		return &CorruptionErr{File: seq, Err: errors.Errorf("invalid magic number %x", m)}
+	}
+	if v := b[4]; v != headChunksFormatV1 {
+		return &CorruptionErr{File: seq, Err: errors.Errorf("unknown format version %d", v)}
+	}
+	for off := headChunkFileHeaderSize; off < len(b); {
+		c, err := readHeadChunk(b, off)
+		if err != nil {
+			return &CorruptionErr{File: seq, Offset: off, Err: err}
+		}
+		// The zeroed remainder of the file was reached.
+		if c.seriesRef == 0 {
+			return nil
+		}
+		if err := fn(c, uint64(seq)<<32|uint64(off)); err != nil {
+			return err
+		}
+		off += c.size
+	}
+	return nil
+}
+
+// readHeadChunk reads the chunk record at off. A chunk with series reference zero
+// is returned if the record lies in the unused remainder of the file.
+func readHeadChunk(b []byte, off int) (headChunk, error) {
+	var c headChunk
+
+	if off+headChunkMetaSize > len(b) {
+		// Not enough space for another record.
+		return c, nil
+	}
+	r := b[off:]
+
+	c.seriesRef = binary.BigEndian.Uint64(r[0:8])
+	if c.seriesRef == 0 {
+		return c, nil
+	}
+	c.mint = int64(binary.BigEndian.Uint64(r[8:16]))
+	c.maxt = int64(binary.BigEndian.Uint64(r[16:24]))
+
+	r = r[headChunkMetaSize:]
+	if len(r) < 1 {
+		return c, errInvalidSize
+	}
+	c.enc = chunkenc.Encoding(r[0])
+
+	l, n := binary.Uvarint(r[1:])
+	if n <= 0 {
+		return c, errors.Errorf("reading chunk length failed with %d", n)
+	}
+	start := headChunkMetaSize + 1 + n
+	end := start + int(l)
+
+	if off+end+4 > len(b) {
+		return c, errInvalidSize
+	}
+	c.data = b[off+start : off+end]
+	c.size = end + 4
+
+	// The checksum covers the entire record.
+	h := newCRC32()
+	if _, err := h.Write(b[off : off+end]); err != nil {
+		return c, err
+	}
+	if exp, got := binary.BigEndian.Uint32(b[off+end:]), h.Sum32(); exp != got {
+		return c, errInvalidChecksum
+	}
+	return c, nil
+}
+
+// Truncate deletes all files that only hold chunks with a max time before mint.
+// The file currently being written to is never deleted.
+func (w *ChunkDiskMapper) Truncate(mint int64) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	var merr error
+
+	for seq, f := range w.files {
+		if f.maxt >= mint || (w.cur != nil && seq == w.curSeq) {
+			continue
+		}
+		delete(w.files, seq)
+
+		if err := f.Close(); err != nil {
+			merr = err
+		}
+		if err := os.Remove(f.path); err != nil {
+			merr = err
+		}
+	}
+	return merr
+}
+
+// Close finalizes the current file and releases all memory-mapped files.
+func (w *ChunkDiskMapper) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	err := w.finalizeCur()
+
+	for seq, f := range w.files {
+		if cerr := f.Close(); cerr != nil {
+			err = cerr
+		}
+		delete(w.files, seq)
+	}
+	return err
+}
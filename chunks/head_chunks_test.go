@@ -0,0 +1,140 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestChunkDiskMapper_WriteRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "head_chunks")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cdm, err := NewChunkDiskMapper(dir)
+	testutil.Ok(t, err)
+
+	type expChunk struct {
+		seriesRef, ref uint64
+		mint, maxt     int64
+		chk            chunkenc.Chunk
+	}
+	var exp []expChunk
+
+	for i := 1; i <= 100; i++ {
+		chk := chunkenc.NewXORChunk()
+		app, err := chk.Appender()
+		testutil.Ok(t, err)
+
+		mint, maxt := int64(i*1000), int64(i*1000+int(i))
+		for ts := mint; ts <= maxt; ts++ {
+			app.Append(ts, float64(ts))
+		}
+		ref, err := cdm.WriteChunk(uint64(i%7+1), mint, maxt, chk)
+		testutil.Ok(t, err)
+
+		exp = append(exp, expChunk{seriesRef: uint64(i%7 + 1), ref: ref, mint: mint, maxt: maxt, chk: chk})
+	}
+	_, err = cdm.WriteChunk(0, 0, 0, chunkenc.NewXORChunk())
+	testutil.NotOk(t, err)
+
+	verify := func(cdm *ChunkDiskMapper) {
+		for _, e := range exp {
+			chk, err := cdm.Chunk(e.ref)
+			testutil.Ok(t, err)
+			testutil.Equals(t, e.chk.Bytes(), chk.Bytes())
+		}
+		i := 0
+		err := cdm.IterateAllChunks(func(seriesRef, chunkRef uint64, mint, maxt int64) error {
+			e := exp[i]
+			testutil.Equals(t, e.seriesRef, seriesRef)
+			testutil.Equals(t, e.ref, chunkRef)
+			testutil.Equals(t, e.mint, mint)
+			testutil.Equals(t, e.maxt, maxt)
+			i++
+			return nil
+		})
+		testutil.Ok(t, err)
+		testutil.Equals(t, len(exp), i)
+	}
+	verify(cdm)
+	testutil.Ok(t, cdm.Close())
+
+	// Chunks remain readable after reopening and new chunks go into a new file.
+	cdm, err = NewChunkDiskMapper(dir)
+	testutil.Ok(t, err)
+	defer cdm.Close()
+
+	verify(cdm)
+
+	ref, err := cdm.WriteChunk(1, 200000, 200001, exp[0].chk)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp[0].ref>>32+1, ref>>32)
+
+	// Truncation deletes the first file but keeps the one being written to.
+	testutil.Ok(t, cdm.Truncate(300000))
+
+	files, err := sequenceFiles(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(files))
+
+	_, err = cdm.Chunk(exp[0].ref)
+	testutil.NotOk(t, err)
+
+	chk, err := cdm.Chunk(ref)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp[0].chk.Bytes(), chk.Bytes())
+}
+
+func TestChunkDiskMapper_Corruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "head_chunks")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cdm, err := NewChunkDiskMapper(dir)
+	testutil.Ok(t, err)
+
+	chk := chunkenc.NewXORChunk()
+	app, err := chk.Appender()
+	testutil.Ok(t, err)
+	app.Append(1, 1)
+
+	ref, err := cdm.WriteChunk(1, 1, 1, chk)
+	testutil.Ok(t, err)
+	testutil.Ok(t, cdm.Close())
+
+	// Flip a bit in the chunk data.
+	fn := filepath.Join(dir, "000001")
+	f, err := os.OpenFile(fn, os.O_RDWR, 0666)
+	testutil.Ok(t, err)
+
+	b := make([]byte, 1)
+	off := int64(ref&0xffffffff) + headChunkMetaSize + 3
+	_, err = f.ReadAt(b, off)
+	testutil.Ok(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, off)
+	testutil.Ok(t, err)
+	testutil.Ok(t, f.Close())
+
+	_, err = NewChunkDiskMapper(dir)
+	_, ok := err.(*CorruptionErr)
+	testutil.Assert(t, ok, "expected corruption error but got %v", err)
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -48,6 +49,24 @@ func main() {
 		listCmd              = cli.Command("ls", "list db blocks")
 		listCmdHumanReadable = listCmd.Flag("human-readable", "print human readable values").Short('h').Bool()
 		listPath             = listCmd.Arg("db path", "database path (default is "+filepath.Join("benchout", "storage")+")").Default(filepath.Join("benchout", "storage")).String()
+		restoreCmd           = cli.Command("restore", "rebuild a db from a chain of backups")
+		restorePath          = restoreCmd.Arg("db path", "empty directory to restore the database into").Required().String()
+		restoreBackups       = restoreCmd.Arg("backups", "backup directories in the order they were taken").Required().Strings()
+		walCmd               = cli.Command("wal", "inspect the write ahead log of a db")
+		walLsCmd             = walCmd.Command("ls", "list checkpoints and segments with their record counts")
+		walLsHumanReadable   = walLsCmd.Flag("human-readable", "print human readable values").Short('h').Bool()
+		walLsPath            = walLsCmd.Arg("db path", "database path (default is "+filepath.Join("benchout", "storage")+")").Default(filepath.Join("benchout", "storage")).String()
+		walDumpCmd           = walCmd.Command("dump", "print the decoded records")
+		walDumpMatch         = walDumpCmd.Flag("match", "only print series matching the selector, given as name=value or name=~regex").Strings()
+		walDumpMinTime       = walDumpCmd.Flag("min-time", "only print samples and tombstones at or after this timestamp").Default(strconv.FormatInt(math.MinInt64, 10)).Int64()
+		walDumpMaxTime       = walDumpCmd.Flag("max-time", "only print samples and tombstones at or before this timestamp").Default(strconv.FormatInt(math.MaxInt64, 10)).Int64()
+		walDumpPath          = walDumpCmd.Arg("db path", "database path (default is "+filepath.Join("benchout", "storage")+")").Default(filepath.Join("benchout", "storage")).String()
+		walCheckCmd          = walCmd.Command("check", "report the first corruption without modifying the write ahead log")
+		walCheckPath         = walCheckCmd.Arg("db path", "database path (default is "+filepath.Join("benchout", "storage")+")").Default(filepath.Join("benchout", "storage")).String()
+		rewriteCmd           = cli.Command("rewrite", "write a copy of a block with relabeled series, replacing the original once the db is opened next")
+		rewritePath          = rewriteCmd.Arg("db path", "database path").Required().String()
+		rewriteBlockID       = rewriteCmd.Flag("block", "ID of the block to rewrite").Required().String()
+		rewriteConfigFile    = rewriteCmd.Flag("config", "YAML file with the relabel_configs to apply").Required().String()
 	)
 
 	switch kingpin.MustParse(cli.Parse(os.Args[1:])) {
@@ -64,6 +83,30 @@ func main() {
 			exitWithError(err)
 		}
 		printBlocks(db.Blocks(), listCmdHumanReadable)
+	case restoreCmd.FullCommand():
+		if err := tsdb.Restore(*restorePath, *restoreBackups...); err != nil {
+			exitWithError(err)
+		}
+	case walLsCmd.FullCommand():
+		if err := listWAL(filepath.Join(*walLsPath, "wal"), *walLsHumanReadable); err != nil {
+			exitWithError(err)
+		}
+	case walDumpCmd.FullCommand():
+		ms, err := parseMatchers(*walDumpMatch)
+		if err != nil {
+			exitWithError(err)
+		}
+		if err := dumpWAL(filepath.Join(*walDumpPath, "wal"), ms, *walDumpMinTime, *walDumpMaxTime); err != nil {
+			exitWithError(err)
+		}
+	case walCheckCmd.FullCommand():
+		if err := checkWAL(filepath.Join(*walCheckPath, "wal")); err != nil {
+			exitWithError(err)
+		}
+	case rewriteCmd.FullCommand():
+		if err := rewriteBlock(*rewritePath, *rewriteBlockID, *rewriteConfigFile); err != nil {
+			exitWithError(err)
+		}
 	}
 	flag.CommandLine.Set("log.level", "debug")
 }
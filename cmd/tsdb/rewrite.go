@@ -0,0 +1,113 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/fileutil"
+	"github.com/prometheus/tsdb/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+// rewriteConfig is the file format of the rules applied by the rewrite command.
+type rewriteConfig struct {
+	RelabelConfigs []struct {
+		SourceLabels []string `yaml:"source_labels"`
+		Separator    string   `yaml:"separator"`
+		Regex        string   `yaml:"regex"`
+		TargetLabel  string   `yaml:"target_label"`
+		Replacement  string   `yaml:"replacement"`
+		Action       string   `yaml:"action"`
+	} `yaml:"relabel_configs"`
+}
+
+// loadRelabelConfigs reads the relabel configs from a YAML file.
+func loadRelabelConfigs(fn string) ([]*relabel.Config, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var rc rewriteConfig
+	if err := yaml.UnmarshalStrict(b, &rc); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", fn)
+	}
+	var cfgs []*relabel.Config
+
+	for i, c := range rc.RelabelConfigs {
+		cfg := &relabel.Config{
+			SourceLabels: c.SourceLabels,
+			Separator:    c.Separator,
+			TargetLabel:  c.TargetLabel,
+			Replacement:  c.Replacement,
+			Action:       relabel.Action(c.Action),
+		}
+		if c.Regex != "" {
+			if cfg.Regex, err = relabel.NewRegexp(c.Regex); err != nil {
+				return nil, errors.Wrapf(err, "relabel config %d", i)
+			}
+		}
+		if err := cfg.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "relabel config %d", i)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+// rewriteBlock writes a relabeled copy of the block to the DB. The DB must
+// not be in use. The original block is deleted once the DB is opened again.
+func rewriteBlock(dbDir, id, configFile string) error {
+	if _, err := ulid.Parse(id); err != nil {
+		return errors.Wrapf(err, "invalid block ID %q", id)
+	}
+	cfgs, err := loadRelabelConfigs(configFile)
+	if err != nil {
+		return err
+	}
+	absdir, err := filepath.Abs(dbDir)
+	if err != nil {
+		return err
+	}
+	lockf, _, err := fileutil.Flock(filepath.Join(absdir, "lock"))
+	if err != nil {
+		return errors.Wrap(err, "lock DB directory")
+	}
+	defer lockf.Release()
+
+	b, err := tsdb.OpenBlock(filepath.Join(dbDir, id), nil)
+	if err != nil {
+		return errors.Wrapf(err, "open block %s", id)
+	}
+	defer b.Close()
+
+	c, err := tsdb.NewLeveledCompactor(nil, log.NewNopLogger(), tsdb.DefaultOptions.BlockRanges, nil)
+	if err != nil {
+		return err
+	}
+	meta := b.Meta()
+
+	uid, err := c.Rewrite(dbDir, b, &meta, cfgs...)
+	if err != nil {
+		return errors.Wrapf(err, "rewrite block %s", id)
+	}
+	fmt.Printf("rewrote block %s to %s, the original block is deleted when the DB is opened next\n", id, uid)
+	return nil
+}
@@ -0,0 +1,307 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/wal"
+)
+
+// walSource is a checkpoint or a single segment of a WAL directory.
+type walSource struct {
+	name       string
+	dir        string
+	segment    int // -1 for checkpoints.
+	size       int64
+	checkpoint bool
+}
+
+func (s walSource) open() (io.ReadCloser, error) {
+	if s.checkpoint {
+		return wal.NewSegmentsReader(filepath.Join(s.dir, s.name))
+	}
+	return wal.NewSegmentsRangeReader(s.dir, s.segment, s.segment)
+}
+
+// listWALSources returns the checkpoints in dir followed by its segments,
+// both in ascending order.
+func listWALSources(dir string) ([]walSource, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoints, segments []walSource
+
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), "checkpoint.") && fi.IsDir() {
+			if _, err := strconv.Atoi(strings.TrimPrefix(fi.Name(), "checkpoint.")); err != nil {
+				continue
+			}
+			size, err := dirSize(filepath.Join(dir, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			checkpoints = append(checkpoints, walSource{
+				name:       fi.Name(),
+				dir:        dir,
+				segment:    -1,
+				size:       size,
+				checkpoint: true,
+			})
+			continue
+		}
+		k, err := strconv.Atoi(fi.Name())
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		segments = append(segments, walSource{
+			name:    fi.Name(),
+			dir:     dir,
+			segment: k,
+			size:    fi.Size(),
+		})
+	}
+	return append(checkpoints, segments...), nil
+}
+
+func dirSize(dir string) (int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, fi := range files {
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// readWALSource passes all records of s to fn. It returns the corruption
+// error of the reader, if any.
+func readWALSource(s walSource, fn func(rec []byte) error) error {
+	rc, err := s.open()
+	if err != nil {
+		return errors.Wrapf(err, "open %s", s.name)
+	}
+	defer rc.Close()
+
+	r := wal.NewReader(rc)
+	for r.Next() {
+		if err := fn(r.Record()); err != nil {
+			return err
+		}
+	}
+	return r.Err()
+}
+
+func listWAL(dir string, humanReadable bool) error {
+	sources, err := listWALSources(dir)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintln(tw, "NAME\tSIZE\tRECORDS\tSERIES\tSAMPLES\tTOMBSTONES\tINVALID\tSTATUS")
+
+	var dec tsdb.RecordDecoder
+	for _, s := range sources {
+		var (
+			total  int
+			counts = map[tsdb.RecordType]int{}
+		)
+		status := "ok"
+		if err := readWALSource(s, func(rec []byte) error {
+			total++
+			counts[dec.Type(rec)]++
+			return nil
+		}); err != nil {
+			status = err.Error()
+		}
+		size := strconv.FormatInt(s.size, 10)
+		if humanReadable {
+			size = formatBytes(s.size)
+		}
+		fmt.Fprintf(tw,
+			"%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			s.name,
+			size,
+			total,
+			counts[tsdb.RecordSeries],
+			counts[tsdb.RecordSamples],
+			counts[tsdb.RecordTombstones],
+			counts[tsdb.RecordInvalid],
+			status,
+		)
+	}
+	return nil
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// checkWAL reads all records in dir and reports the first corruption.
+func checkWAL(dir string) error {
+	sources, err := listWALSources(dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range sources {
+		err := readWALSource(s, func([]byte) error { return nil })
+		if err == nil {
+			continue
+		}
+		if cerr, ok := err.(*wal.CorruptionErr); ok && s.checkpoint {
+			return errors.Errorf("corruption in checkpoint %s, segment %d at %d: %s", s.name, cerr.Segment, cerr.Offset, cerr.Err)
+		}
+		return err
+	}
+	fmt.Printf("checked %d checkpoints and segments, no corruption found\n", len(sources))
+	return nil
+}
+
+// parseMatchers parses selectors of the form name=value and name=~regex.
+func parseMatchers(sels []string) ([]labels.Matcher, error) {
+	var ms []labels.Matcher
+
+	for _, s := range sels {
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("invalid selector %q", s)
+		}
+		name, value := s[:i], s[i+1:]
+
+		if strings.HasPrefix(value, "~") {
+			m, err := labels.NewRegexpMatcher(name, value[1:])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid selector %q", s)
+			}
+			ms = append(ms, m)
+			continue
+		}
+		ms = append(ms, labels.NewEqualMatcher(name, value))
+	}
+	return ms, nil
+}
+
+func matchesAll(lset labels.Labels, ms []labels.Matcher) bool {
+	for _, m := range ms {
+		if !m.Matches(lset.Get(m.Name())) {
+			return false
+		}
+	}
+	return true
+}
+
+// dumpWAL prints the decoded records in dir. Samples and tombstones are only
+// printed for series matching all matchers and within the given time range.
+func dumpWAL(dir string, ms []labels.Matcher, mint, maxt int64) error {
+	sources, err := listWALSources(dir)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	var (
+		dec     tsdb.RecordDecoder
+		series  []tsdb.RefSeries
+		samples []tsdb.RefSample
+		tstones []tsdb.Stone
+		// Series references that match the selectors.
+		selected = map[uint64]bool{}
+	)
+	for _, s := range sources {
+		err := readWALSource(s, func(rec []byte) (err error) {
+			switch dec.Type(rec) {
+			case tsdb.RecordSeries:
+				if series, err = dec.Series(rec, series[:0]); err != nil {
+					return errors.Wrap(err, "decode series")
+				}
+				for _, sr := range series {
+					if !matchesAll(sr.Labels, ms) {
+						continue
+					}
+					selected[sr.Ref] = true
+					fmt.Fprintf(w, "%s series ref=%d %s\n", sourceName(s), sr.Ref, sr.Labels)
+				}
+			case tsdb.RecordSamples:
+				if samples, err = dec.Samples(rec, samples[:0]); err != nil {
+					return errors.Wrap(err, "decode samples")
+				}
+				for _, smpl := range samples {
+					if !selected[smpl.Ref] || smpl.T < mint || smpl.T > maxt {
+						continue
+					}
+					fmt.Fprintf(w, "%s sample ref=%d t=%d v=%g\n", sourceName(s), smpl.Ref, smpl.T, smpl.V)
+				}
+			case tsdb.RecordTombstones:
+				if tstones, err = dec.Tombstones(rec, tstones[:0]); err != nil {
+					return errors.Wrap(err, "decode tombstones")
+				}
+				for _, st := range tstones {
+					if !selected[st.Ref()] || !overlaps(st.Intervals(), mint, maxt) {
+						continue
+					}
+					fmt.Fprintf(w, "%s tombstone ref=%d intervals=%v\n", sourceName(s), st.Ref(), st.Intervals())
+				}
+			default:
+				fmt.Fprintf(w, "%s invalid record of %d bytes\n", sourceName(s), len(rec))
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "read %s", s.name)
+		}
+	}
+	return nil
+}
+
+func sourceName(s walSource) string {
+	if s.checkpoint {
+		return s.name
+	}
+	return "segment." + s.name
+}
+
+func overlaps(ivs tsdb.Intervals, mint, maxt int64) bool {
+	for _, iv := range ivs {
+		if iv.Mint <= maxt && mint <= iv.Maxt {
+			return true
+		}
+	}
+	return false
+}
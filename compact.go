@@ -16,10 +16,12 @@ package tsdb
 import (
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -62,13 +64,33 @@ type Compactor interface {
 	Compact(dest string, dirs ...string) (ulid.ULID, error)
 }
 
+// Planner selects the blocks to compact.
+type Planner interface {
+	// Plan returns groups of block directories that are each compacted into
+	// a single new block. The groups must not overlap. The metas are sorted
+	// by their minimum time and do not include the most recent block.
+	Plan(metas []DirMeta) ([][]string, error)
+}
+
 // LeveledCompactor implements the Compactor interface.
 type LeveledCompactor struct {
 	dir       string
 	metrics   *compactorMetrics
 	logger    log.Logger
-	ranges    []int64
+	planner   Planner
 	chunkPool chunkenc.Pool
+
+	retentionMtx   sync.RWMutex
+	retentionRules []RetentionRule
+	retentionRef   func() int64
+}
+
+// RetentionRule limits the retention of the series matching its selector.
+type RetentionRule struct {
+	Selector labels.Selector
+
+	// Duration of data to keep in milliseconds.
+	Duration int64
 }
 
 type compactorMetrics struct {
@@ -78,6 +100,8 @@ type compactorMetrics struct {
 	chunkSize    prometheus.Histogram
 	chunkSamples prometheus.Histogram
 	chunkRange   prometheus.Histogram
+
+	retentionDroppedChunks prometheus.Counter
 }
 
 func newCompactorMetrics(r prometheus.Registerer) *compactorMetrics {
@@ -111,6 +135,10 @@ func newCompactorMetrics(r prometheus.Registerer) *compactorMetrics {
 		Help:    "Final time range of chunks on their first compaction",
 		Buckets: prometheus.ExponentialBuckets(100, 4, 10),
 	})
+	m.retentionDroppedChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_compaction_retention_dropped_chunks_total",
+		Help: "Total number of chunks dropped during compaction by retention rules.",
+	})
 
 	if r != nil {
 		r.MustRegister(
@@ -120,30 +148,116 @@ func newCompactorMetrics(r prometheus.Registerer) *compactorMetrics {
 			m.chunkRange,
 			m.chunkSamples,
 			m.chunkSize,
+			m.retentionDroppedChunks,
 		)
 	}
 	return m
 }
 
-// NewLeveledCompactor returns a LeveledCompactor.
+// NewLeveledCompactor returns a LeveledCompactor planning compactions with
+// a LeveledPlanner for the given ranges.
 func NewLeveledCompactor(r prometheus.Registerer, l log.Logger, ranges []int64, pool chunkenc.Pool) (*LeveledCompactor, error) {
-	if len(ranges) == 0 {
-		return nil, errors.Errorf("at least one range must be provided")
+	p, err := NewLeveledPlanner(ranges)
+	if err != nil {
+		return nil, err
+	}
+	return NewLeveledCompactorWithPlanner(r, l, p, pool)
+}
+
+// NewLeveledCompactorWithPlanner returns a LeveledCompactor planning
+// compactions with the given planner.
+func NewLeveledCompactorWithPlanner(r prometheus.Registerer, l log.Logger, p Planner, pool chunkenc.Pool) (*LeveledCompactor, error) {
+	if p == nil {
+		return nil, errors.Errorf("a planner must be provided")
 	}
 	if pool == nil {
 		pool = chunkenc.NewPool()
 	}
 	return &LeveledCompactor{
-		ranges:    ranges,
+		planner:   p,
 		chunkPool: pool,
 		logger:    l,
 		metrics:   newCompactorMetrics(r),
 	}, nil
 }
 
-type dirMeta struct {
-	dir  string
-	meta *BlockMeta
+// SetRetentionRules sets the retention rules applied by all following
+// compactions. Chunks of series matching a rule are dropped once they end
+// more than the rule's duration before the timestamp returned by ref.
+// If a series matches multiple rules, the first one applies.
+// Blocks are rewritten on their own once the horizon of a rule passed their
+// end, even if they are not compacted again. Rules are identified by their
+// selector for this.
+func (c *LeveledCompactor) SetRetentionRules(rules []RetentionRule, ref func() int64) {
+	c.retentionMtx.Lock()
+	defer c.retentionMtx.Unlock()
+
+	c.retentionRules = rules
+	c.retentionRef = ref
+}
+
+// retentionHorizons returns a function returning the timestamp before which
+// chunks of a series are dropped. It returns false if the series is kept entirely.
+// It also returns the keys of the rules whose horizon passed maxt.
+func (c *LeveledCompactor) retentionHorizons(maxt int64) (func(labels.Labels) (int64, bool), []string) {
+	c.retentionMtx.RLock()
+	rules, ref := c.retentionRules, c.retentionRef
+	c.retentionMtx.RUnlock()
+
+	if len(rules) == 0 || ref == nil {
+		return func(labels.Labels) (int64, bool) { return 0, false }, nil
+	}
+	// There is no reference for the horizons without any data.
+	t := ref()
+	if t == math.MinInt64 {
+		return func(labels.Labels) (int64, bool) { return 0, false }, nil
+	}
+	var expired []string
+	for _, r := range rules {
+		if t-r.Duration >= maxt {
+			expired = append(expired, r.key())
+		}
+	}
+	return func(lset labels.Labels) (int64, bool) {
+		for _, r := range rules {
+			if r.Selector.Matches(lset) {
+				return t - r.Duration, true
+			}
+		}
+		return 0, false
+	}, expired
+}
+
+// key identifies the rule in the metas of the blocks it expired for.
+func (r RetentionRule) key() string {
+	return fmt.Sprint(r.Selector)
+}
+
+// retentionExpired returns true if the horizon of a retention rule passed the
+// end of the block since it was written. The data of the rule's series is
+// only dropped once the block is rewritten.
+func (c *LeveledCompactor) retentionExpired(meta *BlockMeta) bool {
+	if meta.Compaction.Failed {
+		return false
+	}
+	_, expired := c.retentionHorizons(meta.MaxTime)
+
+Outer:
+	for _, k := range expired {
+		for _, applied := range meta.Compaction.ExpiredRules {
+			if k == applied {
+				continue Outer
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// DirMeta is a block directory and its meta data.
+type DirMeta struct {
+	Dir  string
+	Meta *BlockMeta
 }
 
 // Plan returns a list of compactable blocks in the provided directory.
@@ -156,43 +270,79 @@ func (c *LeveledCompactor) Plan(dir string) ([]string, error) {
 		return nil, nil
 	}
 
-	var dms []dirMeta
+	var dms []DirMeta
 	for _, dir := range dirs {
 		meta, err := readMetaFile(dir)
 		if err != nil {
 			return nil, err
 		}
-		dms = append(dms, dirMeta{dir, meta})
+		dms = append(dms, DirMeta{dir, meta})
 	}
 	return c.plan(dms)
 }
 
-func (c *LeveledCompactor) plan(dms []dirMeta) ([]string, error) {
+// plan returns the first group of blocks selected by the planner.
+func (c *LeveledCompactor) plan(dms []DirMeta) ([]string, error) {
 	sort.Slice(dms, func(i, j int) bool {
-		return dms[i].meta.MinTime < dms[j].meta.MinTime
+		return dms[i].Meta.MinTime < dms[j].Meta.MinTime
 	})
 
 	// We do not include a recently created block with max(minTime), so the block which was just created from WAL.
 	// This gives users a window of a full block size to piece-wise backup new data without having to care about data overlap.
 	dms = dms[:len(dms)-1]
 
+	groups, err := c.planner.Plan(dms)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if len(g) > 0 {
+			return g, nil
+		}
+	}
+	// Blocks that are not compacted again would keep the data of expired
+	// retention rules. Rewrite them on their own.
+	for _, dm := range dms {
+		if c.retentionExpired(dm.Meta) {
+			return []string{dm.Dir}, nil
+		}
+	}
+	return nil, nil
+}
+
+// LeveledPlanner compacts blocks into the next larger of its block ranges once
+// they fill it. Large blocks with many tombstones are compacted on their own.
+type LeveledPlanner struct {
+	ranges []int64
+}
+
+// NewLeveledPlanner returns a LeveledPlanner for the given block ranges.
+func NewLeveledPlanner(ranges []int64) (*LeveledPlanner, error) {
+	if len(ranges) == 0 {
+		return nil, errors.Errorf("at least one range must be provided")
+	}
+	return &LeveledPlanner{ranges: ranges}, nil
+}
+
+// Plan implements the Planner interface. It returns at most one group.
+func (lp *LeveledPlanner) Plan(dms []DirMeta) ([][]string, error) {
 	var res []string
-	for _, dm := range c.selectDirs(dms) {
-		res = append(res, dm.dir)
+	for _, dm := range lp.selectDirs(dms) {
+		res = append(res, dm.Dir)
 	}
 	if len(res) > 0 {
-		return res, nil
+		return [][]string{res}, nil
 	}
 
 	// Compact any blocks that have >5% tombstones.
 	for i := len(dms) - 1; i >= 0; i-- {
-		meta := dms[i].meta
-		if meta.MaxTime-meta.MinTime < c.ranges[len(c.ranges)/2] {
+		meta := dms[i].Meta
+		if meta.MaxTime-meta.MinTime < lp.ranges[len(lp.ranges)/2] {
 			break
 		}
 
 		if float64(meta.Stats.NumTombstones)/float64(meta.Stats.NumSeries+1) > 0.05 {
-			return []string{dms[i].dir}, nil
+			return [][]string{{dms[i].Dir}}, nil
 		}
 	}
 
@@ -201,14 +351,14 @@ func (c *LeveledCompactor) plan(dms []dirMeta) ([]string, error) {
 
 // selectDirs returns the dir metas that should be compacted into a single new block.
 // If only a single block range is configured, the result is always nil.
-func (c *LeveledCompactor) selectDirs(ds []dirMeta) []dirMeta {
-	if len(c.ranges) < 2 || len(ds) < 1 {
+func (lp *LeveledPlanner) selectDirs(ds []DirMeta) []DirMeta {
+	if len(lp.ranges) < 2 || len(ds) < 1 {
 		return nil
 	}
 
-	highTime := ds[len(ds)-1].meta.MinTime
+	highTime := ds[len(ds)-1].Meta.MinTime
 
-	for _, iv := range c.ranges[1:] {
+	for _, iv := range lp.ranges[1:] {
 		parts := splitByRange(ds, iv)
 		if len(parts) == 0 {
 			continue
@@ -218,13 +368,13 @@ func (c *LeveledCompactor) selectDirs(ds []dirMeta) []dirMeta {
 		for _, p := range parts {
 			// Do not select the range if it has a block whose compaction failed.
 			for _, dm := range p {
-				if dm.meta.Compaction.Failed {
+				if dm.Meta.Compaction.Failed {
 					continue Outer
 				}
 			}
 
-			mint := p[0].meta.MinTime
-			maxt := p[len(p)-1].meta.MaxTime
+			mint := p[0].Meta.MinTime
+			maxt := p[len(p)-1].Meta.MaxTime
 			// Pick the range of blocks if it spans the full range (potentially with gaps)
 			// or is before the most recent block.
 			// This ensures we don't compact blocks prematurely when another one of the same
@@ -242,14 +392,14 @@ func (c *LeveledCompactor) selectDirs(ds []dirMeta) []dirMeta {
 //
 // For example, if we have blocks [0-10, 10-20, 50-60, 90-100] and the split range tr is 30
 // it returns [0-10, 10-20], [50-60], [90-100].
-func splitByRange(ds []dirMeta, tr int64) [][]dirMeta {
-	var splitDirs [][]dirMeta
+func splitByRange(ds []DirMeta, tr int64) [][]DirMeta {
+	var splitDirs [][]DirMeta
 
 	for i := 0; i < len(ds); {
 		var (
-			group []dirMeta
+			group []DirMeta
 			t0    int64
-			m     = ds[i].meta
+			m     = ds[i].Meta
 		)
 		// Compute start of aligned time range of size tr closest to the current block's start.
 		if m.MinTime >= 0 {
@@ -259,7 +409,7 @@ func splitByRange(ds []dirMeta, tr int64) [][]dirMeta {
 		}
 		// Skip blocks that don't fall into the range. This can happen via mis-alignment or
 		// by being the multiple of the intended range.
-		if ds[i].meta.MinTime < t0 || ds[i].meta.MaxTime > t0+tr {
+		if ds[i].Meta.MinTime < t0 || ds[i].Meta.MaxTime > t0+tr {
 			i++
 			continue
 		}
@@ -267,7 +417,7 @@ func splitByRange(ds []dirMeta, tr int64) [][]dirMeta {
 		// Add all dirs to the current group that are within [t0, t0+tr].
 		for ; i < len(ds); i++ {
 			// Either the block falls into the next range or doesn't fit at all (checked above).
-			if ds[i].meta.MinTime < t0 || ds[i].meta.MaxTime > t0+tr {
+			if ds[i].Meta.MinTime < t0 || ds[i].Meta.MaxTime > t0+tr {
 				break
 			}
 			group = append(group, ds[i])
@@ -420,7 +570,15 @@ func (w *instrumentedChunkWriter) WriteChunks(chunks ...chunks.Meta) error {
 
 // write creates a new block that is the union of the provided blocks into dir.
 // It cleans up all files of the old blocks after completing successfully.
-func (c *LeveledCompactor) write(dest string, meta *BlockMeta, blocks ...BlockReader) (err error) {
+func (c *LeveledCompactor) write(dest string, meta *BlockMeta, blocks ...BlockReader) error {
+	return c.writeBlock(dest, meta, func(indexw IndexWriter, chunkw ChunkWriter) error {
+		return c.populateBlock(blocks, meta, indexw, chunkw)
+	})
+}
+
+// writeBlock writes the block described by meta into dest. The index and chunks
+// of the block are filled by populate.
+func (c *LeveledCompactor) writeBlock(dest string, meta *BlockMeta, populate func(IndexWriter, ChunkWriter) error) (err error) {
 	dir := filepath.Join(dest, meta.ULID.String())
 	tmp := dir + ".tmp"
 
@@ -469,7 +627,7 @@ func (c *LeveledCompactor) write(dest string, meta *BlockMeta, blocks ...BlockRe
 	}
 	defer indexw.Close()
 
-	if err := c.populateBlock(blocks, meta, indexw, chunkw); err != nil {
+	if err := populate(indexw, chunkw); err != nil {
 		return errors.Wrap(err, "write compaction")
 	}
 
@@ -535,6 +693,9 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 	)
 	defer func() { closeAll(closers...) }()
 
+	horizon, expired := c.retentionHorizons(meta.MaxTime)
+	meta.Compaction.ExpiredRules = expired
+
 	for i, b := range blocks {
 		indexr, err := b.Index()
 		if err != nil {
@@ -594,6 +755,14 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 	for set.Next() {
 		lset, chks, dranges := set.At() // The chunks here are not fully deleted.
 
+		// Drop the chunks beyond the retention of the series.
+		if mint, ok := horizon(lset); ok {
+			var err error
+			if chks, err = c.dropChunksBefore(chks, mint); err != nil {
+				return err
+			}
+		}
+
 		// Skip the series with all deleted chunks.
 		if len(chks) == 0 {
 			continue
@@ -605,24 +774,8 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 					chk.MinTime, chk.MaxTime, meta.MinTime, meta.MaxTime)
 			}
 
-			if len(dranges) > 0 {
-				// Re-encode the chunk to not have deleted values.
-				if !chk.OverlapsClosedInterval(dranges[0].Mint, dranges[len(dranges)-1].Maxt) {
-					continue
-				}
-				newChunk := chunkenc.NewXORChunk()
-				app, err := newChunk.Appender()
-				if err != nil {
-					return err
-				}
-
-				it := &deletedIterator{it: chk.Chunk.Iterator(), intervals: dranges}
-				for it.Next() {
-					ts, v := it.At()
-					app.Append(ts, v)
-				}
-
-				chks[i].Chunk = newChunk
+			if err := removeDeleted(&chks[i], dranges); err != nil {
+				return err
 			}
 		}
 
@@ -661,7 +814,35 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 	if set.Err() != nil {
 		return errors.Wrap(set.Err(), "iterate compaction set")
 	}
+	return writePostings(indexw, values, postings)
+}
 
+// removeDeleted re-encodes the chunk without the samples in the deleted intervals.
+func removeDeleted(chk *chunks.Meta, dranges Intervals) error {
+	if len(dranges) == 0 {
+		return nil
+	}
+	if !chk.OverlapsClosedInterval(dranges[0].Mint, dranges[len(dranges)-1].Maxt) {
+		return nil
+	}
+	newChunk := chunkenc.NewXORChunk()
+	app, err := newChunk.Appender()
+	if err != nil {
+		return err
+	}
+
+	it := &deletedIterator{it: chk.Chunk.Iterator(), intervals: dranges}
+	for it.Next() {
+		ts, v := it.At()
+		app.Append(ts, v)
+	}
+
+	chk.Chunk = newChunk
+	return nil
+}
+
+// writePostings writes the label indexes and postings lists of a block.
+func writePostings(indexw IndexWriter, values map[string]stringset, postings *index.MemPostings) error {
 	s := make([]string, 0, 256)
 	for n, v := range values {
 		s = s[:0]
@@ -682,6 +863,24 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 	return nil
 }
 
+// dropChunksBefore removes the chunks ending before mint.
+func (c *LeveledCompactor) dropChunksBefore(chks []chunks.Meta, mint int64) ([]chunks.Meta, error) {
+	keep := chks[:0]
+
+	for _, chk := range chks {
+		if chk.MaxTime >= mint {
+			keep = append(keep, chk)
+			continue
+		}
+		c.metrics.retentionDroppedChunks.Inc()
+
+		if err := c.chunkPool.Put(chk.Chunk); err != nil {
+			return nil, errors.Wrap(err, "put chunk")
+		}
+	}
+	return keep, nil
+}
+
 type compactionSeriesSet struct {
 	p          index.Postings
 	index      IndexReader
@@ -23,6 +23,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
 	"github.com/prometheus/tsdb/testutil"
 )
 
@@ -105,10 +106,10 @@ func TestSplitByRange(t *testing.T) {
 
 	for _, c := range cases {
 		// Transform input range tuples into dirMetas.
-		blocks := make([]dirMeta, 0, len(c.ranges))
+		blocks := make([]DirMeta, 0, len(c.ranges))
 		for _, r := range c.ranges {
-			blocks = append(blocks, dirMeta{
-				meta: &BlockMeta{
+			blocks = append(blocks, DirMeta{
+				Meta: &BlockMeta{
 					MinTime: r[0],
 					MaxTime: r[1],
 				},
@@ -116,11 +117,11 @@ func TestSplitByRange(t *testing.T) {
 		}
 
 		// Transform output range tuples into dirMetas.
-		exp := make([][]dirMeta, len(c.output))
+		exp := make([][]DirMeta, len(c.output))
 		for i, group := range c.output {
 			for _, r := range group {
-				exp[i] = append(exp[i], dirMeta{
-					meta: &BlockMeta{MinTime: r[0], MaxTime: r[1]},
+				exp[i] = append(exp[i], DirMeta{
+					Meta: &BlockMeta{MinTime: r[0], MaxTime: r[1]},
 				})
 			}
 		}
@@ -131,17 +132,17 @@ func TestSplitByRange(t *testing.T) {
 
 // See https://github.com/prometheus/prometheus/issues/3064
 func TestNoPanicFor0Tombstones(t *testing.T) {
-	metas := []dirMeta{
+	metas := []DirMeta{
 		{
-			dir: "1",
-			meta: &BlockMeta{
+			Dir: "1",
+			Meta: &BlockMeta{
 				MinTime: 0,
 				MaxTime: 100,
 			},
 		},
 		{
-			dir: "2",
-			meta: &BlockMeta{
+			Dir: "2",
+			Meta: &BlockMeta{
 				MinTime: 101,
 				MaxTime: 200,
 			},
@@ -166,18 +167,18 @@ func TestLeveledCompactor_plan(t *testing.T) {
 	testutil.Ok(t, err)
 
 	cases := []struct {
-		metas    []dirMeta
+		metas    []DirMeta
 		expected []string
 	}{
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 20, nil),
 			},
 			expected: nil,
 		},
 		// We should wait for four blocks of size 20 to appear before compacting.
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 20, nil),
 				metaRange("2", 20, 40, nil),
 			},
@@ -186,7 +187,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		// We should wait for a next block of size 20 to appear before compacting
 		// the existing ones. We have three, but we ignore the fresh one from WAl.
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 20, nil),
 				metaRange("2", 20, 40, nil),
 				metaRange("3", 40, 60, nil),
@@ -195,7 +196,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		},
 		// Block to fill the entire parent range appeared – should be compacted.
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 20, nil),
 				metaRange("2", 20, 40, nil),
 				metaRange("3", 40, 60, nil),
@@ -206,7 +207,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		// Block for the next parent range appeared with gap with size 20. Nothing will happen in the first one
 		// anymore but we ignore fresh one still, so no compaction.
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 20, nil),
 				metaRange("2", 20, 40, nil),
 				metaRange("3", 60, 80, nil),
@@ -216,7 +217,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		// Block for the next parent range appeared, and we have a gap with size 20 between second and third block.
 		// We will not get this missed gap anymore and we should compact just these two.
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 20, nil),
 				metaRange("2", 20, 40, nil),
 				metaRange("3", 60, 80, nil),
@@ -226,7 +227,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		},
 		{
 			// We have 20, 20, 20, 60, 60 range blocks. "5" is marked as fresh one.
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 20, nil),
 				metaRange("2", 20, 40, nil),
 				metaRange("3", 40, 60, nil),
@@ -237,7 +238,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		},
 		{
 			// We have 20, 60, 20, 60, 240 range blocks. We can compact 20 + 60 + 60.
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("2", 20, 40, nil),
 				metaRange("4", 60, 120, nil),
 				metaRange("5", 960, 980, nil), // Fresh one.
@@ -248,7 +249,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		},
 		// Do not select large blocks that have many tombstones when there is no fresh block.
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 540, &BlockStats{
 					NumSeries:     10,
 					NumTombstones: 3,
@@ -258,7 +259,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		},
 		// Select large blocks that have many tombstones when fresh appears.
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 540, &BlockStats{
 					NumSeries:     10,
 					NumTombstones: 3,
@@ -269,7 +270,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		},
 		// For small blocks, do not compact tombstones, even when fresh appears.
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 60, &BlockStats{
 					NumSeries:     10,
 					NumTombstones: 3,
@@ -281,7 +282,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		// Regression test: we were stuck in a compact loop where we always recompacted
 		// the same block when tombstones and series counts were zero.
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 540, &BlockStats{
 					NumSeries:     0,
 					NumTombstones: 0,
@@ -296,7 +297,7 @@ func TestLeveledCompactor_plan(t *testing.T) {
 		// With previous, wrong approach "8" block was ignored, so we were wrongly compacting 5 and 7 and introducing
 		// block overlaps.
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("5", 0, 360, nil),
 				metaRange("6", 540, 560, nil), // Fresh one.
 				metaRange("7", 360, 420, nil),
@@ -329,10 +330,10 @@ func TestRangeWithFailedCompactionWontGetSelected(t *testing.T) {
 	testutil.Ok(t, err)
 
 	cases := []struct {
-		metas []dirMeta
+		metas []DirMeta
 	}{
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 20, nil),
 				metaRange("2", 20, 40, nil),
 				metaRange("3", 40, 60, nil),
@@ -340,7 +341,7 @@ func TestRangeWithFailedCompactionWontGetSelected(t *testing.T) {
 			},
 		},
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 20, nil),
 				metaRange("2", 20, 40, nil),
 				metaRange("3", 60, 80, nil),
@@ -348,7 +349,7 @@ func TestRangeWithFailedCompactionWontGetSelected(t *testing.T) {
 			},
 		},
 		{
-			metas: []dirMeta{
+			metas: []DirMeta{
 				metaRange("1", 0, 20, nil),
 				metaRange("2", 20, 40, nil),
 				metaRange("3", 40, 60, nil),
@@ -360,7 +361,7 @@ func TestRangeWithFailedCompactionWontGetSelected(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		c.metas[1].meta.Compaction.Failed = true
+		c.metas[1].Meta.Compaction.Failed = true
 		res, err := compactor.plan(c.metas)
 		testutil.Ok(t, err)
 
@@ -387,14 +388,14 @@ func TestCompactionFailWillCleanUpTempDir(t *testing.T) {
 	testutil.Assert(t, os.IsNotExist(err), "directory is not cleaned up")
 }
 
-func metaRange(name string, mint, maxt int64, stats *BlockStats) dirMeta {
+func metaRange(name string, mint, maxt int64, stats *BlockStats) DirMeta {
 	meta := &BlockMeta{MinTime: mint, MaxTime: maxt}
 	if stats != nil {
 		meta.Stats = *stats
 	}
-	return dirMeta{
-		dir:  name,
-		meta: meta,
+	return DirMeta{
+		Dir:  name,
+		Meta: meta,
 	}
 }
 
@@ -682,3 +683,57 @@ func TestCompaction_populateBlock(t *testing.T) {
 		}
 	}
 }
+
+func TestCompaction_populateBlockRetentionRules(t *testing.T) {
+	input := []seriesSamples{
+		{
+			lset:   map[string]string{"a": "billing"},
+			chunks: [][]sample{{{t: 0}, {t: 10}}, {{t: 11}, {t: 20}}},
+		},
+		{
+			lset:   map[string]string{"a": "debug", "b": "1"},
+			chunks: [][]sample{{{t: 0}, {t: 10}}, {{t: 11}, {t: 20}}},
+		},
+		{
+			lset:   map[string]string{"a": "debug", "b": "2"},
+			chunks: [][]sample{{{t: 0}, {t: 5}}},
+		},
+	}
+	c, err := NewLeveledCompactor(nil, nil, []int64{0}, nil)
+	testutil.Ok(t, err)
+
+	populate := func() []seriesSamples {
+		ir, cr := createIdxChkReaders(input)
+		iw := &mockIndexWriter{}
+		meta := &BlockMeta{MinTime: 0, MaxTime: math.MaxInt64}
+
+		testutil.Ok(t, c.populateBlock([]BlockReader{&mockBReader{ir: ir, cr: cr}}, meta, iw, nopChunkWriter{}))
+		return iw.series
+	}
+	ref := func() int64 { return 30 }
+
+	// The first matching rule applies, chunks ending before the horizon are dropped.
+	c.SetRetentionRules([]RetentionRule{
+		{Selector: labels.Selector{labels.NewEqualMatcher("b", "2")}, Duration: 100},
+		{Selector: labels.Selector{labels.NewEqualMatcher("a", "debug")}, Duration: 15},
+	}, ref)
+
+	testutil.Equals(t, []seriesSamples{
+		input[0],
+		{
+			lset:   map[string]string{"a": "debug", "b": "1"},
+			chunks: [][]sample{{{t: 11}, {t: 20}}},
+		},
+		input[2],
+	}, populate())
+
+	// Rules can be replaced at runtime.
+	c.SetRetentionRules([]RetentionRule{
+		{Selector: labels.Selector{labels.NewEqualMatcher("a", "debug")}, Duration: 5},
+	}, ref)
+
+	testutil.Equals(t, []seriesSamples{input[0]}, populate())
+
+	c.SetRetentionRules(nil, ref)
+	testutil.Equals(t, input, populate())
+}
@@ -27,6 +27,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -37,6 +38,7 @@ import (
 	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/fileutil"
 	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/relabel"
 	"github.com/prometheus/tsdb/wal"
 	"golang.org/x/sync/errgroup"
 )
@@ -53,16 +55,94 @@ var DefaultOptions = &Options{
 // Options of the DB storage.
 type Options struct {
 	// The interval at which the write ahead log is flushed to disk.
+	// Only used with the wal.SyncInterval sync mode.
 	WALFlushInterval time.Duration
 
+	// WALSyncMode controls when appended data is synced to disk. Defaults to
+	// wal.SyncSegment. With wal.SyncCommit, Commit returns once the data is durable.
+	WALSyncMode wal.SyncMode
+
+	// WALCompression compresses records written to the write ahead log.
+	// Defaults to wal.CompressionNone.
+	WALCompression wal.CompressionType
+
+	// WALRepairStrategy defines how a corrupted WAL is repaired on startup.
+	// Defaults to wal.RepairTruncate.
+	WALRepairStrategy wal.RepairStrategy
+
 	// Duration of persisted data to keep.
 	RetentionDuration uint64
 
+	// RetentionRules limit the retention of the series matching their
+	// selectors. They are applied when blocks are compacted.
+	RetentionRules []RetentionRule
+
 	// The sizes of the Blocks.
 	BlockRanges []int64
 
+	// CompactionPlanner selects the blocks to compact. If nil, a LeveledPlanner
+	// for the BlockRanges is used.
+	CompactionPlanner Planner
+
 	// NoLockfile disables creation and consideration of a lock file.
 	NoLockfile bool
+
+	// IndexCacheSize is the maximum size in bytes of the cache for postings
+	// and series lookups against persisted blocks. 0 disables the cache.
+	IndexCacheSize uint64
+
+	// LazyIndexLoading keeps the symbols and postings offsets of block indexes
+	// on disk instead of loading them into memory when a block is opened.
+	LazyIndexLoading bool
+
+	// HeadSnapshotOnShutdown writes a snapshot of the head block when the DB is
+	// closed, which avoids replaying the entire WAL on the next start.
+	HeadSnapshotOnShutdown bool
+
+	// MaxHeadSeries is the maximum number of series in the head block. Appends
+	// creating new series beyond it fail with ErrSeriesLimitExceeded. Zero means
+	// no limit.
+	MaxHeadSeries int
+
+	// MaxHeadSeriesPerMetric is the maximum number of series with the same
+	// metric name in the head block. Zero means no limit.
+	MaxHeadSeriesPerMetric int
+
+	// SkipStaleMarkers hides stale marker samples from the series returned by
+	// queriers. They are always stored and kept during compaction.
+	SkipStaleMarkers bool
+
+	// HeadListener is notified asynchronously about series created in and
+	// removed from the head block and about its truncations.
+	HeadListener HeadListener
+
+	// HeadListenerQueueSize is the number of notifications buffered for the
+	// HeadListener. Notifications are dropped once it is full.
+	HeadListenerQueueSize int
+
+	// HeadChunkPolicy controls the size of the chunks cut in the head block.
+	HeadChunkPolicy ChunkPolicy
+
+	// SubscriptionPolicy defines how subscribers that fall behind the committed
+	// samples are handled. By default their samples are dropped.
+	SubscriptionPolicy SubscriptionPolicy
+
+	// SubscriptionBufferSize is the number of commits buffered for each
+	// subscriber.
+	SubscriptionBufferSize int
+
+	// ChunkPool is the pool used to read and compact chunks. It may be shared
+	// by multiple DBs. If nil, the DB creates its own pool.
+	ChunkPool chunkenc.Pool
+
+	// NoAutoCompaction stops the DB from compacting on its own. Compactions
+	// have to be triggered through DB.Compact instead.
+	NoAutoCompaction bool
+
+	// RelabelConfigs are applied in order to the labels of all series added
+	// through the DB's appenders. Series whose labels are dropped are
+	// discarded without an error.
+	RelabelConfigs []*relabel.Config
 }
 
 // Appender allows appending a batch of data. It must be completed with a
@@ -102,6 +182,15 @@ type DB struct {
 	chunkPool chunkenc.Pool
 	compactor Compactor
 
+	// Cache for index lookups shared by all blocks. Nil if disabled.
+	indexCache *indexCache
+
+	// Relabels appended series. Nil if there are no relabel configs.
+	relabeler *relabeler
+
+	// Functions called after a reload changed the set of blocks.
+	reloadListeners []func()
+
 	// Mutex for that must be held when modifying the general block layout.
 	mtx    sync.RWMutex
 	blocks []*Block
@@ -115,6 +204,10 @@ type DB struct {
 	// cmtx is used to control compactions and deletions.
 	cmtx               sync.Mutex
 	compactionsEnabled bool
+
+	// Non-zero while the DB replicates a leader and rejects writes.
+	// Must be accessed atomically.
+	replica uint32
 }
 
 type dbMetrics struct {
@@ -233,10 +326,23 @@ func Open(dir string, l log.Logger, r prometheus.Registerer, opts *Options) (db
 		donec:              make(chan struct{}),
 		stopc:              make(chan struct{}),
 		compactionsEnabled: true,
-		chunkPool:          chunkenc.NewPool(),
+		chunkPool:          opts.ChunkPool,
+	}
+	if db.chunkPool == nil {
+		db.chunkPool = chunkenc.NewPool()
 	}
 	db.metrics = newDBMetrics(db, r)
 
+	if opts.IndexCacheSize > 0 {
+		db.indexCache = newIndexCache(r, opts.IndexCacheSize)
+	}
+	if len(opts.RelabelConfigs) > 0 {
+		db.relabeler, err = newRelabeler(r, opts.RelabelConfigs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if !opts.NoLockfile {
 		absdir, err := filepath.Abs(dir)
 		if err != nil {
@@ -249,16 +355,39 @@ func Open(dir string, l log.Logger, r prometheus.Registerer, opts *Options) (db
 		db.lockf = lockf
 	}
 
-	db.compactor, err = NewLeveledCompactor(r, l, opts.BlockRanges, db.chunkPool)
+	var lc *LeveledCompactor
+	if opts.CompactionPlanner != nil {
+		lc, err = NewLeveledCompactorWithPlanner(r, l, opts.CompactionPlanner, db.chunkPool)
+	} else {
+		lc, err = NewLeveledCompactor(r, l, opts.BlockRanges, db.chunkPool)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "create leveled compactor")
 	}
-
-	wlog, err := wal.New(l, r, filepath.Join(dir, "wal"))
+	lc.SetRetentionRules(opts.RetentionRules, func() int64 { return db.head.MaxTime() })
+	db.compactor = lc
+
+	wlog, err := wal.NewWithOptions(l, r, filepath.Join(dir, "wal"), wal.Options{
+		SyncMode:       opts.WALSyncMode,
+		SyncInterval:   opts.WALFlushInterval,
+		Compression:    opts.WALCompression,
+		RepairStrategy: opts.WALRepairStrategy,
+	})
 	if err != nil {
 		return nil, err
 	}
-	db.head, err = NewHead(r, l, wlog, opts.BlockRanges[0])
+	db.head, err = NewHeadWithOptions(r, l, wlog, opts.BlockRanges[0], &HeadOptions{
+		ChunkDir:           filepath.Join(dir, headChunksDirname),
+		SnapshotOnShutdown: opts.HeadSnapshotOnShutdown,
+		MaxSeries:          opts.MaxHeadSeries,
+		MaxSeriesPerMetric: opts.MaxHeadSeriesPerMetric,
+		Listener:           opts.HeadListener,
+		ListenerQueueSize:  opts.HeadListenerQueueSize,
+		ChunkPolicy:        opts.HeadChunkPolicy,
+
+		SubscriptionPolicy:     opts.SubscriptionPolicy,
+		SubscriptionBufferSize: opts.SubscriptionBufferSize,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -298,6 +427,9 @@ func (db *DB) run() {
 			default:
 			}
 		case <-db.compactc:
+			if db.opts.NoAutoCompaction {
+				continue
+			}
 			db.metrics.compactionsTriggered.Inc()
 
 			err := db.compact()
@@ -334,29 +466,74 @@ func (db *DB) beyondRetention(meta *BlockMeta) bool {
 }
 
 // Appender opens a new appender against the database.
+// The appender rejects all samples while the DB is a replica.
 func (db *DB) Appender() Appender {
+	if db.isReplica() {
+		return replicaAppender{}
+	}
 	return dbAppender{db: db, Appender: db.head.Appender()}
 }
 
-// dbAppender wraps the DB's head appender and triggers compactions on commit
-// if necessary.
+func (db *DB) isReplica() bool {
+	return atomic.LoadUint32(&db.replica) != 0
+}
+
+// dbAppender wraps the DB's head appender, relabels added series and triggers
+// compactions on commit if necessary.
 type dbAppender struct {
 	Appender
 	db *DB
 }
 
+func (a dbAppender) Add(lset labels.Labels, t int64, v float64) (uint64, error) {
+	if a.db.relabeler != nil {
+		return a.db.relabeler.add(a.Appender, a.db.head, lset, t, v)
+	}
+	return a.Appender.Add(lset, t, v)
+}
+
+// AddFast adds a sample for a reference returned by Add. References of
+// relabeled series point to the relabeled series already.
+func (a dbAppender) AddFast(ref uint64, t int64, v float64) error {
+	if ref == droppedSeriesRef {
+		return nil
+	}
+	return a.Appender.AddFast(ref, t, v)
+}
+
 func (a dbAppender) Commit() error {
 	err := a.Appender.Commit()
 
 	// We could just run this check every few minutes practically. But for benchmarks
 	// and high frequency use cases this is the safer way.
-	if a.db.head.MaxTime()-a.db.head.MinTime() > a.db.head.chunkRange/2*3 {
+	a.db.triggerCompaction()
+	return err
+}
+
+// triggerCompaction signals the compaction loop if the head holds enough
+// data to be compacted.
+func (db *DB) triggerCompaction() {
+	if db.head.MaxTime()-db.head.MinTime() > db.head.chunkRange/2*3 {
 		select {
-		case a.db.compactc <- struct{}{}:
+		case db.compactc <- struct{}{}:
 		default:
 		}
 	}
-	return err
+}
+
+// replicaAppender rejects all writes to a replica DB.
+type replicaAppender struct{}
+
+func (replicaAppender) Add(labels.Labels, int64, float64) (uint64, error) { return 0, ErrReadOnly }
+func (replicaAppender) AddFast(uint64, int64, float64) error              { return ErrReadOnly }
+func (replicaAppender) Commit() error                                     { return nil }
+func (replicaAppender) Rollback() error                                   { return nil }
+
+// Compact persists the head block and compacts the persisted blocks if
+// possible. It is a no-op while compactions are disabled.
+func (db *DB) Compact() error {
+	db.metrics.compactionsTriggered.Inc()
+	return db.compact()
 }
 
 // Compact data if possible. After successful compaction blocks are reloaded
@@ -521,10 +698,11 @@ func (db *DB) reload() (err error) {
 		// See if we already have the block in memory or open it otherwise.
 		b, ok := db.getBlock(meta.ULID)
 		if !ok {
-			b, err = OpenBlock(dir, db.chunkPool)
+			b, err = OpenBlockWithOptions(dir, db.chunkPool, &BlockOptions{LazyIndex: db.opts.LazyIndexLoading})
 			if err != nil {
 				return errors.Wrapf(err, "open block %s", dir)
 			}
+			b.cache = db.indexCache
 		}
 		blocks = append(blocks, b)
 		opened[meta.ULID] = struct{}{}
@@ -541,6 +719,7 @@ func (db *DB) reload() (err error) {
 	db.mtx.Lock()
 	oldBlocks := db.blocks
 	db.blocks = blocks
+	listeners := db.reloadListeners
 	db.mtx.Unlock()
 
 	// Drop old blocks from memory.
@@ -558,6 +737,9 @@ func (db *DB) reload() (err error) {
 			return errors.Wrapf(err, "delete obsolete block %s", ulid)
 		}
 	}
+	for _, f := range listeners {
+		f()
+	}
 
 	// Garbage collect data in the head if the most recent persisted block
 	// covers data of its current time range.
@@ -566,7 +748,13 @@ func (db *DB) reload() (err error) {
 	}
 	maxt := blocks[len(blocks)-1].Meta().MaxTime
 
-	return errors.Wrap(db.head.Truncate(maxt), "head truncate failed")
+	if err := db.head.Truncate(maxt); err != nil {
+		return errors.Wrap(err, "head truncate failed")
+	}
+	if db.relabeler != nil {
+		db.relabeler.purge(db.head)
+	}
+	return nil
 }
 
 // validateBlockSequence returns error if given block meta files indicate that some blocks overlaps within sequence.
@@ -700,6 +888,15 @@ func (db *DB) Blocks() []*Block {
 	return db.blocks
 }
 
+// onReload registers f to be called after each reload of the blocks.
+// It must not block.
+func (db *DB) onReload(f func()) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	db.reloadListeners = append(db.reloadListeners, f)
+}
+
 // Head returns the databases's head.
 func (db *DB) Head() *Head {
 	return db.head
@@ -731,6 +928,20 @@ func (db *DB) Close() error {
 	return merr.Err()
 }
 
+// SetRetentionRules replaces the retention rules applied by all following
+// compactions. The horizons of the rules are relative to the newest sample
+// in the head block. Blocks holding data of expired rules are rewritten by
+// the next compaction.
+// The rules can only be applied by a LeveledCompactor.
+func (db *DB) SetRetentionRules(rules []RetentionRule) error {
+	lc, ok := db.compactor.(*LeveledCompactor)
+	if !ok {
+		return errors.Errorf("retention rules are not supported by compactor %T", db.compactor)
+	}
+	lc.SetRetentionRules(rules, func() int64 { return db.head.MaxTime() })
+	return nil
+}
+
 // DisableCompactions disables compactions.
 func (db *DB) DisableCompactions() {
 	db.cmtx.Lock()
@@ -779,6 +990,13 @@ func (db *DB) Snapshot(dir string, withHead bool) error {
 	return errors.Wrap(err, "snapshot head block")
 }
 
+// Subscribe returns a channel receiving the samples of all series matching
+// the matchers right after they were committed, and a function cancelling the
+// subscription. See Head.Subscribe for details.
+func (db *DB) Subscribe(ms ...labels.Matcher) (<-chan []CommittedSample, func()) {
+	return db.head.Subscribe(ms...)
+}
+
 // Querier returns a new querier over the data partition for the given time range.
 // A goroutine must not handle more than one open Querier.
 func (db *DB) Querier(mint, maxt int64) (Querier, error) {
@@ -792,23 +1010,32 @@ func (db *DB) Querier(mint, maxt int64) (Querier, error) {
 			blocks = append(blocks, b)
 		}
 	}
+	var iso *isolationState
 	if maxt >= db.head.MinTime() {
-		blocks = append(blocks, db.head)
+		iso = db.head.iso.state()
+		blocks = append(blocks, &rangeHead{
+			head: db.head,
+			mint: mint,
+			maxt: maxt,
+			iso:  iso,
+		})
 	}
 
 	sq := &querier{
 		blocks: make([]Querier, 0, len(blocks)),
+		iso:    iso,
 	}
 	for _, b := range blocks {
-		q, err := NewBlockQuerier(b, mint, maxt)
+		q, err := NewBlockQuerierWithOptions(b, mint, maxt, QuerierOptions{
+			SkipStaleMarkers: db.opts.SkipStaleMarkers,
+		})
 		if err == nil {
 			sq.blocks = append(sq.blocks, q)
 			continue
 		}
-		// If we fail, all previously opened queriers must be closed.
-		for _, q := range sq.blocks {
-			q.Close()
-		}
+		// If we fail, all previously opened queriers and the isolation state
+		// must be released.
+		sq.Close()
 		return nil, errors.Wrapf(err, "open querier for block %s", b)
 	}
 	return sq, nil
@@ -821,6 +1048,9 @@ func rangeForTimestamp(t int64, width int64) (mint, maxt int64) {
 
 // Delete implements deletion of metrics. It only has atomicity guarantees on a per-block basis.
 func (db *DB) Delete(mint, maxt int64, ms ...labels.Matcher) error {
+	if db.isReplica() {
+		return ErrReadOnly
+	}
 	db.cmtx.Lock()
 	defer db.cmtx.Unlock()
 
@@ -30,7 +30,9 @@ import (
 	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/index"
 	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/relabel"
 	"github.com/prometheus/tsdb/testutil"
+	"github.com/prometheus/tsdb/value"
 	"github.com/prometheus/tsdb/wal"
 )
 
@@ -319,7 +321,7 @@ func TestNonDuplicateNaNDatapointsCausesAmendError(t *testing.T) {
 	testutil.Ok(t, app.Commit())
 
 	app = db.Appender()
-	_, err = app.Add(labels.Labels{}, 0, math.Float64frombits(0x7ff0000000000002))
+	_, err = app.Add(labels.Labels{}, 0, math.Float64frombits(0x7ff0000000000003))
 	testutil.Equals(t, ErrAmendSample, err)
 }
 
@@ -1337,3 +1339,334 @@ func TestCorrectNumTombstones(t *testing.T) {
 	testutil.Ok(t, db.Delete(9, 11, labels.NewEqualMatcher("foo", "bar")))
 	testutil.Equals(t, uint64(3), db.blocks[0].meta.Stats.NumTombstones)
 }
+
+func TestDB_NoAutoCompaction(t *testing.T) {
+	db, closeFn := openTestDB(t, &Options{
+		BlockRanges:      []int64{1000},
+		NoAutoCompaction: true,
+	})
+	defer closeFn()
+	defer db.Close()
+
+	app := db.Appender()
+	for i := int64(0); i < 3000; i += 100 {
+		_, err := app.Add(labels.FromStrings("a", "b"), i, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	// The run loop takes compaction triggers one at a time from a buffer of one.
+	// Once the last trigger was sent, the loop has fully handled at least the
+	// commit's trigger and the next one.
+	for i := 0; i < 3; i++ {
+		db.compactc <- struct{}{}
+	}
+	testutil.Equals(t, 0, len(db.Blocks()))
+
+	testutil.Ok(t, db.Compact())
+	testutil.Assert(t, len(db.Blocks()) > 0, "no blocks after compaction")
+}
+
+func TestDB_RetentionRules(t *testing.T) {
+	db, closeFn := openTestDB(t, &Options{
+		BlockRanges:      []int64{1000},
+		NoAutoCompaction: true,
+	})
+	defer closeFn()
+	defer db.Close()
+
+	testutil.Ok(t, db.SetRetentionRules([]RetentionRule{
+		{Selector: labels.Selector{labels.NewEqualMatcher("a", "debug")}, Duration: 1000},
+	}))
+
+	app := db.Appender()
+	for i := int64(0); i < 5000; i += 100 {
+		_, err := app.Add(labels.FromStrings("a", "billing"), i, 1)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", "debug"), i, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.Compact())
+
+	q, err := db.Querier(0, 5000)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	res := query(t, q, labels.NewMustRegexpMatcher("a", ".*"))
+
+	// Only the debug chunks ending before 3900 are dropped.
+	testutil.Equals(t, 50, len(res[`{a="billing"}`]))
+	testutil.Equals(t, 20, len(res[`{a="debug"}`]))
+}
+
+func TestDB_RetentionRulesRewriteBlocks(t *testing.T) {
+	db, closeFn := openTestDB(t, &Options{
+		BlockRanges:      []int64{1000},
+		NoAutoCompaction: true,
+	})
+	defer closeFn()
+	defer db.Close()
+
+	app := db.Appender()
+	for i := int64(0); i < 5000; i += 100 {
+		_, err := app.Add(labels.FromStrings("a", "billing"), i, 1)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", "debug"), i, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.Compact())
+
+	blockIDs := func() (ids []ulid.ULID) {
+		for _, b := range db.Blocks() {
+			ids = append(ids, b.Meta().ULID)
+		}
+		return ids
+	}
+	before := blockIDs()
+
+	// Blocks at the largest level are rewritten once the horizon of a
+	// rule set at runtime passed their end.
+	testutil.Ok(t, db.SetRetentionRules([]RetentionRule{
+		{Selector: labels.Selector{labels.NewEqualMatcher("a", "debug")}, Duration: 1000},
+	}))
+	testutil.Ok(t, db.Compact())
+
+	after := blockIDs()
+	testutil.Equals(t, len(before), len(after))
+	testutil.Assert(t, before[0] != after[0], "block was not rewritten")
+
+	q, err := db.Querier(0, 5000)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	res := query(t, q, labels.NewMustRegexpMatcher("a", ".*"))
+	testutil.Equals(t, 50, len(res[`{a="billing"}`]))
+	testutil.Equals(t, 20, len(res[`{a="debug"}`]))
+
+	// Blocks are not rewritten again for the same rules.
+	testutil.Ok(t, db.Compact())
+	testutil.Equals(t, after, blockIDs())
+
+	// Rules cannot be applied without a leveled compactor.
+	testutil.NotOk(t, (&DB{compactor: &mockCompactorFailing{t: t}}).SetRetentionRules(nil))
+}
+
+func TestDB_Relabel(t *testing.T) {
+	db, closeFn := openTestDB(t, &Options{
+		BlockRanges: []int64{1000},
+		RelabelConfigs: []*relabel.Config{
+			{
+				SourceLabels: []string{"job"},
+				Regex:        relabel.MustNewRegexp("noisy"),
+				Action:       relabel.Drop,
+			},
+			{
+				Regex:  relabel.MustNewRegexp("pod_id"),
+				Action: relabel.LabelDrop,
+			},
+		},
+	})
+	defer closeFn()
+	defer db.Close()
+
+	app := db.Appender()
+	ref1, err := app.Add(labels.FromStrings("job", "api", "pod_id", "1"), 100, 1)
+	testutil.Ok(t, err)
+	ref2, err := app.Add(labels.FromStrings("job", "api", "pod_id", "2"), 100, 2)
+	testutil.Ok(t, err)
+	ref3, err := app.Add(labels.FromStrings("job", "noisy"), 100, 3)
+	testutil.Ok(t, err)
+
+	// Both pods map to the same series.
+	testutil.Equals(t, ref1, ref2)
+
+	testutil.Ok(t, app.AddFast(ref1, 200, 4))
+	testutil.Ok(t, app.AddFast(ref3, 200, 5))
+	testutil.Ok(t, app.Commit())
+
+	// The cached result is used for further appends.
+	app = db.Appender()
+	ref, err := app.Add(labels.FromStrings("job", "api", "pod_id", "1"), 300, 6)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ref1, ref)
+	testutil.Ok(t, app.Commit())
+
+	q, err := db.Querier(0, 1000)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	testutil.Equals(t, map[string][]sample{
+		`{job="api"}`: {{100, 1}, {200, 4}, {300, 6}},
+	}, query(t, q, labels.NewMustRegexpMatcher("job", ".*")))
+}
+
+func TestDB_RelabelCachePurge(t *testing.T) {
+	db, closeFn := openTestDB(t, &Options{
+		BlockRanges: []int64{1000},
+		RelabelConfigs: []*relabel.Config{
+			{
+				SourceLabels: []string{"job"},
+				Regex:        relabel.MustNewRegexp("noisy"),
+				Action:       relabel.Drop,
+			},
+			{
+				Regex:  relabel.MustNewRegexp("pod_id"),
+				Action: relabel.LabelDrop,
+			},
+		},
+		NoAutoCompaction: true,
+	})
+	defer closeFn()
+	defer db.Close()
+
+	cached := func() (n int) {
+		for i := range db.relabeler.cache {
+			for _, es := range db.relabeler.cache[i] {
+				n += len(es)
+			}
+		}
+		return n
+	}
+
+	app := db.Appender()
+	_, err := app.Add(labels.FromStrings("job", "api", "pod_id", "1"), 100, 1)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("job", "noisy"), 100, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+	testutil.Equals(t, 2, cached())
+
+	// Dropped series are kept as long as they are appended.
+	db.relabeler.purge(db.head)
+	testutil.Equals(t, 2, cached())
+	db.relabeler.purge(db.head)
+	testutil.Equals(t, 1, cached())
+
+	// Entries are removed along with their head series.
+	testutil.Ok(t, db.head.Truncate(1000))
+	db.relabeler.purge(db.head)
+	testutil.Equals(t, 0, cached())
+
+	app = db.Appender()
+	ref, err := app.Add(labels.FromStrings("job", "api", "pod_id", "1"), 1100, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.AddFast(ref, 1200, 2))
+	testutil.Ok(t, app.Commit())
+	testutil.Equals(t, 1, cached())
+}
+
+func TestDB_RelabelInvalidConfig(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	_, err = Open(tmpdir, nil, nil, &Options{
+		BlockRanges:    []int64{1000},
+		RelabelConfigs: []*relabel.Config{{Action: relabel.Keep}},
+	})
+	testutil.NotOk(t, err)
+}
+
+func TestDB_StaleMarkers(t *testing.T) {
+	opts := *DefaultOptions
+	opts.SkipStaleMarkers = true
+
+	db, close := openTestDB(t, &opts)
+	defer close()
+	defer db.Close()
+
+	blockRange := DefaultOptions.BlockRanges[0]
+	label := labels.FromStrings("foo", "bar")
+
+	app := db.Appender()
+	for i := int64(0); i < 4; i++ {
+		_, err := app.Add(label, i*blockRange, float64(i))
+		testutil.Ok(t, err)
+		_, err = app.Add(label, i*blockRange+1000, value.StaleMarker())
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	// A sample for the timestamp of a stale marker is no amend conflict.
+	app = db.Appender()
+	_, err := app.Add(label, 3*blockRange+1000, 5)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	testutil.Ok(t, db.compact())
+	testutil.Assert(t, len(db.Blocks()) > 0, "no block was compacted")
+
+	// The compacted block keeps the stale markers.
+	q, err := NewBlockQuerier(db.Blocks()[0], math.MinInt64, math.MaxInt64)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	ss, err := q.Select(labels.NewEqualMatcher("foo", "bar"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ss.Next(), "series not found")
+
+	var stale int
+	it := ss.At().Iterator()
+	for it.Next() {
+		if _, v := it.At(); value.IsStaleNaN(v) {
+			stale++
+		}
+	}
+	testutil.Ok(t, it.Err())
+	testutil.Assert(t, stale > 0, "stale markers were not kept")
+
+	// The DB querier skips them as configured.
+	dq, err := db.Querier(math.MinInt64, math.MaxInt64)
+	testutil.Ok(t, err)
+	defer dq.Close()
+
+	testutil.Equals(t, map[string][]sample{
+		label.String(): {{0, 0}, {blockRange, 1}, {2 * blockRange, 2}, {3 * blockRange, 3}},
+	}, query(t, dq, labels.NewEqualMatcher("foo", "bar")))
+}
+
+func TestDB_QuerierReleasesIsolationState(t *testing.T) {
+	db, closeFn := openTestDB(t, &Options{
+		BlockRanges:      []int64{1000},
+		NoAutoCompaction: true,
+	})
+	defer closeFn()
+	defer db.Close()
+
+	app := db.Appender()
+	for i := int64(0); i < 3000; i += 100 {
+		_, err := app.Add(labels.FromStrings("a", "b"), i, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.Compact())
+	testutil.Assert(t, len(db.Blocks()) > 0, "no block was compacted")
+
+	readsOpen := func() int {
+		db.head.iso.readMtx.Lock()
+		defer db.head.iso.readMtx.Unlock()
+		return len(db.head.iso.readsOpen)
+	}
+
+	q, err := db.Querier(0, 3000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, readsOpen())
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 0, readsOpen())
+
+	// Opening the querier of a block fails while it is closing.
+	b := db.Blocks()[0]
+	b.mtx.Lock()
+	b.closing = true
+	b.mtx.Unlock()
+
+	_, err = db.Querier(0, 3000)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 0, readsOpen())
+
+	b.mtx.Lock()
+	b.closing = false
+	b.mtx.Unlock()
+}
@@ -0,0 +1,337 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// DefaultReplicaGap is the gap after which the series of a replica is
+// considered to have missing data.
+const DefaultReplicaGap = 60 * 1000 // 1 minute in milliseconds
+
+// FanoutOptions control how the data of replicas is merged.
+type FanoutOptions struct {
+	// ReplicaLabel is removed from all series before they are merged so that
+	// the series of different replicas are deduplicated. If empty, only series
+	// with identical labels are deduplicated.
+	ReplicaLabel string
+
+	// MaxGap is the maximum distance between two samples of a replica. Beyond
+	// it the replica is considered to have a gap and the samples are taken
+	// from another replica. Defaults to DefaultReplicaGap.
+	MaxGap int64
+}
+
+// NewFanoutQuerier returns a querier merging the data of all queriers.
+// Series with the same labels are deduplicated.
+func NewFanoutQuerier(queriers ...Querier) Querier {
+	return NewFanoutQuerierWithOptions(FanoutOptions{}, queriers...)
+}
+
+// NewFanoutQuerierWithOptions returns a querier merging the data of all
+// queriers according to the options.
+func NewFanoutQuerierWithOptions(opts FanoutOptions, queriers ...Querier) Querier {
+	if opts.MaxGap <= 0 {
+		opts.MaxGap = DefaultReplicaGap
+	}
+	return &fanoutQuerier{queriers: queriers, opts: opts}
+}
+
+type fanoutQuerier struct {
+	queriers []Querier
+	opts     FanoutOptions
+}
+
+func (q *fanoutQuerier) Select(ms ...labels.Matcher) (SeriesSet, error) {
+	return q.sel(q.queriers, ms)
+}
+
+func (q *fanoutQuerier) sel(qs []Querier, ms []labels.Matcher) (SeriesSet, error) {
+	if len(qs) == 0 {
+		return EmptySeriesSet(), nil
+	}
+	if len(qs) == 1 {
+		ss, err := qs[0].Select(ms...)
+		if err != nil {
+			return nil, err
+		}
+		if q.opts.ReplicaLabel == "" {
+			return ss, nil
+		}
+		return q.stripReplicas(ss)
+	}
+	l := len(qs) / 2
+
+	a, err := q.sel(qs[:l], ms)
+	if err != nil {
+		return nil, err
+	}
+	b, err := q.sel(qs[l:], ms)
+	if err != nil {
+		return nil, err
+	}
+	s := newMergedSeriesSet(a, b)
+	s.merge = q.dedup
+	return s, nil
+}
+
+// stripReplicas removes the replica label from all series of the set and
+// deduplicates the series that become identical.
+func (q *fanoutQuerier) stripReplicas(ss SeriesSet) (SeriesSet, error) {
+	var res []Series
+
+	for ss.Next() {
+		s := ss.At()
+		res = append(res, &relabeledSeries{
+			Series: s,
+			lset:   withoutLabel(s.Labels(), q.opts.ReplicaLabel),
+		})
+	}
+	if err := ss.Err(); err != nil {
+		return nil, err
+	}
+	// Removing a label may change the order of the series.
+	sort.SliceStable(res, func(i, j int) bool {
+		return labels.Compare(res[i].Labels(), res[j].Labels()) < 0
+	})
+
+	var (
+		merged = res[:0]
+		prev   Series
+	)
+	for _, s := range res {
+		if prev != nil && prev.Labels().Equals(s.Labels()) {
+			prev = q.dedup(prev, s)
+			merged[len(merged)-1] = prev
+			continue
+		}
+		prev = s
+		merged = append(merged, s)
+	}
+	return &listSeriesSet{series: merged}, nil
+}
+
+func (q *fanoutQuerier) dedup(a, b Series) Series {
+	var series []Series
+
+	for _, s := range []Series{a, b} {
+		if ds, ok := s.(*dedupSeries); ok {
+			series = append(series, ds.series...)
+		} else {
+			series = append(series, s)
+		}
+	}
+	return &dedupSeries{series: series, maxGap: q.opts.MaxGap}
+}
+
+func (q *fanoutQuerier) LabelValues(n string) ([]string, error) {
+	if q.opts.ReplicaLabel != "" && n == q.opts.ReplicaLabel {
+		return nil, nil
+	}
+	var res []string
+
+	for _, sq := range q.queriers {
+		vals, err := sq.LabelValues(n)
+		if err != nil {
+			return nil, err
+		}
+		res = mergeStrings(res, vals)
+	}
+	return res, nil
+}
+
+func (q *fanoutQuerier) LabelValuesFor(string, labels.Label) ([]string, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (q *fanoutQuerier) Close() error {
+	var merr MultiError
+
+	for _, sq := range q.queriers {
+		merr.Add(sq.Close())
+	}
+	return merr.Err()
+}
+
+// withoutLabel returns the label set without the label with the given name.
+func withoutLabel(lset labels.Labels, name string) labels.Labels {
+	for i, l := range lset {
+		if l.Name != name {
+			continue
+		}
+		res := make(labels.Labels, 0, len(lset)-1)
+		res = append(res, lset[:i]...)
+		return append(res, lset[i+1:]...)
+	}
+	return lset
+}
+
+// listSeriesSet is a series set over a sorted list of series.
+type listSeriesSet struct {
+	series []Series
+	cur    int
+}
+
+func (s *listSeriesSet) Next() bool {
+	if s.cur >= len(s.series) {
+		return false
+	}
+	s.cur++
+	return true
+}
+
+func (s *listSeriesSet) At() Series { return s.series[s.cur-1] }
+func (s *listSeriesSet) Err() error { return nil }
+
+// relabeledSeries is a series with replaced labels.
+type relabeledSeries struct {
+	Series
+	lset labels.Labels
+}
+
+func (s *relabeledSeries) Labels() labels.Labels {
+	return s.lset
+}
+
+// dedupSeries merges the data of replicas of the same series.
+type dedupSeries struct {
+	series []Series
+	maxGap int64
+}
+
+func (s *dedupSeries) Labels() labels.Labels {
+	return s.series[0].Labels()
+}
+
+func (s *dedupSeries) Iterator() SeriesIterator {
+	its := make([]SeriesIterator, 0, len(s.series))
+	for _, sr := range s.series {
+		its = append(its, sr.Iterator())
+	}
+	return newDedupSeriesIterator(s.maxGap, its...)
+}
+
+// dedupSeriesIterator returns the samples of a single replica and switches
+// to another replica once the current one has a gap of more than maxGap.
+// Samples at or before the last returned timestamp are dropped.
+type dedupSeriesIterator struct {
+	its    []SeriesIterator
+	ok     []bool
+	maxGap int64
+
+	cur   int
+	lastT int64
+	err   error
+}
+
+func newDedupSeriesIterator(maxGap int64, its ...SeriesIterator) *dedupSeriesIterator {
+	return &dedupSeriesIterator{
+		its:    its,
+		maxGap: maxGap,
+		cur:    -1,
+		lastT:  math.MinInt64,
+	}
+}
+
+// pick selects the replica holding the next sample.
+func (it *dedupSeriesIterator) pick() bool {
+	for i, ok := range it.ok {
+		if !ok && it.its[i].Err() != nil {
+			it.err = it.its[i].Err()
+			return false
+		}
+	}
+	// Stay with the current replica unless it has a gap.
+	if it.cur >= 0 && it.ok[it.cur] && it.lastT != math.MinInt64 {
+		if t, _ := it.its[it.cur].At(); t-it.lastT <= it.maxGap {
+			it.lastT = t
+			return true
+		}
+	}
+	best, bestT := -1, int64(math.MaxInt64)
+	if it.cur >= 0 && it.ok[it.cur] {
+		best = it.cur
+		bestT, _ = it.its[it.cur].At()
+	}
+	for i, ok := range it.ok {
+		if !ok {
+			continue
+		}
+		if t, _ := it.its[i].At(); t < bestT {
+			best, bestT = i, t
+		}
+	}
+	if best < 0 {
+		return false
+	}
+	it.cur, it.lastT = best, bestT
+	return true
+}
+
+func (it *dedupSeriesIterator) Seek(t int64) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.ok != nil && it.cur >= 0 && it.lastT >= t {
+		return it.ok[it.cur]
+	}
+	started := it.ok != nil
+	if !started {
+		it.ok = make([]bool, len(it.its))
+	}
+	for i, sit := range it.its {
+		// Exhausted replicas are not seeked again.
+		if !started || it.ok[i] {
+			it.ok[i] = sit.Seek(t)
+		}
+	}
+	it.lastT = math.MinInt64
+
+	return it.pick()
+}
+
+func (it *dedupSeriesIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.ok == nil {
+		it.ok = make([]bool, len(it.its))
+		for i, sit := range it.its {
+			it.ok[i] = sit.Next()
+		}
+		return it.pick()
+	}
+	for i, sit := range it.its {
+		for it.ok[i] {
+			if t, _ := sit.At(); t > it.lastT {
+				break
+			}
+			it.ok[i] = sit.Next()
+		}
+	}
+	return it.pick()
+}
+
+func (it *dedupSeriesIterator) At() (t int64, v float64) {
+	return it.its[it.cur].At()
+}
+
+func (it *dedupSeriesIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/prometheus/tsdb/tsdbutil"
+)
+
+func samplesAt(ts ...int64) []tsdbutil.Sample {
+	res := make([]tsdbutil.Sample, 0, len(ts))
+	for _, t := range ts {
+		res = append(res, sample{t: t, v: float64(t)})
+	}
+	return res
+}
+
+func TestDedupSeriesIterator(t *testing.T) {
+	cases := []struct {
+		replicas [][]tsdbutil.Sample
+		exp      []sample
+	}{
+		{
+			replicas: [][]tsdbutil.Sample{samplesAt(0, 10, 20), samplesAt(0, 10, 20)},
+			exp:      []sample{{0, 0}, {10, 10}, {20, 20}},
+		},
+		{
+			// The first replica is kept as long as it has no gaps. Later samples
+			// of the second replica are still returned.
+			replicas: [][]tsdbutil.Sample{samplesAt(0, 10, 20, 30), samplesAt(1, 11, 21, 31)},
+			exp:      []sample{{0, 0}, {10, 10}, {20, 20}, {30, 30}, {31, 31}},
+		},
+		{
+			// The gap of the first replica is filled by the second one.
+			replicas: [][]tsdbutil.Sample{samplesAt(0, 10, 20, 60, 70), samplesAt(1, 11, 21, 31, 41, 51, 61)},
+			exp:      []sample{{0, 0}, {10, 10}, {20, 20}, {21, 21}, {31, 31}, {41, 41}, {51, 51}, {61, 61}, {70, 70}},
+		},
+		{
+			replicas: [][]tsdbutil.Sample{samplesAt(), samplesAt(5, 15)},
+			exp:      []sample{{5, 5}, {15, 15}},
+		},
+		{
+			replicas: [][]tsdbutil.Sample{samplesAt(), samplesAt()},
+		},
+	}
+	for i, c := range cases {
+		var its []SeriesIterator
+		for _, r := range c.replicas {
+			its = append(its, newListSeriesIterator(r))
+		}
+		res, err := expandSeriesIterator(newDedupSeriesIterator(10, its...))
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.exp, res, "case %d", i)
+	}
+}
+
+func TestDedupSeriesIterator_Seek(t *testing.T) {
+	it := newDedupSeriesIterator(10,
+		newListSeriesIterator(samplesAt(0, 10, 20, 60, 70)),
+		newListSeriesIterator(samplesAt(1, 11, 21, 31, 41, 51, 61)),
+	)
+	testutil.Assert(t, it.Seek(25), "seek failed")
+	ts, _ := it.At()
+	testutil.Equals(t, int64(31), ts)
+
+	// Seeking backwards does not move the iterator.
+	testutil.Assert(t, it.Seek(5), "seek failed")
+	ts, _ = it.At()
+	testutil.Equals(t, int64(31), ts)
+
+	res, err := expandSeriesIterator(it)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []sample{{41, 41}, {51, 51}, {61, 61}, {70, 70}}, res)
+
+	testutil.Assert(t, !it.Seek(100), "seek beyond end succeeded")
+}
+
+// listQuerier returns the series matching the selection from a fixed list.
+type listQuerier struct {
+	series []Series
+	closed bool
+}
+
+func (q *listQuerier) Select(ms ...labels.Matcher) (SeriesSet, error) {
+	var res []Series
+Outer:
+	for _, s := range q.series {
+		for _, m := range ms {
+			if !m.Matches(s.Labels().Get(m.Name())) {
+				continue Outer
+			}
+		}
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return labels.Compare(res[i].Labels(), res[j].Labels()) < 0
+	})
+	return newMockSeriesSet(res), nil
+}
+
+func (q *listQuerier) LabelValues(n string) ([]string, error) {
+	var res []string
+	for _, s := range q.series {
+		if v := s.Labels().Get(n); v != "" {
+			res = mergeStrings(res, []string{v})
+		}
+	}
+	return res, nil
+}
+
+func (q *listQuerier) LabelValuesFor(string, labels.Label) ([]string, error) {
+	return nil, nil
+}
+
+func (q *listQuerier) Close() error {
+	q.closed = true
+	return nil
+}
+
+func TestFanoutQuerier(t *testing.T) {
+	// Both queriers hold the data of both replicas. The replica label sorts
+	// before the label "z" so that removing it changes the order of the series.
+	q1 := &listQuerier{series: []Series{
+		newSeries(map[string]string{"a": "1", "replica": "x", "z": "2"}, samplesAt(0, 10, 20)),
+		newSeries(map[string]string{"a": "1", "replica": "y", "z": "1"}, samplesAt(0, 10)),
+		newSeries(map[string]string{"a": "1", "replica": "y", "z": "2"}, samplesAt(1, 11, 21, 31, 41)),
+	}}
+	q2 := &listQuerier{series: []Series{
+		newSeries(map[string]string{"a": "1", "replica": "x", "z": "2"}, samplesAt(50, 60)),
+		newSeries(map[string]string{"a": "2", "replica": "x"}, samplesAt(5)),
+	}}
+	q := NewFanoutQuerierWithOptions(FanoutOptions{ReplicaLabel: "replica", MaxGap: 10}, q1, q2)
+
+	ss, err := q.Select(labels.NewEqualMatcher("a", "1"))
+	testutil.Ok(t, err)
+
+	var (
+		lsets   []labels.Labels
+		samples [][]sample
+	)
+	for ss.Next() {
+		lsets = append(lsets, ss.At().Labels())
+		smpls, err := expandSeriesIterator(ss.At().Iterator())
+		testutil.Ok(t, err)
+		samples = append(samples, smpls)
+	}
+	testutil.Ok(t, ss.Err())
+
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings("a", "1", "z", "1"),
+		labels.FromStrings("a", "1", "z", "2"),
+	}, lsets)
+	testutil.Equals(t, [][]sample{
+		{{0, 0}, {10, 10}},
+		{{0, 0}, {10, 10}, {20, 20}, {21, 21}, {31, 31}, {41, 41}, {50, 50}, {60, 60}},
+	}, samples)
+
+	vals, err := q.LabelValues("a")
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"1", "2"}, vals)
+
+	vals, err = q.LabelValues("replica")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(vals))
+
+	testutil.Ok(t, q.Close())
+	testutil.Assert(t, q1.closed && q2.closed, "queriers not closed")
+}
+
+func TestNewFanoutQuerier(t *testing.T) {
+	// Without a replica label only identical series are deduplicated.
+	q1 := &listQuerier{series: []Series{
+		newSeries(map[string]string{"a": "1"}, samplesAt(0, 10)),
+	}}
+	q2 := &listQuerier{series: []Series{
+		newSeries(map[string]string{"a": "1"}, samplesAt(0, 10, 20)),
+		newSeries(map[string]string{"a": "2"}, samplesAt(0)),
+	}}
+	ss, err := NewFanoutQuerier(q1, q2).Select(labels.NewMustRegexpMatcher("a", ".*"))
+	testutil.Ok(t, err)
+
+	res := map[string][]sample{}
+	for ss.Next() {
+		smpls, err := expandSeriesIterator(ss.At().Iterator())
+		testutil.Ok(t, err)
+		res[ss.At().Labels().String()] = smpls
+	}
+	testutil.Ok(t, ss.Err())
+
+	testutil.Equals(t, map[string][]sample{
+		`{a="1"}`: {{0, 0}, {10, 10}, {20, 20}},
+		`{a="2"}`: {{0, 0}},
+	}, res)
+}
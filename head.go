@@ -14,7 +14,10 @@
 package tsdb
 
 import (
+	"io"
+	"io/ioutil"
 	"math"
+	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -31,6 +34,7 @@ import (
 	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/index"
 	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/value"
 	"github.com/prometheus/tsdb/wal"
 )
 
@@ -49,6 +53,10 @@ var (
 	// ErrOutOfBounds is returned if an appended sample is out of the
 	// writable time range.
 	ErrOutOfBounds = errors.New("out of bounds")
+
+	// ErrSeriesLimitExceeded is returned if an appended sample would create a
+	// new series while the head holds the maximum number of series.
+	ErrSeriesLimitExceeded = errors.New("series limit exceeded")
 )
 
 // Head handles reads and writes of time series data within a time window.
@@ -73,28 +81,156 @@ type Head struct {
 	postings *index.MemPostings // postings lists for terms
 
 	tombstones *memTombstones
+
+	limits *seriesLimits
+
+	// Hides samples of open appends from queriers.
+	iso *isolation
+
+	// Delivers series lifecycle events. Nil if there is no listener.
+	notifier *headNotifier
+
+	// Receive committed samples of matching series.
+	subs *subscriptions
+
+	chunkPolicy *ChunkPolicy
+
+	// Writes completed chunks to disk. Nil if all chunks are kept in memory.
+	chunkDiskMapper *chunks.ChunkDiskMapper
+
+	snapshotOnShutdown bool
 }
 
+// headChunksDirname is the directory within the DB directory that holds
+// the chunk files of the head block.
+const headChunksDirname = "chunks_head"
+
+// HeadOptions are parameters for the Head block.
+type HeadOptions struct {
+	// ChunkDir is the directory into which completed chunks are written. They are
+	// memory-mapped for reads and released from memory. If empty, all chunks are
+	// kept in memory.
+	ChunkDir string
+
+	// SnapshotOnShutdown writes a snapshot of the head on Close, which is loaded on
+	// the next Init instead of replaying the entire WAL. It requires a WAL.
+	SnapshotOnShutdown bool
+
+	// MaxSeries is the maximum number of series in the head. Samples for new
+	// series beyond it are rejected. Zero means no limit.
+	MaxSeries int
+
+	// MaxSeriesPerMetric is the maximum number of series with the same metric
+	// name in the head. Zero means no limit.
+	MaxSeriesPerMetric int
+
+	// Listener is notified about created and removed series and truncations.
+	Listener HeadListener
+
+	// ListenerQueueSize is the number of notifications buffered for the listener.
+	// Defaults to DefaultHeadListenerQueueSize.
+	ListenerQueueSize int
+
+	// ChunkPolicy controls when new chunks are cut for a series.
+	ChunkPolicy ChunkPolicy
+
+	// SubscriptionPolicy defines how subscribers falling behind are handled.
+	SubscriptionPolicy SubscriptionPolicy
+
+	// SubscriptionBufferSize is the number of commits buffered for each
+	// subscriber. Defaults to DefaultSubscriptionBufferSize.
+	SubscriptionBufferSize int
+}
+
+// DefaultSamplesPerChunk is the number of samples targeted per head chunk if no
+// other value is configured. Based on Gorilla white papers this offers near-optimal
+// compression ratio so anything bigger that this has diminishing returns and
+// increases the time range within which we have to decompress all samples.
+const DefaultSamplesPerChunk = 120
+
+// ChunkPolicy defines when the head cuts a new chunk for a series. A chunk is
+// cut when any of the limits is reached. Chunks never span across chunk
+// ranges of the head.
+type ChunkPolicy struct {
+	// SamplesPerChunk is the targeted number of samples per chunk. The end time
+	// of a chunk is estimated from the rate of its first samples. Defaults to
+	// DefaultSamplesPerChunk.
+	SamplesPerChunk int
+
+	// MaxChunkBytes is the maximum encoded size of a chunk in bytes. Zero means
+	// no limit.
+	MaxChunkBytes int
+
+	// MaxChunkDuration is the maximum time span of a chunk. Zero means no limit
+	// besides the chunk range of the head.
+	MaxChunkDuration int64
+}
+
+func (p *ChunkPolicy) validate() error {
+	if p.SamplesPerChunk < 0 || p.SamplesPerChunk > math.MaxUint16 {
+		return errors.Errorf("invalid samples per chunk %d", p.SamplesPerChunk)
+	}
+	if p.MaxChunkBytes < 0 {
+		return errors.Errorf("invalid max chunk bytes %d", p.MaxChunkBytes)
+	}
+	if p.MaxChunkDuration < 0 {
+		return errors.Errorf("invalid max chunk duration %d", p.MaxChunkDuration)
+	}
+	return nil
+}
+
+func (p *ChunkPolicy) samplesPerChunk() int {
+	if p == nil || p.SamplesPerChunk == 0 {
+		return DefaultSamplesPerChunk
+	}
+	return p.SamplesPerChunk
+}
+
+// full returns true if a sample at t must not be appended to the chunk anymore.
+func (p *ChunkPolicy) full(c *memChunk, t int64) bool {
+	if p == nil {
+		return false
+	}
+	if p.MaxChunkDuration > 0 && t-c.minTime >= p.MaxChunkDuration {
+		return true
+	}
+	if p.MaxChunkBytes > 0 && len(c.chunk.Bytes()) >= p.MaxChunkBytes {
+		return true
+	}
+	return false
+}
+
+// DefaultHeadOptions keeps all chunks in memory.
+var DefaultHeadOptions = &HeadOptions{}
+
 type headMetrics struct {
-	activeAppenders         prometheus.Gauge
-	series                  prometheus.Gauge
-	seriesCreated           prometheus.Counter
-	seriesRemoved           prometheus.Counter
-	seriesNotFound          prometheus.Counter
-	chunks                  prometheus.Gauge
-	chunksCreated           prometheus.Counter
-	chunksRemoved           prometheus.Counter
-	gcDuration              prometheus.Summary
-	minTime                 prometheus.GaugeFunc
-	maxTime                 prometheus.GaugeFunc
-	samplesAppended         prometheus.Counter
-	walTruncateDuration     prometheus.Summary
-	headTruncateFail        prometheus.Counter
-	headTruncateTotal       prometheus.Counter
-	checkpointDeleteFail    prometheus.Counter
-	checkpointDeleteTotal   prometheus.Counter
-	checkpointCreationFail  prometheus.Counter
-	checkpointCreationTotal prometheus.Counter
+	activeAppenders            prometheus.Gauge
+	series                     prometheus.Gauge
+	seriesCreated              prometheus.Counter
+	seriesRemoved              prometheus.Counter
+	seriesNotFound             prometheus.Counter
+	seriesRejected             prometheus.Counter
+	listenerEventsDropped      prometheus.Counter
+	subscriptions              prometheus.Gauge
+	subscriptionSamplesDropped prometheus.Counter
+	chunks                     prometheus.Gauge
+	chunksCreated              prometheus.Counter
+	chunksRemoved              prometheus.Counter
+	mmapChunkErrors            prometheus.Counter
+	gcDuration                 prometheus.Summary
+	minTime                    prometheus.GaugeFunc
+	maxTime                    prometheus.GaugeFunc
+	samplesAppended            prometheus.Counter
+	commitDuration             prometheus.Summary
+	walTruncateDuration        prometheus.Summary
+	headTruncateFail           prometheus.Counter
+	headTruncateTotal          prometheus.Counter
+	checkpointDeleteFail       prometheus.Counter
+	checkpointDeleteTotal      prometheus.Counter
+	checkpointCreationFail     prometheus.Counter
+	checkpointCreationTotal    prometheus.Counter
+	chunkSamples               prometheus.Histogram
+	chunkSizeBytes             prometheus.Histogram
 }
 
 func newHeadMetrics(h *Head, r prometheus.Registerer) *headMetrics {
@@ -120,6 +256,22 @@ func newHeadMetrics(h *Head, r prometheus.Registerer) *headMetrics {
 		Name: "prometheus_tsdb_head_series_not_found_total",
 		Help: "Total number of requests for series that were not found.",
 	})
+	m.seriesRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_head_series_rejected_total",
+		Help: "Total number of series not created because a series limit was reached.",
+	})
+	m.listenerEventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_head_listener_events_dropped_total",
+		Help: "Total number of series lifecycle events dropped as the head listener fell behind.",
+	})
+	m.subscriptions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_head_subscriptions",
+		Help: "Number of active subscriptions to samples committed to the head.",
+	})
+	m.subscriptionSamplesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_head_subscription_samples_dropped_total",
+		Help: "Total number of committed samples dropped as a subscriber fell behind.",
+	})
 	m.chunks = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "prometheus_tsdb_head_chunks",
 		Help: "Total number of chunks in the head block.",
@@ -132,6 +284,10 @@ func newHeadMetrics(h *Head, r prometheus.Registerer) *headMetrics {
 		Name: "prometheus_tsdb_head_chunks_removed_total",
 		Help: "Total number of chunks removed in the head",
 	})
+	m.mmapChunkErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_head_mmap_chunk_errors_total",
+		Help: "Total number of completed head chunks kept in memory as writing them to disk failed.",
+	})
 	m.gcDuration = prometheus.NewSummary(prometheus.SummaryOpts{
 		Name: "prometheus_tsdb_head_gc_duration_seconds",
 		Help: "Runtime of garbage collection in the head block.",
@@ -156,6 +312,10 @@ func newHeadMetrics(h *Head, r prometheus.Registerer) *headMetrics {
 		Name: "prometheus_tsdb_head_samples_appended_total",
 		Help: "Total number of appended samples.",
 	})
+	m.commitDuration = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "prometheus_tsdb_head_commit_duration_seconds",
+		Help: "Duration of appender commits, including writing to the WAL.",
+	})
 	m.headTruncateFail = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "prometheus_tsdb_head_truncations_failed_total",
 		Help: "Total number of head truncations that failed.",
@@ -181,27 +341,46 @@ func newHeadMetrics(h *Head, r prometheus.Registerer) *headMetrics {
 		Help: "Total number of checkpoint creations attempted.",
 	})
 
+	m.chunkSamples = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "prometheus_tsdb_head_chunk_samples",
+		Help:    "Number of samples in completed head chunks.",
+		Buckets: prometheus.ExponentialBuckets(4, 2, 12),
+	})
+	m.chunkSizeBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "prometheus_tsdb_head_chunk_size_bytes",
+		Help:    "Encoded size of completed head chunks.",
+		Buckets: prometheus.ExponentialBuckets(16, 2, 12),
+	})
+
 	if r != nil {
 		r.MustRegister(
 			m.activeAppenders,
 			m.chunks,
 			m.chunksCreated,
 			m.chunksRemoved,
+			m.mmapChunkErrors,
 			m.series,
 			m.seriesCreated,
 			m.seriesRemoved,
 			m.seriesNotFound,
+			m.seriesRejected,
+			m.listenerEventsDropped,
+			m.subscriptions,
+			m.subscriptionSamplesDropped,
 			m.minTime,
 			m.maxTime,
 			m.gcDuration,
 			m.walTruncateDuration,
 			m.samplesAppended,
+			m.commitDuration,
 			m.headTruncateFail,
 			m.headTruncateTotal,
 			m.checkpointDeleteFail,
 			m.checkpointDeleteTotal,
 			m.checkpointCreationFail,
 			m.checkpointCreationTotal,
+			m.chunkSamples,
+			m.chunkSizeBytes,
 		)
 	}
 	return m
@@ -209,12 +388,28 @@ func newHeadMetrics(h *Head, r prometheus.Registerer) *headMetrics {
 
 // NewHead opens the head block in dir.
 func NewHead(r prometheus.Registerer, l log.Logger, wal *wal.WAL, chunkRange int64) (*Head, error) {
+	return NewHeadWithOptions(r, l, wal, chunkRange, nil)
+}
+
+// NewHeadWithOptions opens the head block in dir like NewHead with the given
+// options. Nil options use DefaultHeadOptions.
+func NewHeadWithOptions(r prometheus.Registerer, l log.Logger, wal *wal.WAL, chunkRange int64, opts *HeadOptions) (*Head, error) {
 	if l == nil {
 		l = log.NewNopLogger()
 	}
+	if opts == nil {
+		opts = DefaultHeadOptions
+	}
 	if chunkRange < 1 {
 		return nil, errors.Errorf("invalid chunk range %d", chunkRange)
 	}
+	if opts.MaxSeries < 0 || opts.MaxSeriesPerMetric < 0 {
+		return nil, errors.New("series limits must not be negative")
+	}
+	if err := opts.ChunkPolicy.validate(); err != nil {
+		return nil, err
+	}
+	chunkPolicy := opts.ChunkPolicy
 	h := &Head{
 		wal:        wal,
 		logger:     l,
@@ -226,12 +421,51 @@ func NewHead(r prometheus.Registerer, l log.Logger, wal *wal.WAL, chunkRange int
 		symbols:    map[string]struct{}{},
 		postings:   index.NewUnorderedMemPostings(),
 		tombstones: NewMemTombstones(),
+		limits:     newSeriesLimits(opts.MaxSeries, opts.MaxSeriesPerMetric),
+		iso:        newIsolation(),
+
+		chunkPolicy: &chunkPolicy,
+
+		snapshotOnShutdown: opts.SnapshotOnShutdown && wal != nil,
 	}
 	h.metrics = newHeadMetrics(h, r)
 
+	if opts.Listener != nil {
+		h.notifier = newHeadNotifier(opts.Listener, opts.ListenerQueueSize, h.metrics)
+	}
+	h.subs = newSubscriptions(opts.SubscriptionPolicy, opts.SubscriptionBufferSize, h.metrics)
+
+	if opts.ChunkDir != "" {
+		cdm, err := h.openChunkDiskMapper(opts.ChunkDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "open head chunks")
+		}
+		h.chunkDiskMapper = cdm
+	}
 	return h, nil
 }
 
+// openChunkDiskMapper opens the head chunks in dir. Corrupted head chunks are
+// deleted as all their data can be restored from the WAL.
+func (h *Head) openChunkDiskMapper(dir string) (*chunks.ChunkDiskMapper, error) {
+	cdm, err := chunks.NewChunkDiskMapper(dir)
+	if _, ok := err.(*chunks.CorruptionErr); !ok {
+		return cdm, err
+	}
+	level.Warn(h.logger).Log("msg", "deleting corrupted head chunks", "err", err)
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	// Snapshots may reference the deleted chunks.
+	if h.wal != nil {
+		if err := deleteChunkSnapshots(h.wal.Dir(), math.MaxInt64); err != nil {
+			return nil, errors.Wrap(err, "delete head snapshots")
+		}
+	}
+	return chunks.NewChunkDiskMapper(dir)
+}
+
 // processWALSamples adds a partition of samples it receives to the head and passes
 // them on to other workers.
 // Samples before the mint timestamp are discarded.
@@ -254,7 +488,9 @@ func (h *Head) processWALSamples(
 				unknownRefs++
 				continue
 			}
+			ms.Lock()
 			_, chunkCreated := ms.append(s.T, s.V)
+			ms.Unlock()
 			if chunkCreated {
 				h.metrics.chunksCreated.Inc()
 				h.metrics.chunks.Inc()
@@ -294,7 +530,14 @@ func (h *Head) updateMinMaxTime(mint, maxt int64) {
 	}
 }
 
-func (h *Head) loadWAL(r *wal.Reader) error {
+// recordReader reads records from a WAL. It is implemented by wal.Reader and wal.LiveReader.
+type recordReader interface {
+	Next() bool
+	Err() error
+	Record() []byte
+}
+
+func (h *Head) loadWAL(r recordReader, mmappedChunks map[uint64][]*memChunk) error {
 	minValidTime := h.MinTime()
 	// If the min time is still uninitialized (no persisted blocks yet),
 	// we accept all sample timestamps from the WAL.
@@ -348,10 +591,19 @@ func (h *Head) loadWAL(r *wal.Reader) error {
 				return errors.Wrap(err, "decode series")
 			}
 			for _, s := range series {
-				h.getOrCreateWithID(s.Ref, s.Labels.Hash(), s.Labels)
+				ms, created := h.getOrCreateWithID(s.Ref, s.Labels.Hash(), s.Labels)
+
+				// Samples up to the end of the memory-mapped chunks are dropped
+				// when appending them.
+				if mcs, ok := mmappedChunks[s.Ref]; ok && created {
+					ms.chunks = mcs
+					h.metrics.chunks.Add(float64(len(mcs)))
+					h.metrics.chunksCreated.Add(float64(len(mcs)))
+					delete(mmappedChunks, s.Ref)
+				}
 
-				if h.lastSeriesID < s.Ref {
-					h.lastSeriesID = s.Ref
+				if atomic.LoadUint64(&h.lastSeriesID) < s.Ref {
+					atomic.StoreUint64(&h.lastSeriesID, s.Ref)
 				}
 			}
 		case RecordSamples:
@@ -416,6 +668,31 @@ func (h *Head) Init() error {
 	if h.wal == nil {
 		return nil
 	}
+	// The listener must not miss the series restored on startup.
+	h.notifier.setBlocking(true)
+	defer h.notifier.setBlocking(false)
+
+	// Restore the head from a snapshot if possible and only replay the WAL written after it.
+	startFrom, offset, err := h.loadChunkSnapshot()
+	if err == nil {
+		return h.replayWAL(startFrom, offset, nil)
+	}
+	if err != ErrNotFound {
+		// Nothing was loaded and we can fall back to replaying the entire WAL.
+		level.Warn(h.logger).Log("msg", "loading head snapshot failed, replaying entire WAL", "err", err)
+
+		if err := deleteChunkSnapshots(h.wal.Dir(), math.MaxInt64); err != nil {
+			return errors.Wrap(err, "delete head snapshots")
+		}
+	}
+
+	var mmappedChunks map[uint64][]*memChunk
+	if h.chunkDiskMapper != nil {
+		var err error
+		if mmappedChunks, err = h.loadMmappedChunks(); err != nil {
+			return errors.Wrap(err, "load head chunks")
+		}
+	}
 
 	// Backfill the checkpoint first if it exists.
 	dir, startFrom, err := LastCheckpoint(h.wal.Dir())
@@ -431,20 +708,44 @@ func (h *Head) Init() error {
 
 		// A corrupted checkpoint is a hard error for now and requires user
 		// intervention. There's likely little data that can be recovered anyway.
-		if err := h.loadWAL(wal.NewReader(sr)); err != nil {
+		if err := h.loadWAL(wal.NewReader(sr), mmappedChunks); err != nil {
 			return errors.Wrap(err, "backfill checkpoint")
 		}
 		startFrom++
 	}
 
 	// Backfill segments from the last checkpoint onwards
+	return h.replayWAL(startFrom, 0, mmappedChunks)
+}
+
+// replayWAL loads all WAL segments starting at the given offset of segment startFrom.
+func (h *Head) replayWAL(startFrom int, offset int64, mmappedChunks map[uint64][]*memChunk) error {
 	sr, err := wal.NewSegmentsRangeReader(h.wal.Dir(), startFrom, -1)
 	if err != nil {
 		return errors.Wrap(err, "open WAL segments")
 	}
 	defer sr.Close()
 
-	err = h.loadWAL(wal.NewReader(sr))
+	if _, err := io.CopyN(ioutil.Discard, sr, offset); err != nil {
+		return errors.Wrap(err, "skip WAL records")
+	}
+	// When salvaging, all readable records are loaded and the corrupted
+	// segments are rewritten afterwards.
+	if h.wal.RepairStrategy() == wal.RepairSalvage {
+		r := wal.NewSalvageReader(sr)
+		if err := h.loadWAL(r, mmappedChunks); err != nil {
+			return err
+		}
+		if losses := r.Losses(); len(losses) > 0 {
+			level.Warn(h.logger).Log("msg", "skipped corrupted WAL data, salvaging segments", "from", losses[0].Segment)
+
+			if _, err := h.wal.Salvage(losses[0].Segment); err != nil {
+				return errors.Wrap(err, "salvage corrupted WAL")
+			}
+		}
+		return nil
+	}
+	err = h.loadWAL(wal.NewReader(sr), mmappedChunks)
 	if err == nil {
 		return nil
 	}
@@ -456,6 +757,34 @@ func (h *Head) Init() error {
 	return nil
 }
 
+// loadMmappedChunks returns the chunks written to disk by a previous head by
+// their series reference. Chunks before the head's min time are skipped.
+func (h *Head) loadMmappedChunks() (map[uint64][]*memChunk, error) {
+	minValidTime := h.MinTime()
+	if minValidTime == math.MaxInt64 {
+		minValidTime = math.MinInt64
+	}
+	res := map[uint64][]*memChunk{}
+
+	err := h.chunkDiskMapper.IterateAllChunks(func(seriesRef, chunkRef uint64, mint, maxt int64) error {
+		if maxt < minValidTime {
+			return nil
+		}
+		// A chunk may have been written again by a previous head that replayed
+		// the WAL after loading a snapshot.
+		if mcs := res[seriesRef]; len(mcs) > 0 && mint <= mcs[len(mcs)-1].maxTime {
+			return nil
+		}
+		res[seriesRef] = append(res[seriesRef], &memChunk{
+			ref:     chunkRef,
+			minTime: mint,
+			maxTime: maxt,
+		})
+		return nil
+	})
+	return res, err
+}
+
 // Truncate removes old data before mint from the head.
 func (h *Head) Truncate(mint int64) (err error) {
 	defer func() {
@@ -488,6 +817,14 @@ func (h *Head) Truncate(mint int64) (err error) {
 	level.Info(h.logger).Log("msg", "head GC completed", "duration", time.Since(start))
 	h.metrics.gcDuration.Observe(time.Since(start).Seconds())
 
+	h.notifier.notify(headEvent{typ: headEventTruncated, mint: mint})
+
+	if h.chunkDiskMapper != nil {
+		if err := h.chunkDiskMapper.Truncate(mint); err != nil {
+			// Leftover files are deleted at the next truncation.
+			level.Error(h.logger).Log("msg", "truncating head chunk files failed", "err", err)
+		}
+	}
 	if h.wal == nil {
 		return nil
 	}
@@ -523,6 +860,10 @@ func (h *Head) Truncate(mint int64) (err error) {
 		level.Error(h.logger).Log("msg", "truncating segments failed", "err", err)
 	}
 	h.metrics.checkpointDeleteTotal.Inc()
+	// Snapshots taken before the checkpoint can no longer be used.
+	if err := deleteChunkSnapshots(h.wal.Dir(), last+1); err != nil {
+		level.Error(h.logger).Log("msg", "delete head snapshots", "err", err)
+	}
 	if err := DeleteCheckpoints(h.wal.Dir(), last); err != nil {
 		// Leftover old checkpoints do not cause problems down the line beyond
 		// occupying disk space.
@@ -555,14 +896,23 @@ func (h *Head) initTime(t int64) (initialized bool) {
 type rangeHead struct {
 	head       *Head
 	mint, maxt int64
+
+	// Hides samples of appends that were not committed when the range head was
+	// created. Nil if all samples are visible. The state is owned and closed
+	// by the creator of the range head.
+	iso *isolationState
 }
 
 func (h *rangeHead) Index() (IndexReader, error) {
-	return h.head.indexRange(h.mint, h.maxt), nil
+	ir := h.head.indexRange(h.mint, h.maxt)
+	ir.iso = h.iso
+	return ir, nil
 }
 
 func (h *rangeHead) Chunks() (ChunkReader, error) {
-	return h.head.chunksRange(h.mint, h.maxt), nil
+	cr := h.head.chunksRange(h.mint, h.maxt)
+	cr.iso = h.iso
+	return cr, nil
 }
 
 func (h *rangeHead) Tombstones() (TombstoneReader, error) {
@@ -620,12 +970,16 @@ func (h *Head) Appender() Appender {
 }
 
 func (h *Head) appender() *headAppender {
+	cleanupAppendIDsBelow := h.iso.lowWatermark()
+
 	return &headAppender{
-		head:         h,
-		minValidTime: h.MaxTime() - h.chunkRange/2,
-		mint:         math.MaxInt64,
-		maxt:         math.MinInt64,
-		samples:      h.getAppendBuffer(),
+		head:                  h,
+		appendID:              h.iso.newAppendID(),
+		cleanupAppendIDsBelow: cleanupAppendIDsBelow,
+		minValidTime:          h.MaxTime() - h.chunkRange/2,
+		mint:                  math.MaxInt64,
+		maxt:                  math.MinInt64,
+		samples:               h.getAppendBuffer(),
 	}
 }
 
@@ -658,6 +1012,9 @@ type headAppender struct {
 	minValidTime int64 // No samples below this timestamp are allowed.
 	mint, maxt   int64
 
+	appendID              uint64
+	cleanupAppendIDsBelow uint64
+
 	series  []RefSeries
 	samples []RefSample
 }
@@ -667,7 +1024,14 @@ func (a *headAppender) Add(lset labels.Labels, t int64, v float64) (uint64, erro
 		return 0, ErrOutOfBounds
 	}
 
-	s, created := a.head.getOrCreate(lset.Hash(), lset)
+	hash := lset.Hash()
+
+	// Samples for existing series are accepted regardless of the limits.
+	if a.head.series.getByHash(hash, lset) == nil && !a.head.limits.allow(lset) {
+		a.head.metrics.seriesRejected.Inc()
+		return 0, ErrSeriesLimitExceeded
+	}
+	s, created := a.head.getOrCreate(hash, lset)
 	if created {
 		a.series = append(a.series, RefSeries{
 			Ref:    s.ref,
@@ -741,8 +1105,13 @@ func (a *headAppender) log() error {
 }
 
 func (a *headAppender) Commit() error {
+	start := time.Now()
+	defer func() {
+		a.head.metrics.commitDuration.Observe(time.Since(start).Seconds())
+	}()
 	defer a.head.metrics.activeAppenders.Dec()
 	defer a.head.putAppendBuffer(a.samples)
+	defer a.head.iso.closeAppend(a.appendID)
 
 	if err := a.log(); err != nil {
 		return errors.Wrap(err, "write to WAL")
@@ -750,14 +1119,23 @@ func (a *headAppender) Commit() error {
 
 	total := len(a.samples)
 
+	var committed []RefSample
+	publish := !a.head.subs.empty()
+
 	for _, s := range a.samples {
 		s.series.Lock()
 		ok, chunkCreated := s.series.append(s.T, s.V)
+		if ok {
+			s.series.addAppendID(a.appendID, s.T)
+		}
+		s.series.cleanupAppendIDsBelow(a.cleanupAppendIDsBelow)
 		s.series.pendingCommit = false
 		s.series.Unlock()
 
 		if !ok {
 			total--
+		} else if publish {
+			committed = append(committed, s)
 		}
 		if chunkCreated {
 			a.head.metrics.chunks.Inc()
@@ -768,11 +1146,15 @@ func (a *headAppender) Commit() error {
 	a.head.metrics.samplesAppended.Add(float64(total))
 	a.head.updateMinMaxTime(a.mint, a.maxt)
 
+	if len(committed) > 0 {
+		a.head.subs.publish(committed)
+	}
 	return nil
 }
 
 func (a *headAppender) Rollback() error {
 	a.head.metrics.activeAppenders.Dec()
+	defer a.head.iso.closeAppend(a.appendID)
 	for _, s := range a.samples {
 		s.series.Lock()
 		s.series.pendingCommit = false
@@ -836,7 +1218,11 @@ func (h *Head) gc() {
 
 	// Drop old chunks and remember series IDs and hashes if they can be
 	// deleted entirely.
-	deleted, chunksRemoved := h.series.gc(mint)
+	deleted, chunksRemoved := h.series.gc(mint, func(s *memSeries) {
+		h.limits.remove(s.lset)
+		h.notifier.notify(headEvent{typ: headEventSeriesRemoved, ref: s.ref, lset: s.lset})
+		h.subs.seriesRemoved(s.ref)
+	})
 	seriesRemoved := len(deleted)
 
 	h.metrics.seriesRemoved.Add(float64(seriesRemoved))
@@ -916,15 +1302,29 @@ func (h *Head) MaxTime() int64 {
 
 // Close flushes the WAL and closes the head.
 func (h *Head) Close() error {
-	if h.wal == nil {
-		return nil
+	var merr MultiError
+
+	if h.chunkDiskMapper != nil {
+		merr.Add(h.chunkDiskMapper.Close())
 	}
-	return h.wal.Close()
+	if h.wal != nil {
+		err := h.wal.Close()
+		merr.Add(err)
+
+		if err == nil && h.snapshotOnShutdown {
+			merr.Add(errors.Wrap(h.writeChunkSnapshot(), "write head snapshot"))
+		}
+	}
+	h.notifier.close()
+	h.subs.closeAll()
+
+	return merr.Err()
 }
 
 type headChunkReader struct {
 	head       *Head
 	mint, maxt int64
+	iso        *isolationState
 }
 
 func (h *headChunkReader) Close() error {
@@ -966,31 +1366,55 @@ func (h *headChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
 		s.Unlock()
 		return nil, ErrNotFound
 	}
+	chk, ref, mmapped := c.chunk, c.ref, c.mmapped()
+	limit := s.isolationLimit(h.iso)
 	s.Unlock()
 
+	// Memory-mapped chunks are complete and never change.
+	if mmapped {
+		mc, err := h.head.chunkDiskMapper.Chunk(ref)
+		if err != nil || limit == math.MaxInt64 {
+			return mc, err
+		}
+		return &isolationChunk{Chunk: mc, limit: limit}, nil
+	}
 	return &safeChunk{
-		Chunk: c.chunk,
+		Chunk: chk,
 		s:     s,
 		cid:   int(cid),
+		limit: limit,
 	}, nil
 }
 
 type safeChunk struct {
 	chunkenc.Chunk
-	s   *memSeries
-	cid int
+	s     *memSeries
+	cid   int
+	limit int64 // Samples at or after it are hidden from the reader.
 }
 
 func (c *safeChunk) Iterator() chunkenc.Iterator {
 	c.s.Lock()
-	it := c.s.iterator(c.cid)
-	c.s.Unlock()
-	return it
+	defer c.s.Unlock()
+
+	var it chunkenc.Iterator
+	// The chunk was memory-mapped after it was retrieved. It is complete
+	// and the data we hold can no longer change.
+	if mc := c.s.chunk(c.cid); mc != nil && mc.mmapped() {
+		it = c.Chunk.Iterator()
+	} else {
+		it = c.s.iterator(c.cid)
+	}
+	if c.limit == math.MaxInt64 {
+		return it
+	}
+	return &isolationIterator{Iterator: it, limit: c.limit}
 }
 
 type headIndexReader struct {
 	head       *Head
 	mint, maxt int64
+	iso        *isolationState
 }
 
 func (h *headIndexReader) Close() error {
@@ -1069,14 +1493,24 @@ func (h *headIndexReader) Series(ref uint64, lbls *labels.Labels, chks *[]chunks
 
 	*chks = (*chks)[:0]
 
+	limit := s.isolationLimit(h.iso)
+
 	for i, c := range s.chunks {
 		// Do not expose chunks that are outside of the specified range.
 		if !c.OverlapsClosedInterval(h.mint, h.maxt) {
 			continue
 		}
+		// Do not expose chunks that only hold samples hidden from the reader.
+		if c.minTime >= limit {
+			continue
+		}
+		maxt := c.maxTime
+		if maxt >= limit {
+			maxt = limit - 1
+		}
 		*chks = append(*chks, chunks.Meta{
 			MinTime: c.minTime,
-			MaxTime: c.maxTime,
+			MaxTime: maxt,
 			Ref:     packChunkID(s.ref, uint64(s.chunkID(i))),
 		})
 	}
@@ -1113,6 +1547,10 @@ func (h *Head) getOrCreate(hash uint64, lset labels.Labels) (*memSeries, bool) {
 
 func (h *Head) getOrCreateWithID(id, hash uint64, lset labels.Labels) (*memSeries, bool) {
 	s := newMemSeries(lset, id, h.chunkRange)
+	s.chunkDiskMapper = h.chunkDiskMapper
+	s.chunkPolicy = h.chunkPolicy
+	s.metrics = h.metrics
+	s.logger = h.logger
 
 	s, created := h.series.getOrSet(hash, s)
 	if !created {
@@ -1121,8 +1559,11 @@ func (h *Head) getOrCreateWithID(id, hash uint64, lset labels.Labels) (*memSerie
 
 	h.metrics.series.Inc()
 	h.metrics.seriesCreated.Inc()
+	h.limits.add(lset)
+	h.notifier.notify(headEvent{typ: headEventSeriesCreated, ref: id, lset: lset})
 
 	h.postings.Add(id, lset)
+	h.subs.seriesCreated(id, lset)
 
 	h.symMtx.Lock()
 	defer h.symMtx.Unlock()
@@ -1142,6 +1583,74 @@ func (h *Head) getOrCreateWithID(id, hash uint64, lset labels.Labels) (*memSerie
 	return s, true
 }
 
+const metricNameLabel = "__name__"
+
+// seriesLimits tracks the number of series in the head to limit the creation
+// of new ones. Concurrent appenders may exceed the limits by a few series as
+// they are checked before the series are created.
+type seriesLimits struct {
+	maxSeries    int
+	maxPerMetric int
+
+	mtx       sync.Mutex
+	series    int
+	perMetric map[string]int // Only tracked if maxPerMetric is set.
+}
+
+func newSeriesLimits(maxSeries, maxPerMetric int) *seriesLimits {
+	l := &seriesLimits{
+		maxSeries:    maxSeries,
+		maxPerMetric: maxPerMetric,
+	}
+	if maxPerMetric > 0 {
+		l.perMetric = map[string]int{}
+	}
+	return l
+}
+
+// allow returns true if a new series with the given labels may be created.
+func (l *seriesLimits) allow(lset labels.Labels) bool {
+	if l.maxSeries == 0 && l.maxPerMetric == 0 {
+		return true
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.maxSeries > 0 && l.series >= l.maxSeries {
+		return false
+	}
+	if l.maxPerMetric > 0 && l.perMetric[lset.Get(metricNameLabel)] >= l.maxPerMetric {
+		return false
+	}
+	return true
+}
+
+func (l *seriesLimits) add(lset labels.Labels) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.series++
+	if l.perMetric != nil {
+		l.perMetric[lset.Get(metricNameLabel)]++
+	}
+}
+
+func (l *seriesLimits) remove(lset labels.Labels) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.series--
+	if l.perMetric == nil {
+		return
+	}
+	name := lset.Get(metricNameLabel)
+	if n := l.perMetric[name]; n > 1 {
+		l.perMetric[name] = n - 1
+	} else {
+		delete(l.perMetric, name)
+	}
+}
+
 // seriesHashmap is a simple hashmap for memSeries by their label set. It is built
 // on top of a regular hashmap and holds a slice of series to resolve hash collisions.
 // Its methods require the hash to be submitted with it to avoid re-computations throughout
@@ -1216,8 +1725,8 @@ func newStripeSeries() *stripeSeries {
 }
 
 // gc garbage collects old chunks that are strictly before mint and removes
-// series entirely that have no chunks left.
-func (s *stripeSeries) gc(mint int64) (map[uint64]struct{}, int) {
+// series entirely that have no chunks left. Removed series are passed to onDelete.
+func (s *stripeSeries) gc(mint int64, onDelete func(*memSeries)) (map[uint64]struct{}, int) {
 	var (
 		deleted  = map[uint64]struct{}{}
 		rmChunks = 0
@@ -1249,6 +1758,7 @@ func (s *stripeSeries) gc(mint int64) (map[uint64]struct{}, int) {
 				}
 
 				deleted[series.ref] = struct{}{}
+				onDelete(series)
 				s.hashes[i].del(hash, series.lset)
 				delete(s.series[j], series.ref)
 
@@ -1337,6 +1847,16 @@ type memSeries struct {
 	pendingCommit bool // Whether there are samples waiting to be committed to this series.
 
 	app chunkenc.Appender // Current appender for the chunk.
+
+	chunkPolicy *ChunkPolicy // Defaults apply if nil.
+	metrics     *headMetrics // Observes completed chunks if set.
+	logger      log.Logger   // Logs failures to write head chunks to disk if set.
+
+	// Append IDs of the most recent samples, which may not be visible to
+	// all readers yet.
+	txs []txEntry
+
+	chunkDiskMapper *chunks.ChunkDiskMapper
 }
 
 func (s *memSeries) minTime() int64 {
@@ -1355,6 +1875,12 @@ func (s *memSeries) maxTime() int64 {
 }
 
 func (s *memSeries) cut(mint int64) *memChunk {
+	if c := s.head(); c != nil && !c.mmapped() && s.metrics != nil {
+		s.metrics.chunkSamples.Observe(float64(c.chunk.NumSamples()))
+		s.metrics.chunkSizeBytes.Observe(float64(len(c.chunk.Bytes())))
+	}
+	s.mmapHeadChunk()
+
 	c := &memChunk{
 		chunk:   chunkenc.NewXORChunk(),
 		minTime: mint,
@@ -1374,6 +1900,26 @@ func (s *memSeries) cut(mint int64) *memChunk {
 	return c
 }
 
+// mmapHeadChunk writes the current head chunk to disk and releases its data from
+// memory. The chunk is kept in memory if it cannot be written.
+func (s *memSeries) mmapHeadChunk() {
+	c := s.head()
+	if c == nil || c.mmapped() || s.chunkDiskMapper == nil {
+		return
+	}
+	ref, err := s.chunkDiskMapper.WriteChunk(s.ref, c.minTime, c.maxTime, c.chunk)
+	if err != nil {
+		if s.metrics != nil {
+			s.metrics.mmapChunkErrors.Inc()
+		}
+		if s.logger != nil {
+			level.Error(s.logger).Log("msg", "write head chunk to disk", "series", s.ref, "err", err)
+		}
+		return
+	}
+	c.chunk, c.ref = nil, ref
+}
+
 func newMemSeries(lset labels.Labels, id uint64, chunkRange int64) *memSeries {
 	s := &memSeries{
 		lset:       lset,
@@ -1399,10 +1945,16 @@ func (s *memSeries) appendable(t int64, v float64) error {
 	}
 	// We are allowing exact duplicates as we can encounter them in valid cases
 	// like federation and erroring out at that time would be extremely noisy.
-	if math.Float64bits(s.lastValue) != math.Float64bits(v) {
-		return ErrAmendSample
+	if math.Float64bits(s.lastValue) == math.Float64bits(v) {
+		return nil
 	}
-	return nil
+	// A stale marker for the timestamp of the last sample, or a sample for the
+	// timestamp of a stale marker, does not conflict with it. The sample is
+	// dropped like a duplicate.
+	if value.IsStaleNaN(v) || value.IsStaleNaN(s.lastValue) {
+		return nil
+	}
+	return ErrAmendSample
 }
 
 func (s *memSeries) chunk(id int) *memChunk {
@@ -1435,13 +1987,15 @@ func (s *memSeries) truncateChunksBefore(mint int64) (removed int) {
 
 // append adds the sample (t, v) to the series.
 func (s *memSeries) append(t int64, v float64) (success, chunkCreated bool) {
-	// Based on Gorilla white papers this offers near-optimal compression ratio
-	// so anything bigger that this has diminishing returns and increases
-	// the time range within which we have to decompress all samples.
-	const samplesPerChunk = 120
-
 	c := s.head()
 
+	// A memory-mapped head chunk was loaded from disk and cannot be appended to.
+	if c != nil && c.mmapped() {
+		if c.maxTime >= t {
+			return false, false
+		}
+		c = nil
+	}
 	if c == nil {
 		c = s.cut(t)
 		chunkCreated = true
@@ -1455,10 +2009,14 @@ func (s *memSeries) append(t int64, v float64) (success, chunkCreated bool) {
 	// If we reach 25% of a chunk's desired sample count, set a definitive time
 	// at which to start the next chunk.
 	// At latest it must happen at the timestamp set when the chunk was cut.
-	if numSamples == samplesPerChunk/4 {
+	quarter := s.chunkPolicy.samplesPerChunk() / 4
+	if quarter < 1 {
+		quarter = 1
+	}
+	if numSamples == quarter {
 		s.nextAt = computeChunkEndTime(c.minTime, c.maxTime, s.nextAt)
 	}
-	if t >= s.nextAt {
+	if t >= s.nextAt || (numSamples > 0 && s.chunkPolicy.full(c, t)) {
 		c = s.cut(t)
 		chunkCreated = true
 	}
@@ -1495,6 +2053,13 @@ func (s *memSeries) iterator(id int) chunkenc.Iterator {
 	if c == nil {
 		return chunkenc.NewNopIterator()
 	}
+	if c.mmapped() {
+		chk, err := s.chunkDiskMapper.Chunk(c.ref)
+		if err != nil {
+			return &errChunkIterator{err: err}
+		}
+		return chk.Iterator()
+	}
 
 	if id-s.firstChunkID < len(s.chunks)-1 {
 		return c.chunk.Iterator()
@@ -1518,15 +2083,29 @@ func (s *memSeries) head() *memChunk {
 }
 
 type memChunk struct {
-	chunk            chunkenc.Chunk
+	chunk            chunkenc.Chunk // Nil if the chunk is memory-mapped.
+	ref              uint64         // Reference into the head chunk files if memory-mapped.
 	minTime, maxTime int64
 }
 
+// mmapped returns whether the chunk's data was written to disk and released from memory.
+func (mc *memChunk) mmapped() bool {
+	return mc.ref != 0
+}
+
 // Returns true if the chunk overlaps [mint, maxt].
 func (mc *memChunk) OverlapsClosedInterval(mint, maxt int64) bool {
 	return mc.minTime <= maxt && mint <= mc.maxTime
 }
 
+type errChunkIterator struct {
+	err error
+}
+
+func (it *errChunkIterator) At() (int64, float64) { return 0, 0 }
+func (it *errChunkIterator) Next() bool           { return false }
+func (it *errChunkIterator) Err() error           { return it.err }
+
 type memSafeIterator struct {
 	chunkenc.Iterator
 
@@ -0,0 +1,169 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"sync"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// HeadListener is notified about the lifecycle of series in the head.
+// Notifications are delivered sequentially and in order from a separate
+// goroutine. If the listener falls behind, notifications are dropped, except
+// while the head is restored from the WAL on startup. Then the restore waits
+// for the listener instead.
+type HeadListener interface {
+	// SeriesCreated is called for every series created in the head, including
+	// the series restored from the WAL on startup.
+	SeriesCreated(ref uint64, lset labels.Labels)
+
+	// SeriesRemoved is called for series removed from the head as they have no
+	// data left after a truncation.
+	SeriesRemoved(ref uint64, lset labels.Labels)
+
+	// Truncated is called after data before mint was removed from the head.
+	Truncated(mint int64)
+}
+
+// DefaultHeadListenerQueueSize is the number of notifications buffered for a
+// head listener if no size is configured.
+const DefaultHeadListenerQueueSize = 1024
+
+type headEventType uint8
+
+const (
+	headEventSeriesCreated headEventType = iota
+	headEventSeriesRemoved
+	headEventTruncated
+)
+
+type headEvent struct {
+	typ  headEventType
+	ref  uint64
+	lset labels.Labels
+	mint int64
+}
+
+// headNotifier delivers head events to a listener through a bounded queue.
+type headNotifier struct {
+	listener HeadListener
+	queue    chan headEvent
+	stopc    chan struct{}
+	donec    chan struct{}
+	metrics  *headMetrics
+
+	mtx      sync.RWMutex
+	closed   bool
+	blocking bool
+}
+
+func newHeadNotifier(l HeadListener, size int, m *headMetrics) *headNotifier {
+	if size <= 0 {
+		size = DefaultHeadListenerQueueSize
+	}
+	n := &headNotifier{
+		listener: l,
+		queue:    make(chan headEvent, size),
+		stopc:    make(chan struct{}),
+		donec:    make(chan struct{}),
+		metrics:  m,
+	}
+	go n.run()
+
+	return n
+}
+
+func (n *headNotifier) run() {
+	defer close(n.donec)
+
+	for {
+		select {
+		case e := <-n.queue:
+			n.deliver(e)
+		case <-n.stopc:
+			// Deliver the events queued before the notifier was closed.
+			for {
+				select {
+				case e := <-n.queue:
+					n.deliver(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (n *headNotifier) deliver(e headEvent) {
+	switch e.typ {
+	case headEventSeriesCreated:
+		n.listener.SeriesCreated(e.ref, e.lset)
+	case headEventSeriesRemoved:
+		n.listener.SeriesRemoved(e.ref, e.lset)
+	case headEventTruncated:
+		n.listener.Truncated(e.mint)
+	}
+}
+
+// setBlocking makes notify wait for space in the queue instead of dropping
+// events. It is used while the head is restored so that no events are lost.
+func (n *headNotifier) setBlocking(b bool) {
+	if n == nil {
+		return
+	}
+	n.mtx.Lock()
+	n.blocking = b
+	n.mtx.Unlock()
+}
+
+// notify queues the event. Unless the notifier is blocking, the event is
+// dropped if the queue is full. Events after close are dropped.
+func (n *headNotifier) notify(e headEvent) {
+	if n == nil {
+		return
+	}
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+
+	if n.closed {
+		return
+	}
+	if n.blocking {
+		n.queue <- e
+		return
+	}
+	select {
+	case n.queue <- e:
+	default:
+		n.metrics.listenerEventsDropped.Inc()
+	}
+}
+
+// close delivers all queued events and stops the notifier.
+func (n *headNotifier) close() {
+	if n == nil {
+		return
+	}
+	n.mtx.Lock()
+	if n.closed {
+		n.mtx.Unlock()
+		return
+	}
+	n.closed = true
+	n.mtx.Unlock()
+
+	close(n.stopc)
+	<-n.donec
+}
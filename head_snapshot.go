@@ -0,0 +1,443 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/wal"
+)
+
+const chunkSnapshotPrefix = "chunk_snapshot."
+
+// Record types that only appear in head snapshots. Tombstones are
+// encoded as in the WAL.
+const (
+	recordSnapshotMeta   RecordType = 64
+	recordSnapshotSeries RecordType = 65
+)
+
+// snapshotSeries is the state of a memSeries in a head snapshot.
+type snapshotSeries struct {
+	ref       uint64
+	lset      labels.Labels
+	chunks    []*memChunk
+	nextAt    int64
+	lastValue float64
+	sampleBuf [4]sample
+	app       chunkenc.Appender // Appender of the rebuilt head chunk.
+}
+
+// chunkSnapshotDir returns the name of the snapshot taken at the given WAL segment.
+func chunkSnapshotDir(walDir string, segment int) string {
+	return filepath.Join(walDir, fmt.Sprintf("%s%06d", chunkSnapshotPrefix, segment))
+}
+
+// lastChunkSnapshot returns the directory and WAL segment of the most recent head snapshot.
+// If dir does not contain any snapshots, ErrNotFound is returned.
+func lastChunkSnapshot(dir string) (string, int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", 0, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		fi := files[i]
+
+		if !strings.HasPrefix(fi.Name(), chunkSnapshotPrefix) || !fi.IsDir() {
+			continue
+		}
+		idx, err := strconv.Atoi(fi.Name()[len(chunkSnapshotPrefix):])
+		if err != nil {
+			continue
+		}
+		return filepath.Join(dir, fi.Name()), idx, nil
+	}
+	return "", 0, ErrNotFound
+}
+
+// deleteChunkSnapshots deletes all head snapshots in a directory below a given segment.
+func deleteChunkSnapshots(dir string, maxIndex int) error {
+	var errs MultiError
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), chunkSnapshotPrefix) {
+			continue
+		}
+		// Also remove leftover temporary directories.
+		idx, err := strconv.Atoi(strings.TrimSuffix(fi.Name()[len(chunkSnapshotPrefix):], ".tmp"))
+		if err != nil || idx >= maxIndex {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+			errs.Add(err)
+		}
+	}
+	return errs.Err()
+}
+
+// writeChunkSnapshot writes all series and tombstones of the head into a snapshot. It must
+// be called after the WAL was closed and records the position up to which the WAL is covered.
+//
+// The snapshot is stored in a directory named chunk_snapshot.N in the WAL directory, where
+// N is the last WAL segment. It uses the segmented format of the WAL itself.
+func (h *Head) writeChunkSnapshot() error {
+	start := time.Now()
+
+	_, last, err := h.wal.Segments()
+	if err != nil {
+		return errors.Wrap(err, "get segment range")
+	}
+	fi, err := os.Stat(wal.SegmentName(h.wal.Dir(), last))
+	if err != nil {
+		return errors.Wrap(err, "stat last segment")
+	}
+
+	dir := chunkSnapshotDir(h.wal.Dir(), last)
+	tmp := dir + ".tmp"
+
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return errors.Wrap(err, "create snapshot dir")
+	}
+	sw, err := wal.NewWithOptions(nil, nil, tmp, wal.Options{Compression: h.wal.Compression()})
+	if err != nil {
+		return errors.Wrap(err, "open snapshot")
+	}
+
+	var (
+		buf  []byte
+		recs [][]byte
+		enc  RecordEncoder
+	)
+	meta := encbuf{}
+	meta.putByte(byte(recordSnapshotMeta))
+	meta.putBE64int64(fi.Size())
+	recs = append(recs, meta.get())
+
+	numSeries := 0
+
+	for i := 0; i < stripeSize; i++ {
+		h.series.locks[i].RLock()
+
+		for _, s := range h.series.series[i] {
+			start := len(buf)
+
+			s.Lock()
+			buf = encodeSnapshotSeries(s, buf)
+			s.Unlock()
+
+			recs = append(recs, buf[start:])
+			numSeries++
+		}
+		h.series.locks[i].RUnlock()
+
+		// Flush records in 1 MB increments.
+		if len(buf) > 1*1024*1024 {
+			if err := sw.Log(recs...); err != nil {
+				sw.Close()
+				return errors.Wrap(err, "flush records")
+			}
+			buf, recs = buf[:0], recs[:0]
+		}
+	}
+
+	var stones []Stone
+	if err := h.tombstones.Iter(func(ref uint64, ivs Intervals) error {
+		stones = append(stones, Stone{ref: ref, intervals: ivs})
+		return nil
+	}); err != nil {
+		sw.Close()
+		return errors.Wrap(err, "iterate tombstones")
+	}
+	if len(stones) > 0 {
+		recs = append(recs, enc.Tombstones(stones, nil))
+	}
+	if err := sw.Log(recs...); err != nil {
+		sw.Close()
+		return errors.Wrap(err, "flush records")
+	}
+	if err := sw.Close(); err != nil {
+		return errors.Wrap(err, "close snapshot")
+	}
+	if err := fileutil.Replace(tmp, dir); err != nil {
+		return errors.Wrap(err, "rename snapshot directory")
+	}
+	if err := deleteChunkSnapshots(h.wal.Dir(), last); err != nil {
+		level.Error(h.logger).Log("msg", "delete old head snapshots", "err", err)
+	}
+	level.Info(h.logger).Log("msg", "head snapshot written", "segment", last,
+		"series", numSeries, "duration", time.Since(start))
+
+	return nil
+}
+
+func encodeSnapshotSeries(s *memSeries, b []byte) []byte {
+	buf := encbuf{b: b}
+	buf.putByte(byte(recordSnapshotSeries))
+	buf.putBE64(s.ref)
+
+	buf.putUvarint(len(s.lset))
+	for _, l := range s.lset {
+		buf.putUvarintStr(l.Name)
+		buf.putUvarintStr(l.Value)
+	}
+	buf.putBE64int64(s.nextAt)
+	buf.putBE64(math.Float64bits(s.lastValue))
+
+	for _, smpl := range s.sampleBuf {
+		buf.putBE64int64(smpl.t)
+		buf.putBE64(math.Float64bits(smpl.v))
+	}
+
+	// Memory-mapped chunks are stored by reference as their data is on disk already.
+	buf.putUvarint(len(s.chunks))
+	for _, c := range s.chunks {
+		buf.putBE64int64(c.minTime)
+		buf.putBE64int64(c.maxTime)
+		buf.putBE64(c.ref)
+
+		if c.mmapped() {
+			continue
+		}
+		buf.putByte(byte(c.chunk.Encoding()))
+		buf.putUvarint(len(c.chunk.Bytes()))
+		buf.putBytes(c.chunk.Bytes())
+	}
+	return buf.get()
+}
+
+func decodeSnapshotSeries(rec []byte) (*snapshotSeries, error) {
+	dec := decbuf{b: rec}
+
+	if RecordType(dec.byte()) != recordSnapshotSeries {
+		return nil, errors.New("invalid record type")
+	}
+	s := &snapshotSeries{ref: dec.be64()}
+
+	s.lset = make(labels.Labels, dec.uvarint())
+	for i := range s.lset {
+		s.lset[i].Name = dec.uvarintStr()
+		s.lset[i].Value = dec.uvarintStr()
+	}
+	s.nextAt = dec.be64int64()
+	s.lastValue = math.Float64frombits(dec.be64())
+
+	for i := range s.sampleBuf {
+		s.sampleBuf[i].t = dec.be64int64()
+		s.sampleBuf[i].v = math.Float64frombits(dec.be64())
+	}
+
+	n := dec.uvarint()
+	for i := 0; i < n && dec.err() == nil; i++ {
+		c := &memChunk{
+			minTime: dec.be64int64(),
+			maxTime: dec.be64int64(),
+			ref:     dec.be64(),
+		}
+		s.chunks = append(s.chunks, c)
+
+		if c.mmapped() {
+			continue
+		}
+		enc := chunkenc.Encoding(dec.byte())
+		l := dec.uvarint()
+
+		if dec.err() != nil {
+			break
+		}
+		if dec.len() < l {
+			return nil, errors.Wrap(errInvalidSize, "chunk data")
+		}
+		chk, err := chunkenc.FromData(enc, append([]byte(nil), dec.get()[:l]...))
+		if err != nil {
+			return nil, errors.Wrap(err, "decode chunk")
+		}
+		c.chunk = chk
+		dec.b = dec.b[l:]
+	}
+	if dec.err() != nil {
+		return nil, dec.err()
+	}
+	if len(dec.b) > 0 {
+		return nil, errors.Errorf("unexpected %d bytes left in entry", len(dec.b))
+	}
+	return s, nil
+}
+
+// loadChunkSnapshot restores the head from the most recent snapshot. It returns the WAL
+// segment and the offset within it from which the WAL must be replayed.
+// ErrNotFound is returned if there is no snapshot that can be used with the current WAL.
+func (h *Head) loadChunkSnapshot() (segment int, offset int64, err error) {
+	dir, segment, err := lastChunkSnapshot(h.wal.Dir())
+	if err != nil {
+		return 0, 0, err
+	}
+	// The WAL may have been checkpointed beyond the snapshot.
+	first, _, err := h.wal.Segments()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "get segment range")
+	}
+	if first > segment {
+		return 0, 0, ErrNotFound
+	}
+
+	sr, err := wal.NewSegmentsReader(dir)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "open snapshot")
+	}
+	defer sr.Close()
+
+	var (
+		r       = wal.NewReader(sr)
+		dec     RecordDecoder
+		series  []*snapshotSeries
+		tstones []Stone
+		hasMeta bool
+	)
+	// Decode the entire snapshot before modifying the head so that a corrupted
+	// snapshot does not leave partial data behind.
+	for r.Next() {
+		rec := r.Record()
+		if len(rec) == 0 {
+			return 0, 0, errors.New("empty record")
+		}
+		switch RecordType(rec[0]) {
+		case recordSnapshotMeta:
+			d := decbuf{b: rec[1:]}
+			offset = d.be64int64()
+			if d.err() != nil {
+				return 0, 0, errors.Wrap(d.err(), "decode meta")
+			}
+			hasMeta = true
+		case recordSnapshotSeries:
+			s, err := decodeSnapshotSeries(rec)
+			if err != nil {
+				return 0, 0, errors.Wrap(err, "decode series")
+			}
+			for _, c := range s.chunks {
+				if c.mmapped() && h.chunkDiskMapper == nil {
+					return 0, 0, errors.New("snapshot references memory-mapped chunks but head chunks are disabled")
+				}
+			}
+			// Rebuild the head chunk on a detached series as it may fail to decode.
+			if n := len(s.chunks); n > 0 && !s.chunks[n-1].mmapped() {
+				ms := &memSeries{chunks: s.chunks}
+				if err := ms.restoreHeadChunk(); err != nil {
+					return 0, 0, errors.Wrapf(err, "restore head chunk of series %d", s.ref)
+				}
+				s.app = ms.app
+			}
+			series = append(series, s)
+		case RecordTombstones:
+			tstones, err = dec.Tombstones(rec, tstones)
+			if err != nil {
+				return 0, 0, errors.Wrap(err, "decode tombstones")
+			}
+		default:
+			return 0, 0, errors.Errorf("invalid record type %v", rec[0])
+		}
+	}
+	if r.Err() != nil {
+		return 0, 0, errors.Wrap(r.Err(), "read records")
+	}
+	if !hasMeta {
+		return 0, 0, errors.New("snapshot has no meta record")
+	}
+
+	minValidTime := h.MinTime()
+	if minValidTime == math.MaxInt64 {
+		minValidTime = math.MinInt64
+	}
+	mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+
+	for _, ss := range series {
+		s, _ := h.getOrCreateWithID(ss.ref, ss.lset.Hash(), ss.lset)
+
+		if h.lastSeriesID < ss.ref {
+			h.lastSeriesID = ss.ref
+		}
+		s.chunks = ss.chunks
+		s.nextAt = ss.nextAt
+		s.lastValue = ss.lastValue
+		s.sampleBuf = ss.sampleBuf
+		s.truncateChunksBefore(minValidTime)
+
+		if len(s.chunks) == 0 {
+			continue
+		}
+		s.app = ss.app
+		h.metrics.chunks.Add(float64(len(s.chunks)))
+		h.metrics.chunksCreated.Add(float64(len(s.chunks)))
+
+		if t := s.minTime(); t < mint {
+			mint = t
+		}
+		if t := s.maxTime(); t > maxt {
+			maxt = t
+		}
+	}
+	h.updateMinMaxTime(mint, maxt)
+
+	for _, s := range tstones {
+		for _, itv := range s.intervals {
+			if itv.Maxt < minValidTime {
+				continue
+			}
+			h.tombstones.addInterval(s.ref, itv)
+		}
+	}
+	level.Info(h.logger).Log("msg", "head snapshot loaded", "segment", segment, "series", len(series))
+
+	return segment, offset, nil
+}
+
+// restoreHeadChunk prepares the series' head chunk for further appends. An appender
+// cannot resume from encoded chunk bytes as the bit position within the last byte
+// is lost. The chunk is rebuilt by appending all its samples to a new one instead.
+func (s *memSeries) restoreHeadChunk() error {
+	c := s.head()
+
+	chk := chunkenc.NewXORChunk()
+	app, err := chk.Appender()
+	if err != nil {
+		return err
+	}
+	it := c.chunk.Iterator()
+	for it.Next() {
+		app.Append(it.At())
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+	c.chunk, s.app = chk, app
+	return nil
+}
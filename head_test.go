@@ -14,11 +14,14 @@
 package tsdb
 
 import (
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/prometheus/tsdb/chunkenc"
@@ -698,6 +701,88 @@ func TestMemSeries_append(t *testing.T) {
 	}
 }
 
+func TestMemSeries_appendChunkPolicy(t *testing.T) {
+	cases := map[string]struct {
+		policy ChunkPolicy
+		check  func(c *memChunk) bool
+	}{
+		"samples_per_chunk": {
+			policy: ChunkPolicy{SamplesPerChunk: 40},
+			check: func(c *memChunk) bool {
+				n := c.chunk.NumSamples()
+				return n >= 30 && n <= 50
+			},
+		},
+		"max_duration": {
+			policy: ChunkPolicy{MaxChunkDuration: 100},
+			check: func(c *memChunk) bool {
+				return c.maxTime-c.minTime < 100
+			},
+		},
+		"max_bytes": {
+			policy: ChunkPolicy{MaxChunkBytes: 64},
+			check: func(c *memChunk) bool {
+				// A chunk is cut once the limit is reached, so the last sample may
+				// exceed it slightly.
+				return len(c.chunk.Bytes()) < 64+16
+			},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := newMemSeries(labels.Labels{}, 1, 100000)
+			s.chunkPolicy = &c.policy
+
+			for i := 0; i < 2000; i++ {
+				ok, _ := s.append(int64(i), float64(i))
+				testutil.Assert(t, ok, "append failed")
+			}
+			testutil.Assert(t, len(s.chunks) > 3, "expected intermediate chunks")
+
+			for i, chk := range s.chunks[:len(s.chunks)-1] {
+				testutil.Assert(t, c.check(chk), "unexpected chunk %d with %d samples over [%d, %d]", i, chk.chunk.NumSamples(), chk.minTime, chk.maxTime)
+			}
+		})
+	}
+}
+
+func TestHead_ChunkPolicyReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "head_chunk_policy")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := &HeadOptions{ChunkPolicy: ChunkPolicy{MaxChunkDuration: 100}}
+
+	w, err := wal.New(nil, nil, dir)
+	testutil.Ok(t, err)
+	h, err := NewHeadWithOptions(nil, nil, w, 10000, opts)
+	testutil.Ok(t, err)
+
+	app := h.Appender()
+	for i := 0; i < 1000; i += 5 {
+		_, err := app.Add(labels.FromStrings("a", "b"), int64(i), float64(i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	s := h.series.getByID(1)
+	testutil.Equals(t, 10, len(s.chunks))
+	testutil.Ok(t, h.Close())
+
+	// The chunks are cut the same way when replaying the WAL.
+	w, err = wal.New(nil, nil, dir)
+	testutil.Ok(t, err)
+	h, err = NewHeadWithOptions(nil, nil, w, 10000, opts)
+	testutil.Ok(t, err)
+	defer h.Close()
+	testutil.Ok(t, h.Init())
+
+	testutil.Equals(t, 10, len(h.series.getByID(1).chunks))
+
+	_, err = NewHeadWithOptions(nil, nil, nil, 1000, &HeadOptions{ChunkPolicy: ChunkPolicy{SamplesPerChunk: -1}})
+	testutil.NotOk(t, err)
+}
+
 func TestGCChunkAccess(t *testing.T) {
 	// Put a chunk, select it. GC it and then access it.
 	h, err := NewHead(nil, nil, nil, 1000)
@@ -861,3 +946,612 @@ func TestHead_LogRollback(t *testing.T) {
 	testutil.Assert(t, ok, "expected series record but got %+v", recs[0])
 	testutil.Equals(t, []RefSeries{{Ref: 1, Labels: labels.FromStrings("a", "b")}}, series)
 }
+
+func TestHead_SeriesLimits(t *testing.T) {
+	h, err := NewHeadWithOptions(nil, nil, nil, 1000, &HeadOptions{MaxSeries: 3, MaxSeriesPerMetric: 2})
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	app := h.Appender()
+	ref, err := app.Add(labels.FromStrings("__name__", "a", "i", "1"), 100, 1)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("__name__", "a", "i", "2"), 100, 1)
+	testutil.Ok(t, err)
+
+	// The per-metric limit is reached.
+	_, err = app.Add(labels.FromStrings("__name__", "a", "i", "3"), 100, 1)
+	testutil.Equals(t, ErrSeriesLimitExceeded, err)
+
+	_, err = app.Add(labels.FromStrings("__name__", "b", "i", "1"), 100, 1)
+	testutil.Ok(t, err)
+
+	// The global limit is reached.
+	_, err = app.Add(labels.FromStrings("__name__", "c", "i", "1"), 100, 1)
+	testutil.Equals(t, ErrSeriesLimitExceeded, err)
+	testutil.Ok(t, app.Commit())
+
+	// Existing series can still be appended to.
+	app = h.Appender()
+	testutil.Ok(t, app.AddFast(ref, 200, 2))
+	_, err = app.Add(labels.FromStrings("__name__", "a", "i", "2"), 200, 2)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	testutil.Equals(t, 3, h.limits.series)
+
+	// Removed series no longer count towards the limits.
+	testutil.Ok(t, h.Truncate(2000))
+
+	app = h.Appender()
+	_, err = app.Add(labels.FromStrings("__name__", "a", "i", "3"), 2100, 1)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("__name__", "c", "i", "1"), 2100, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	_, err = NewHeadWithOptions(nil, nil, nil, 1000, &HeadOptions{MaxSeries: -1})
+	testutil.NotOk(t, err)
+}
+
+func TestHead_Isolation(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	app := h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 10, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	newQuerier := func() Querier {
+		iso := h.iso.state()
+		q, err := NewBlockQuerier(&rangeHead{head: h, mint: 0, maxt: 1000, iso: iso}, 0, 1000)
+		testutil.Ok(t, err)
+		return &querier{blocks: []Querier{q}, iso: iso}
+	}
+	all, err := labels.NewRegexpMatcher("a", ".+")
+	testutil.Ok(t, err)
+
+	app = h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 20, 2)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("a", "2"), 20, 2)
+	testutil.Ok(t, err)
+
+	// The samples of an append that was open when a querier was created are hidden
+	// from it, even if they are committed by the time the querier reads them.
+	q1 := newQuerier()
+	testutil.Ok(t, app.Commit())
+	q2 := newQuerier()
+
+	testutil.Equals(t, map[string][]sample{
+		`{a="1"}`: {{10, 1}},
+	}, query(t, q1, all))
+	testutil.Equals(t, map[string][]sample{
+		`{a="1"}`: {{10, 1}, {20, 2}},
+		`{a="2"}`: {{20, 2}},
+	}, query(t, q2, all))
+
+	testutil.Ok(t, q1.Close())
+	testutil.Ok(t, q2.Close())
+
+	// Once no reader needs them, the append IDs are dropped with the next append.
+	app = h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 30, 3)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	s := h.series.getByHash(labels.FromStrings("a", "1").Hash(), labels.FromStrings("a", "1"))
+	testutil.Equals(t, 1, len(s.txs))
+}
+
+type recordingListener struct {
+	mtx     sync.Mutex
+	events  []string
+	blockc  chan struct{} // If set, the first notification blocks until it is closed.
+	blocked bool
+}
+
+func (l *recordingListener) record(e string) {
+	if l.blockc != nil && !l.blocked {
+		l.blocked = true
+		<-l.blockc
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.events = append(l.events, e)
+}
+
+func (l *recordingListener) SeriesCreated(ref uint64, lset labels.Labels) {
+	l.record(fmt.Sprintf("created %d %s", ref, lset))
+}
+
+func (l *recordingListener) SeriesRemoved(ref uint64, lset labels.Labels) {
+	l.record(fmt.Sprintf("removed %d %s", ref, lset))
+}
+
+func (l *recordingListener) Truncated(mint int64) {
+	l.record(fmt.Sprintf("truncated %d", mint))
+}
+
+func TestHead_Listener(t *testing.T) {
+	l := &recordingListener{}
+
+	h, err := NewHeadWithOptions(nil, nil, nil, 1000, &HeadOptions{Listener: l})
+	testutil.Ok(t, err)
+
+	app := h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 100, 1)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("a", "2"), 2100, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	testutil.Ok(t, h.Truncate(2000))
+	// Closing the head delivers all queued notifications.
+	testutil.Ok(t, h.Close())
+
+	testutil.Equals(t, []string{
+		`created 1 {a="1"}`,
+		`created 2 {a="2"}`,
+		`removed 1 {a="1"}`,
+		`truncated 2000`,
+	}, l.events)
+}
+
+func TestHead_ListenerQueueFull(t *testing.T) {
+	l := &recordingListener{blockc: make(chan struct{})}
+
+	h, err := NewHeadWithOptions(nil, nil, nil, 1000, &HeadOptions{Listener: l, ListenerQueueSize: 1})
+	testutil.Ok(t, err)
+
+	// The listener blocks on the first notification. Appends must not block
+	// once the queue is full.
+	app := h.Appender()
+	for i := 0; i < 10; i++ {
+		_, err = app.Add(labels.FromStrings("a", strconv.Itoa(i)), 100, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	close(l.blockc)
+	testutil.Ok(t, h.Close())
+
+	testutil.Assert(t, len(l.events) >= 1 && len(l.events) <= 2, "unexpected notifications %v", l.events)
+	testutil.Equals(t, `created 1 {a="0"}`, l.events[0])
+}
+
+func TestHead_ListenerReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "head_listener_replay")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := wal.New(nil, nil, dir)
+	testutil.Ok(t, err)
+	h, err := NewHead(nil, nil, w, 1000)
+	testutil.Ok(t, err)
+
+	app := h.Appender()
+	for i := 0; i < 20; i++ {
+		_, err = app.Add(labels.FromStrings("a", strconv.Itoa(i)), 100, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, h.Close())
+
+	// No series restored from the WAL is dropped, even if the queue is full.
+	l := &recordingListener{}
+
+	w, err = wal.New(nil, nil, dir)
+	testutil.Ok(t, err)
+	h, err = NewHeadWithOptions(nil, nil, w, 1000, &HeadOptions{Listener: l, ListenerQueueSize: 1})
+	testutil.Ok(t, err)
+	testutil.Ok(t, h.Init())
+	testutil.Ok(t, h.Close())
+
+	testutil.Equals(t, 20, len(l.events))
+}
+
+func TestHead_ListenerAfterClose(t *testing.T) {
+	l := &recordingListener{}
+
+	h, err := NewHeadWithOptions(nil, nil, nil, 1000, &HeadOptions{Listener: l})
+	testutil.Ok(t, err)
+	testutil.Ok(t, h.Close())
+
+	// Notifications after the head was closed are dropped.
+	app := h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 100, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, h.Truncate(2000))
+	testutil.Ok(t, h.Close())
+
+	testutil.Equals(t, 0, len(l.events))
+}
+
+func TestHead_Subscribe(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	app := h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 100, 1)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("a", "2"), 100, 2)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	ch, cancel := h.Subscribe(labels.NewEqualMatcher("a", "1"), labels.NewEqualMatcher("b", ""))
+
+	// The existing series is resolved through the postings, new series are
+	// matched on creation. Samples of other series and rolled back samples
+	// are not delivered.
+	app = h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 200, 3)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("a", "2"), 200, 4)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	app = h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 300, 5)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Rollback())
+
+	app = h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1", "b", "1"), 400, 6)
+	testutil.Ok(t, err)
+	ref, err := app.Add(labels.FromStrings("a", "1", "c", "1"), 400, 7)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	testutil.Equals(t, []CommittedSample{
+		{Ref: 1, Labels: labels.FromStrings("a", "1"), T: 200, V: 3},
+	}, <-ch)
+	testutil.Equals(t, []CommittedSample{
+		{Ref: ref, Labels: labels.FromStrings("a", "1", "c", "1"), T: 400, V: 7},
+	}, <-ch)
+
+	cancel()
+	cancel()
+
+	_, ok := <-ch
+	testutil.Assert(t, !ok, "channel not closed after cancel")
+
+	app = h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 500, 8)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+}
+
+func TestHead_SubscribeDrop(t *testing.T) {
+	h, err := NewHeadWithOptions(nil, nil, nil, 1000, &HeadOptions{SubscriptionBufferSize: 1})
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	ch, cancel := h.Subscribe()
+	defer cancel()
+
+	// Commits must not block once the buffer is full.
+	for i := 0; i < 3; i++ {
+		app := h.Appender()
+		_, err = app.Add(labels.FromStrings("a", "1"), int64(i), float64(i))
+		testutil.Ok(t, err)
+		testutil.Ok(t, app.Commit())
+	}
+	testutil.Equals(t, []CommittedSample{{Ref: 1, Labels: labels.FromStrings("a", "1"), T: 0, V: 0}}, <-ch)
+
+	select {
+	case s := <-ch:
+		t.Fatalf("unexpected samples %v", s)
+	default:
+	}
+}
+
+func TestHead_SubscribeBlock(t *testing.T) {
+	h, err := NewHeadWithOptions(nil, nil, nil, 1000, &HeadOptions{
+		SubscriptionPolicy:     SubscriptionBlock,
+		SubscriptionBufferSize: 1,
+	})
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	ch, cancel := h.Subscribe()
+
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		for i := 0; i < 3; i++ {
+			app := h.Appender()
+			_, err := app.Add(labels.FromStrings("a", "1"), int64(i), float64(i))
+			testutil.Ok(t, err)
+			testutil.Ok(t, app.Commit())
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		testutil.Equals(t, []CommittedSample{{Ref: 1, Labels: labels.FromStrings("a", "1"), T: int64(i), V: float64(i)}}, <-ch)
+	}
+	<-donec
+	testutil.Equals(t, []CommittedSample{{Ref: 1, Labels: labels.FromStrings("a", "1"), T: 2, V: 2}}, <-ch)
+
+	// Cancelling unblocks pending commits.
+	app := h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 3, 3)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	go cancel()
+
+	app = h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 4, 4)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+}
+
+func TestHead_SubscribeAfterClose(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	testutil.Ok(t, h.Close())
+
+	ch, cancel := h.Subscribe()
+	defer cancel()
+
+	select {
+	case _, ok := <-ch:
+		testutil.Assert(t, !ok, "channel received samples")
+	default:
+		t.Fatalf("channel was not closed")
+	}
+}
+
+func TestHead_MmappedChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_mmapped_chunks")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := &HeadOptions{ChunkDir: filepath.Join(dir, headChunksDirname)}
+
+	w, err := wal.New(nil, nil, filepath.Join(dir, "wal"))
+	testutil.Ok(t, err)
+
+	h, err := NewHeadWithOptions(nil, nil, w, 100000, opts)
+	testutil.Ok(t, err)
+	testutil.Ok(t, h.Init())
+
+	app := h.Appender()
+	for i := 0; i < 1000; i++ {
+		for _, v := range []string{"1", "2", "3"} {
+			_, err := app.Add(labels.FromStrings("a", v), int64(i*10), float64(i))
+			testutil.Ok(t, err)
+		}
+		if i%100 == 0 {
+			testutil.Ok(t, app.Commit())
+			app = h.Appender()
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	s := h.series.getByHash(labels.FromStrings("a", "1").Hash(), labels.FromStrings("a", "1"))
+	testutil.Assert(t, len(s.chunks) > 2, "expected multiple chunks but got %d", len(s.chunks))
+
+	// All but the head chunk are released from memory.
+	for i, c := range s.chunks {
+		testutil.Equals(t, i < len(s.chunks)-1, c.mmapped())
+		testutil.Equals(t, c.mmapped(), c.chunk == nil)
+	}
+	numChunks := len(s.chunks)
+
+	q, err := NewBlockQuerier(h, 0, 10000)
+	testutil.Ok(t, err)
+	exp := query(t, q, labels.NewMustRegexpMatcher("a", ".*"))
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 3, len(exp))
+	testutil.Equals(t, 1000, len(exp[`{a="1"}`]))
+
+	testutil.Ok(t, h.Close())
+
+	// The memory-mapped chunks are loaded on restart and only newer samples
+	// are replayed from the WAL.
+	w, err = wal.New(nil, nil, filepath.Join(dir, "wal"))
+	testutil.Ok(t, err)
+
+	h, err = NewHeadWithOptions(nil, nil, w, 100000, opts)
+	testutil.Ok(t, err)
+	defer h.Close()
+	testutil.Ok(t, h.Init())
+
+	s = h.series.getByHash(labels.FromStrings("a", "1").Hash(), labels.FromStrings("a", "1"))
+	testutil.Equals(t, numChunks, len(s.chunks))
+
+	for i, c := range s.chunks {
+		testutil.Equals(t, i < len(s.chunks)-1, c.mmapped())
+	}
+
+	q, err = NewBlockQuerier(h, 0, 10000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp, query(t, q, labels.NewMustRegexpMatcher("a", ".*")))
+	testutil.Ok(t, q.Close())
+}
+
+func TestHead_ChunkSnapshot(t *testing.T) {
+	for _, chunkDir := range []string{"", headChunksDirname} {
+		t.Run(fmt.Sprintf("chunkDir=%q", chunkDir), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test_chunk_snapshot")
+			testutil.Ok(t, err)
+			defer os.RemoveAll(dir)
+
+			opts := &HeadOptions{SnapshotOnShutdown: true}
+			if chunkDir != "" {
+				opts.ChunkDir = filepath.Join(dir, chunkDir)
+			}
+			walDir := filepath.Join(dir, "wal")
+
+			openHead := func(opts *HeadOptions) *Head {
+				w, err := wal.New(nil, nil, walDir)
+				testutil.Ok(t, err)
+				h, err := NewHeadWithOptions(nil, nil, w, 100000, opts)
+				testutil.Ok(t, err)
+				testutil.Ok(t, h.Init())
+				return h
+			}
+			appendSamples := func(h *Head, from, to int) {
+				app := h.Appender()
+				for i := from; i < to; i++ {
+					for _, v := range []string{"1", "2", "3"} {
+						_, err := app.Add(labels.FromStrings("a", v), int64(i*10), float64(i))
+						testutil.Ok(t, err)
+					}
+				}
+				testutil.Ok(t, app.Commit())
+			}
+			queryAll := func(h *Head) map[string][]sample {
+				q, err := NewBlockQuerier(h, 0, 100000)
+				testutil.Ok(t, err)
+				defer q.Close()
+				return query(t, q, labels.NewMustRegexpMatcher("a", ".*"))
+			}
+
+			h := openHead(opts)
+			appendSamples(h, 0, 500)
+			testutil.Ok(t, h.Delete(100, 200, labels.NewEqualMatcher("a", "2")))
+			exp := queryAll(h)
+			testutil.Ok(t, h.Close())
+
+			_, seg, err := lastChunkSnapshot(walDir)
+			testutil.Ok(t, err)
+
+			// The snapshot is loaded and the WAL after it is replayed. The next shutdown
+			// does not write a snapshot, so it must be used again on the next start.
+			h = openHead(&HeadOptions{ChunkDir: opts.ChunkDir})
+			testutil.Equals(t, exp, queryAll(h))
+			appendSamples(h, 500, 1000)
+			exp = queryAll(h)
+			testutil.Ok(t, h.Close())
+
+			w, err := wal.New(nil, nil, walDir)
+			testutil.Ok(t, err)
+			h, err = NewHeadWithOptions(nil, nil, w, 100000, opts)
+			testutil.Ok(t, err)
+
+			segment, offset, err := h.loadChunkSnapshot()
+			testutil.Ok(t, err)
+			testutil.Equals(t, seg, segment)
+			testutil.Assert(t, offset > 0, "expected non-zero WAL offset")
+			testutil.Ok(t, h.replayWAL(segment, offset, nil))
+			h.postings.EnsureOrder()
+
+			testutil.Equals(t, exp, queryAll(h))
+			testutil.Equals(t, 1000, len(exp[`{a="1"}`]))
+			testutil.Equals(t, 1000-11, len(exp[`{a="2"}`]))
+			testutil.Ok(t, h.Close())
+
+			// A corrupted snapshot is deleted and the entire WAL is replayed.
+			snapDir, _, err := lastChunkSnapshot(walDir)
+			testutil.Ok(t, err)
+			f, err := os.OpenFile(wal.SegmentName(snapDir, 0), os.O_RDWR, 0666)
+			testutil.Ok(t, err)
+			_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 100)
+			testutil.Ok(t, err)
+			testutil.Ok(t, f.Close())
+
+			h = openHead(&HeadOptions{ChunkDir: opts.ChunkDir})
+			defer h.Close()
+			testutil.Equals(t, exp, queryAll(h))
+
+			_, _, err = lastChunkSnapshot(walDir)
+			testutil.Equals(t, ErrNotFound, err)
+		})
+	}
+}
+
+func TestHead_ChunkSnapshotUndecodableHeadChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_chunk_snapshot")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	walDir := filepath.Join(dir, "wal")
+
+	openHead := func(opts *HeadOptions) *Head {
+		w, err := wal.New(nil, nil, walDir)
+		testutil.Ok(t, err)
+		h, err := NewHeadWithOptions(nil, nil, w, 100000, opts)
+		testutil.Ok(t, err)
+		testutil.Ok(t, h.Init())
+		return h
+	}
+	queryAll := func(h *Head) map[string][]sample {
+		q, err := NewBlockQuerier(h, 0, 100000)
+		testutil.Ok(t, err)
+		defer q.Close()
+		return query(t, q, labels.NewMustRegexpMatcher("a", ".*"))
+	}
+
+	h := openHead(&HeadOptions{SnapshotOnShutdown: true})
+	app := h.Appender()
+	for i := 0; i < 500; i++ {
+		for _, v := range []string{"1", "2", "3"} {
+			_, err := app.Add(labels.FromStrings("a", v), int64(i*10), float64(i))
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+	exp := queryAll(h)
+	testutil.Ok(t, h.Close())
+
+	// Rewrite the snapshot with a head chunk that cannot be decoded in the
+	// last series, after the other series could have been restored.
+	snapDir, _, err := lastChunkSnapshot(walDir)
+	testutil.Ok(t, err)
+	sr, err := wal.NewSegmentsReader(snapDir)
+	testutil.Ok(t, err)
+
+	var (
+		r    = wal.NewReader(sr)
+		recs [][]byte
+		last = -1
+	)
+	for r.Next() {
+		recs = append(recs, append([]byte(nil), r.Record()...))
+		if RecordType(r.Record()[0]) == recordSnapshotSeries {
+			last = len(recs) - 1
+		}
+	}
+	testutil.Ok(t, r.Err())
+	testutil.Ok(t, sr.Close())
+	testutil.Assert(t, last >= 0, "expected series in snapshot")
+
+	ss, err := decodeSnapshotSeries(recs[last])
+	testutil.Ok(t, err)
+	// The chunk claims to hold samples but has no data.
+	ss.chunks[len(ss.chunks)-1].chunk, err = chunkenc.FromData(chunkenc.EncXOR, []byte{0, 100})
+	testutil.Ok(t, err)
+	recs[last] = encodeSnapshotSeries(&memSeries{
+		ref:       ss.ref,
+		lset:      ss.lset,
+		chunks:    ss.chunks,
+		nextAt:    ss.nextAt,
+		lastValue: ss.lastValue,
+		sampleBuf: ss.sampleBuf,
+	}, nil)
+
+	testutil.Ok(t, os.RemoveAll(snapDir))
+	sw, err := wal.New(nil, nil, snapDir)
+	testutil.Ok(t, err)
+	testutil.Ok(t, sw.Log(recs...))
+	testutil.Ok(t, sw.Close())
+
+	// The snapshot is not used at all and the WAL is replayed into an empty head.
+	h = openHead(nil)
+	defer h.Close()
+	testutil.Equals(t, exp, queryAll(h))
+
+	_, _, err = lastChunkSnapshot(walDir)
+	testutil.Equals(t, ErrNotFound, err)
+
+	app = h.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 5000, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+}
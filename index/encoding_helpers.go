@@ -97,6 +97,20 @@ func (d *decbuf) uvarintStr() string {
 	return s
 }
 
+func (d *decbuf) uvarintBytes() []byte {
+	l := d.uvarint64()
+	if d.e != nil {
+		return nil
+	}
+	if len(d.b) < int(l) {
+		d.e = errInvalidSize
+		return nil
+	}
+	s := d.b[:l]
+	d.b = d.b[l:]
+	return s
+}
+
 func (d *decbuf) varint64() int64 {
 	if d.e != nil {
 		return 0
@@ -38,6 +38,16 @@ const (
 
 	indexFormatV1 = 1
 	indexFormatV2 = 2
+	indexFormatV3 = 3
+
+	// postingsBlockSize is the number of references in each block of a
+	// compressed postings list. Each block is addressable through the skip table.
+	postingsBlockSize = 64
+
+	// Sampling rates of the symbol and postings offset tables held in memory
+	// by lazily loaded readers.
+	symbolSampleRate   = 32
+	postingsSampleRate = 32
 )
 
 type indexWriterSeries struct {
@@ -136,8 +146,12 @@ type indexTOC struct {
 	postingsTable     uint64
 }
 
-// NewWriter returns a new Writer to the given filename. It serializes data in format version 2.
+// NewWriter returns a new Writer to the given filename. It serializes data in format version 3.
 func NewWriter(fn string) (*Writer, error) {
+	return newWriter(fn, indexFormatV3)
+}
+
+func newWriter(fn string, version int) (*Writer, error) {
 	dir := filepath.Dir(fn)
 
 	df, err := fileutil.OpenDir(dir)
@@ -173,6 +187,8 @@ func NewWriter(fn string) (*Writer, error) {
 		symbols:       make(map[string]uint32, 1<<13),
 		seriesOffsets: make(map[uint64]uint64, 1<<16),
 		crc32:         newCRC32(),
+
+		Version: version,
 	}
 	if err := iw.writeMeta(); err != nil {
 		return nil, err
@@ -252,7 +268,7 @@ func (w *Writer) ensureStage(s indexWriterStage) error {
 func (w *Writer) writeMeta() error {
 	w.buf1.reset()
 	w.buf1.putBE32(MagicIndex)
-	w.buf1.putByte(indexFormatV2)
+	w.buf1.putByte(byte(w.Version))
 
 	return w.write(w.buf1.get())
 }
@@ -486,8 +502,12 @@ func (w *Writer) WritePostings(name, value string, it Postings) error {
 	w.buf2.reset()
 	w.buf2.putBE32int(len(refs))
 
-	for _, r := range refs {
-		w.buf2.putBE32(r)
+	if w.Version >= indexFormatV3 {
+		w.writeCompressedPostings(refs)
+	} else {
+		for _, r := range refs {
+			w.buf2.putBE32(r)
+		}
 	}
 	w.uint32s = refs
 
@@ -500,6 +520,30 @@ func (w *Writer) WritePostings(name, value string, it Postings) error {
 	return errors.Wrap(err, "write postings")
 }
 
+// writeCompressedPostings appends the sorted references to buf2 as blocks
+// of uvarint deltas preceded by a skip table holding the first reference and
+// the data offset of each block.
+func (w *Writer) writeCompressedPostings(refs []uint32) {
+	w.buf1.reset()
+
+	numBlocks := (len(refs) + postingsBlockSize - 1) / postingsBlockSize
+	w.buf2.putBE32int(numBlocks)
+
+	for i := 0; i < len(refs); i += postingsBlockSize {
+		w.buf2.putBE32(refs[i])
+		w.buf2.putBE32int(w.buf1.len())
+
+		end := i + postingsBlockSize
+		if end > len(refs) {
+			end = len(refs)
+		}
+		for j := i + 1; j < end; j++ {
+			w.buf1.putUvarint32(refs[j] - refs[j-1])
+		}
+	}
+	w.buf2.putBytes(w.buf1.get())
+}
+
 type uint32slice []uint32
 
 func (s uint32slice) Len() int           { return len(s) }
@@ -555,6 +599,24 @@ type Reader struct {
 	crc32 hash.Hash32
 
 	version int
+
+	// Lazily loaded readers keep the symbols and the postings offset table on
+	// disk and only hold every n-th entry of them in memory.
+	lazy            bool
+	symbolsStart    int
+	symbolsEnd      int
+	numSymbols      int
+	symbolSamples   []int
+	postingsEnd     int
+	postingsSamples []postingsSample
+
+	symbolTableSize uint64
+}
+
+// postingsSample is an entry of the sampled postings offset table.
+type postingsSample struct {
+	l   labels.Label
+	off int // Position of the entry in the postings offset table.
 }
 
 var (
@@ -586,26 +648,46 @@ func (b realByteSlice) Sub(start, end int) ByteSlice {
 // NewReader returns a new IndexReader on the given byte slice. It automatically
 // handles different format versions.
 func NewReader(b ByteSlice) (*Reader, error) {
-	return newReader(b, nil)
+	return newReader(b, nil, false)
 }
 
 // NewFileReader returns a new index reader against the given index file.
 func NewFileReader(path string) (*Reader, error) {
+	return newFileReader(path, false)
+}
+
+// NewLazyFileReader returns a new index reader against the given index file.
+// Unlike NewFileReader, it does not load all symbols and postings offsets into
+// memory but reads them from the mmapped file on demand, which trades lookup
+// speed for a much smaller heap footprint.
+func NewLazyFileReader(path string) (*Reader, error) {
+	return newFileReader(path, true)
+}
+
+func newFileReader(path string, lazy bool) (*Reader, error) {
 	f, err := fileutil.OpenMmapFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return newReader(realByteSlice(f.Bytes()), f)
+	r, err := newReader(realByteSlice(f.Bytes()), f, lazy)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
 }
 
-func newReader(b ByteSlice, c io.Closer) (*Reader, error) {
+func newReader(b ByteSlice, c io.Closer, lazy bool) (*Reader, error) {
 	r := &Reader{
-		b:        b,
-		c:        c,
-		symbols:  map[uint32]string{},
-		labels:   map[string]uint64{},
-		postings: map[labels.Label]uint64{},
-		crc32:    newCRC32(),
+		b:      b,
+		c:      c,
+		labels: map[string]uint64{},
+		crc32:  newCRC32(),
+		lazy:   lazy,
+	}
+	if !lazy {
+		r.symbols = map[uint32]string{}
+		r.postings = map[labels.Label]uint64{}
 	}
 
 	// Verify header.
@@ -617,17 +699,22 @@ func newReader(b ByteSlice, c io.Closer) (*Reader, error) {
 	}
 	r.version = int(r.b.Range(4, 5)[0])
 
-	if r.version != 1 && r.version != 2 {
+	if r.version != indexFormatV1 && r.version != indexFormatV2 && r.version != indexFormatV3 {
 		return nil, errors.Errorf("unknown index file version %d", r.version)
 	}
 
 	if err := r.readTOC(); err != nil {
 		return nil, errors.Wrap(err, "read TOC")
 	}
-	if err := r.readSymbols(int(r.toc.symbols)); err != nil {
+	var err error
+	if lazy {
+		err = r.readSymbolsSampled(int(r.toc.symbols))
+	} else {
+		err = r.readSymbols(int(r.toc.symbols))
+	}
+	if err != nil {
 		return nil, errors.Wrap(err, "read symbols")
 	}
-	var err error
 
 	err = r.readOffsetTable(r.toc.labelIndicesTable, func(key []string, off uint64) error {
 		if len(key) != 1 {
@@ -639,18 +726,16 @@ func newReader(b ByteSlice, c io.Closer) (*Reader, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "read label index table")
 	}
-	err = r.readOffsetTable(r.toc.postingsTable, func(key []string, off uint64) error {
-		if len(key) != 2 {
-			return errors.Errorf("unexpected key length %d", len(key))
-		}
-		r.postings[labels.Label{Name: key[0], Value: key[1]}] = off
-		return nil
-	})
+	if lazy {
+		err = r.readPostingsTableSampled(r.toc.postingsTable)
+	} else {
+		err = r.readPostingsTable(r.toc.postingsTable)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "read postings table")
 	}
 
-	r.dec = &Decoder{symbols: r.symbols}
+	r.dec = &Decoder{lookup: r.lookupSymbol, version: r.version}
 
 	return r, nil
 }
@@ -670,7 +755,22 @@ type Range struct {
 func (r *Reader) PostingsRanges() (map[labels.Label]Range, error) {
 	m := map[labels.Label]Range{}
 
-	for l, start := range r.postings {
+	postings := r.postings
+	if postings == nil {
+		postings = map[labels.Label]uint64{}
+
+		err := r.readOffsetTable(r.toc.postingsTable, func(key []string, off uint64) error {
+			if len(key) != 2 {
+				return errors.Errorf("unexpected key length %d", len(key))
+			}
+			postings[labels.Label{Name: key[0], Value: key[1]}] = off
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "read postings table")
+		}
+	}
+	for l, start := range postings {
 		d := r.decbufAt(int(start))
 		if d.err() != nil {
 			return nil, d.err()
@@ -776,15 +876,16 @@ func (r *Reader) readSymbols(off int) error {
 		nextPos = basePos + uint32(origLen-d.len())
 	)
 
-	if r.version == 2 {
+	if r.version >= indexFormatV2 {
 		nextPos = 0
 	}
+	r.symbolTableSize = uint64(origLen - 4)
 
 	for d.err() == nil && d.len() > 0 && cnt > 0 {
 		s := d.uvarintStr()
 		r.symbols[nextPos] = s
 
-		if r.version == 2 {
+		if r.version >= indexFormatV2 {
 			nextPos++
 		} else {
 			nextPos = basePos + uint32(origLen-d.len())
@@ -794,6 +895,122 @@ func (r *Reader) readSymbols(off int) error {
 	return errors.Wrap(d.err(), "read symbols")
 }
 
+// readSymbolsSampled verifies the symbol table and records the position of every
+// symbolSampleRate-th symbol. Symbols are then decoded from the byte slice on lookup.
+func (r *Reader) readSymbolsSampled(off int) error {
+	if off == 0 {
+		return nil
+	}
+	d := r.decbufAt(off)
+
+	var (
+		origLen = d.len()
+		cnt     = d.be32int()
+		basePos = off + 4
+	)
+	r.symbolsStart = basePos + origLen - d.len()
+	r.symbolsEnd = basePos + origLen
+	r.symbolTableSize = uint64(origLen - 4)
+
+	for d.err() == nil && d.len() > 0 && cnt > 0 {
+		if r.numSymbols%symbolSampleRate == 0 {
+			r.symbolSamples = append(r.symbolSamples, basePos+origLen-d.len())
+		}
+		d.uvarintBytes()
+		r.numSymbols++
+		cnt--
+	}
+	return errors.Wrap(d.err(), "read symbols")
+}
+
+func (r *Reader) readPostingsTable(off uint64) error {
+	return r.readOffsetTable(off, func(key []string, off uint64) error {
+		if len(key) != 2 {
+			return errors.Errorf("unexpected key length %d", len(key))
+		}
+		r.postings[labels.Label{Name: key[0], Value: key[1]}] = off
+		return nil
+	})
+}
+
+// readPostingsTableSampled records the position of every postingsSampleRate-th entry
+// of the postings offset table. Lookups binary search the samples and scan the
+// following entries on disk, which requires the table to be sorted. Tables that are
+// not sorted are loaded into memory fully instead.
+func (r *Reader) readPostingsTableSampled(off uint64) error {
+	d := r.decbufAt(int(off))
+
+	var (
+		origLen = d.len()
+		cnt     = d.be32()
+		basePos = int(off) + 4
+		samples []postingsSample
+		last    labels.Label
+	)
+	r.postingsEnd = basePos + origLen
+
+	for i := 0; d.err() == nil && d.len() > 0 && cnt > 0; i++ {
+		pos := basePos + origLen - d.len()
+
+		if keyCount := d.uvarint(); keyCount != 2 {
+			return errors.Errorf("unexpected key length %d", keyCount)
+		}
+		l := labels.Label{Name: d.uvarintStr(), Value: d.uvarintStr()}
+		d.uvarint64()
+
+		if d.err() != nil {
+			break
+		}
+		if i > 0 && compareLabels(last, l) >= 0 {
+			r.postings = map[labels.Label]uint64{}
+			return r.readPostingsTable(off)
+		}
+		if i%postingsSampleRate == 0 {
+			samples = append(samples, postingsSample{l: l, off: pos})
+		}
+		last = l
+		cnt--
+	}
+	r.postingsSamples = samples
+
+	return d.err()
+}
+
+// postingsOffset returns the offset of the postings list for the given label pair.
+func (r *Reader) postingsOffset(name, value string) (uint64, bool, error) {
+	if r.postings != nil {
+		off, ok := r.postings[labels.Label{Name: name, Value: value}]
+		return off, ok, nil
+	}
+	l := labels.Label{Name: name, Value: value}
+
+	i := sort.Search(len(r.postingsSamples), func(i int) bool {
+		return compareLabels(r.postingsSamples[i].l, l) > 0
+	})
+	if i == 0 {
+		return 0, false, nil
+	}
+	d := decbuf{b: r.b.Range(r.postingsSamples[i-1].off, r.postingsEnd)}
+
+	for j := 0; j < postingsSampleRate && d.err() == nil && d.len() > 0; j++ {
+		d.uvarint()
+		n, v := d.uvarintBytes(), d.uvarintBytes()
+		off := d.uvarint64()
+
+		if string(n) == name && string(v) == value {
+			return off, d.err() == nil, d.err()
+		}
+	}
+	return 0, false, d.err()
+}
+
+func compareLabels(a, b labels.Label) int {
+	if c := strings.Compare(a.Name, b.Name); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Value, b.Value)
+}
+
 // readOffsetTable reads an offset table at the given position calls f for each
 // found entry.f
 // If f returns an error it stops decoding and returns the received error,
@@ -822,10 +1039,16 @@ func (r *Reader) readOffsetTable(off uint64, f func([]string, uint64) error) err
 
 // Close the reader and its underlying resources.
 func (r *Reader) Close() error {
+	if r.c == nil {
+		return nil
+	}
 	return r.c.Close()
 }
 
 func (r *Reader) lookupSymbol(o uint32) (string, error) {
+	if r.lazy {
+		return r.readSymbol(o)
+	}
 	s, ok := r.symbols[o]
 	if !ok {
 		return "", errors.Errorf("unknown symbol offset %d", o)
@@ -833,8 +1056,40 @@ func (r *Reader) lookupSymbol(o uint32) (string, error) {
 	return s, nil
 }
 
+// readSymbol decodes the symbol with the given reference from the byte slice.
+func (r *Reader) readSymbol(o uint32) (string, error) {
+	var d decbuf
+
+	if r.version == indexFormatV1 {
+		// In version 1 symbol references are the offsets of the symbols in the file.
+		if int(o) < r.symbolsStart || int(o) >= r.symbolsEnd {
+			return "", errors.Errorf("unknown symbol offset %d", o)
+		}
+		d = decbuf{b: r.b.Range(int(o), r.symbolsEnd)}
+	} else {
+		if int(o) >= r.numSymbols {
+			return "", errors.Errorf("unknown symbol offset %d", o)
+		}
+		d = decbuf{b: r.b.Range(r.symbolSamples[o/symbolSampleRate], r.symbolsEnd)}
+
+		for i := o % symbolSampleRate; i > 0; i-- {
+			d.uvarintBytes()
+		}
+	}
+	s := d.uvarintStr()
+	return s, errors.Wrap(d.err(), "read symbol")
+}
+
 // Symbols returns a set of symbols that exist within the index.
 func (r *Reader) Symbols() (map[string]struct{}, error) {
+	if r.lazy {
+		res := make(map[string]struct{}, r.numSymbols)
+
+		err := r.forEachSymbol(func(_ uint32, s string) {
+			res[s] = struct{}{}
+		})
+		return res, err
+	}
 	res := make(map[string]struct{}, len(r.symbols))
 
 	for _, s := range r.symbols {
@@ -843,9 +1098,44 @@ func (r *Reader) Symbols() (map[string]struct{}, error) {
 	return res, nil
 }
 
+// forEachSymbol decodes all symbols from the byte slice and calls f with
+// each of them and its reference.
+func (r *Reader) forEachSymbol(f func(ref uint32, s string)) error {
+	if r.numSymbols == 0 {
+		return nil
+	}
+	d := decbuf{b: r.b.Range(r.symbolsStart, r.symbolsEnd)}
+
+	for i := 0; i < r.numSymbols && d.err() == nil; i++ {
+		ref := uint32(i)
+		if r.version == indexFormatV1 {
+			ref = uint32(r.symbolsEnd - d.len())
+		}
+		s := d.uvarintStr()
+		if d.err() == nil {
+			f(ref, s)
+		}
+	}
+	return errors.Wrap(d.err(), "read symbols")
+}
+
 // SymbolTable returns the symbol table that is used to resolve symbol references.
+// Lazily loaded readers decode the full table on each call.
 func (r *Reader) SymbolTable() map[uint32]string {
-	return r.symbols
+	if !r.lazy {
+		return r.symbols
+	}
+	res := make(map[uint32]string, r.numSymbols)
+
+	r.forEachSymbol(func(ref uint32, s string) {
+		res[ref] = s
+	})
+	return res
+}
+
+// SymbolTableSize returns the size of all encoded symbols in bytes.
+func (r *Reader) SymbolTableSize() uint64 {
+	return r.symbolTableSize
 }
 
 // LabelValues returns value tuples that exist for the given label name tuples.
@@ -897,9 +1187,9 @@ func (r *Reader) LabelIndices() ([][]string, error) {
 // Series reads the series with the given ID and writes its labels and chunks into lbls and chks.
 func (r *Reader) Series(id uint64, lbls *labels.Labels, chks *[]chunks.Meta) error {
 	offset := id
-	// In version 2 series IDs are no longer exact references but series are 16-byte padded
+	// Since version 2 series IDs are no longer exact references but series are 16-byte padded
 	// and the ID is the multiple of 16 of the actual position.
-	if r.version == 2 {
+	if r.version >= indexFormatV2 {
 		offset = id * 16
 	}
 	d := r.decbufUvarintAt(int(offset))
@@ -911,10 +1201,10 @@ func (r *Reader) Series(id uint64, lbls *labels.Labels, chks *[]chunks.Meta) err
 
 // Postings returns a postings list for the given label pair.
 func (r *Reader) Postings(name, value string) (Postings, error) {
-	off, ok := r.postings[labels.Label{
-		Name:  name,
-		Value: value,
-	}]
+	off, ok, err := r.postingsOffset(name, value)
+	if err != nil {
+		return nil, errors.Wrap(err, "read postings offset")
+	}
 	if !ok {
 		return EmptyPostings(), nil
 	}
@@ -1003,15 +1293,22 @@ func (t *serializedStringTuples) At(i int) ([]string, error) {
 	return res, nil
 }
 
-// Decoder provides decoding methods for the v1 and v2 index file format.
+// Decoder provides decoding methods for the v1, v2 and v3 index file format.
 //
 // It currently does not contain decoding methods for all entry types but can be extended
 // by them if there's demand.
 type Decoder struct {
 	symbols map[uint32]string
+	version int
+
+	// Looks up symbols instead of the symbol table if set.
+	lookup func(uint32) (string, error)
 }
 
 func (dec *Decoder) lookupSymbol(o uint32) (string, error) {
+	if dec.lookup != nil {
+		return dec.lookup(o)
+	}
 	s, ok := dec.symbols[o]
 	if !ok {
 		return "", errors.Errorf("unknown symbol offset %d", o)
@@ -1023,12 +1320,25 @@ func (dec *Decoder) lookupSymbol(o uint32) (string, error) {
 // and label indices
 func (dec *Decoder) SetSymbolTable(t map[uint32]string) {
 	dec.symbols = t
+	dec.lookup = nil
 }
 
 // Postings returns a postings list for b and its number of elements.
 func (dec *Decoder) Postings(b []byte) (int, Postings, error) {
 	d := decbuf{b: b}
 	n := d.be32int()
+
+	if dec.version >= indexFormatV3 {
+		numBlocks := d.be32int()
+		if d.err() != nil {
+			return 0, nil, d.err()
+		}
+		if d.len() < numBlocks*8 {
+			return 0, nil, errors.Wrap(errInvalidSize, "postings skip table")
+		}
+		b := d.get()
+		return n, newDeltaPostings(b[:numBlocks*8], b[numBlocks*8:], n), nil
+	}
 	l := d.get()
 	return n, newBigEndianPostings(l), d.err()
 }
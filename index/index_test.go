@@ -14,6 +14,7 @@
 package index
 
 import (
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -234,6 +235,172 @@ func TestIndexRW_Postings(t *testing.T) {
 	testutil.Ok(t, ir.Close())
 }
 
+// Indexes written in older format versions must remain readable.
+func TestIndexRW_ReadVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_versions")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		refs    []uint64
+		series  []labels.Labels
+		symbols = map[string]struct{}{"a": {}, "1": {}, "i": {}}
+	)
+	for i := 1; i <= 200; i++ {
+		v := fmt.Sprintf("%04d", i)
+		refs = append(refs, uint64(i))
+		series = append(series, labels.FromStrings("a", "1", "i", v))
+		symbols[v] = struct{}{}
+	}
+
+	for _, version := range []int{indexFormatV2, indexFormatV3} {
+		fn := filepath.Join(dir, fmt.Sprintf("index-%d", version))
+
+		iw, err := newWriter(fn, version)
+		testutil.Ok(t, err)
+
+		testutil.Ok(t, iw.AddSymbols(symbols))
+		for i, ref := range refs {
+			testutil.Ok(t, iw.AddSeries(ref, series[i]))
+		}
+		testutil.Ok(t, iw.WritePostings("a", "1", newListPostings(refs)))
+		testutil.Ok(t, iw.Close())
+
+		ir, err := NewFileReader(fn)
+		testutil.Ok(t, err)
+		testutil.Equals(t, version, ir.Version())
+
+		p, err := ir.Postings("a", "1")
+		testutil.Ok(t, err)
+		res, err := ExpandPostings(p)
+		testutil.Ok(t, err)
+		testutil.Equals(t, len(refs), len(res))
+
+		var l labels.Labels
+		var c []chunks.Meta
+		for i, ref := range res {
+			testutil.Ok(t, ir.Series(ref, &l, &c))
+			testutil.Equals(t, series[i], l)
+		}
+		testutil.Ok(t, ir.Close())
+	}
+}
+
+func TestReader_Lazy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_lazy")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		series  []labels.Labels
+		symbols = map[string]struct{}{"a": {}, "b": {}}
+	)
+	for i := 0; i < 100; i++ {
+		a, b := fmt.Sprintf("%03d", i), fmt.Sprintf("b%02d", i%40)
+		series = append(series, labels.FromStrings("a", a, "b", b))
+		symbols[a] = struct{}{}
+		symbols[b] = struct{}{}
+	}
+	mp := NewMemPostings()
+	for i, s := range series {
+		mp.Add(uint64(i+1), s)
+	}
+
+	for _, c := range []struct {
+		version int
+		sorted  bool
+	}{
+		{version: indexFormatV2, sorted: true},
+		{version: indexFormatV3, sorted: true},
+		{version: indexFormatV3, sorted: false},
+	} {
+		fn := filepath.Join(dir, fmt.Sprintf("index-%d-%t", c.version, c.sorted))
+
+		iw, err := newWriter(fn, c.version)
+		testutil.Ok(t, err)
+		testutil.Ok(t, iw.AddSymbols(symbols))
+
+		for i, s := range series {
+			testutil.Ok(t, iw.AddSeries(uint64(i+1), s))
+		}
+		keys := mp.SortedKeys()
+		if !c.sorted {
+			keys[1], keys[len(keys)-1] = keys[len(keys)-1], keys[1]
+		}
+		for _, l := range keys {
+			testutil.Ok(t, iw.WritePostings(l.Name, l.Value, mp.Get(l.Name, l.Value)))
+		}
+		testutil.Ok(t, iw.Close())
+
+		eager, err := NewFileReader(fn)
+		testutil.Ok(t, err)
+		lazy, err := NewLazyFileReader(fn)
+		testutil.Ok(t, err)
+		// Unsorted postings tables cannot be sampled and are loaded fully.
+		testutil.Equals(t, !c.sorted, lazy.postings != nil)
+
+		testutil.Equals(t, eager.SymbolTable(), lazy.SymbolTable())
+		testutil.Equals(t, eager.SymbolTableSize(), lazy.SymbolTableSize())
+
+		expSyms, err := eager.Symbols()
+		testutil.Ok(t, err)
+		gotSyms, err := lazy.Symbols()
+		testutil.Ok(t, err)
+		testutil.Equals(t, expSyms, gotSyms)
+
+		expRanges, err := eager.PostingsRanges()
+		testutil.Ok(t, err)
+		gotRanges, err := lazy.PostingsRanges()
+		testutil.Ok(t, err)
+		testutil.Equals(t, expRanges, gotRanges)
+
+		for _, l := range append(keys, labels.Label{Name: "a", Value: "x"}) {
+			p, err := eager.Postings(l.Name, l.Value)
+			testutil.Ok(t, err)
+			exp, err := ExpandPostings(p)
+			testutil.Ok(t, err)
+
+			p, err = lazy.Postings(l.Name, l.Value)
+			testutil.Ok(t, err)
+			got, err := ExpandPostings(p)
+			testutil.Ok(t, err)
+			testutil.Equals(t, exp, got)
+
+			var (
+				expLset, gotLset labels.Labels
+				expChks, gotChks []chunks.Meta
+			)
+			for _, ref := range got {
+				testutil.Ok(t, eager.Series(ref, &expLset, &expChks))
+				testutil.Ok(t, lazy.Series(ref, &gotLset, &gotChks))
+				testutil.Equals(t, expLset, gotLset)
+			}
+		}
+		testutil.Ok(t, eager.Close())
+		testutil.Ok(t, lazy.Close())
+	}
+}
+
+func TestDecoder_Series(t *testing.T) {
+	var e encbuf
+	e.putUvarint(1)
+	e.putUvarint32(1)
+	e.putUvarint32(2)
+	e.putUvarint(0)
+
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	// A decoder without a symbol table fails without panicking.
+	var dec Decoder
+	testutil.NotOk(t, dec.Series(e.get(), &lset, &chks))
+
+	dec.SetSymbolTable(map[uint32]string{1: "a", 2: "b"})
+	testutil.Ok(t, dec.Series(e.get(), &lset, &chks))
+	testutil.Equals(t, labels.FromStrings("a", "b"), lset)
+}
+
 func TestPersistence_index_e2e(t *testing.T) {
 	dir, err := ioutil.TempDir("", "test_persistence_e2e")
 	testutil.Ok(t, err)
@@ -15,11 +15,13 @@ package index
 
 import (
 	"encoding/binary"
+	"math"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/tsdb/labels"
 )
 
@@ -590,3 +592,107 @@ func (it *bigEndianPostings) Seek(x uint64) bool {
 func (it *bigEndianPostings) Err() error {
 	return nil
 }
+
+// deltaPostings implements the Postings interface over a compressed postings
+// list of the v3 index format. References are stored in blocks of uvarint deltas
+// and a skip table of each block's first reference allows seeking across blocks.
+type deltaPostings struct {
+	skip []byte // first reference and data offset of each block, 8 bytes each
+	data []byte
+	n    int // total number of references
+
+	block int // current block, -1 before the first call to Next
+	left  int // remaining references in the current block
+	pos   int // read position in data
+	cur   uint32
+	err   error
+}
+
+func newDeltaPostings(skip, data []byte, n int) *deltaPostings {
+	return &deltaPostings{skip: skip, data: data, n: n, block: -1}
+}
+
+func (it *deltaPostings) numBlocks() int {
+	return len(it.skip) / 8
+}
+
+func (it *deltaPostings) At() uint64 {
+	return uint64(it.cur)
+}
+
+func (it *deltaPostings) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.left == 0 {
+		return it.seekBlock(it.block + 1)
+	}
+	d, n := binary.Uvarint(it.data[it.pos:])
+	if n <= 0 {
+		it.err = errors.Errorf("invalid postings delta at offset %d", it.pos)
+		return false
+	}
+	it.pos += n
+	it.cur += uint32(d)
+	it.left--
+	return true
+}
+
+// seekBlock positions the iterator at the first reference of the i-th block.
+func (it *deltaPostings) seekBlock(i int) bool {
+	if i >= it.numBlocks() {
+		it.block = it.numBlocks()
+		it.left = 0
+		return false
+	}
+	it.block = i
+	it.cur = binary.BigEndian.Uint32(it.skip[i*8:])
+	it.pos = int(binary.BigEndian.Uint32(it.skip[i*8+4:]))
+
+	if it.pos > len(it.data) {
+		it.err = errors.Errorf("invalid postings block offset %d", it.pos)
+		return false
+	}
+	it.left = postingsBlockSize - 1
+	if rem := it.n - i*postingsBlockSize - 1; rem < it.left {
+		it.left = rem
+	}
+	return true
+}
+
+func (it *deltaPostings) Seek(x uint64) bool {
+	if it.err != nil || it.block >= it.numBlocks() {
+		return false
+	}
+	if it.block >= 0 && uint64(it.cur) >= x {
+		return true
+	}
+	if x > math.MaxUint32 {
+		it.seekBlock(it.numBlocks())
+		return false
+	}
+	// Jump to the last of the following blocks that starts at or before x.
+	start := it.block + 1
+	i := sort.Search(it.numBlocks()-start, func(i int) bool {
+		return binary.BigEndian.Uint32(it.skip[(start+i)*8:]) > uint32(x)
+	})
+	if i > 0 {
+		if !it.seekBlock(start + i - 1) {
+			return false
+		}
+	} else if it.block < 0 {
+		if !it.Next() {
+			return false
+		}
+	}
+	for uint64(it.cur) < x {
+		if !it.Next() {
+			return false
+		}
+	}
+	return true
+}
+
+func (it *deltaPostings) Err() error {
+	return it.err
+}
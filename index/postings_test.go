@@ -538,6 +538,74 @@ func TestBigEndian(t *testing.T) {
 	})
 }
 
+func TestDeltaPostings(t *testing.T) {
+	num := 1000
+	ls := make([]uint32, num)
+	ls[0] = 2
+	for i := 1; i < num; i++ {
+		ls[i] = ls[i-1] + uint32(rand.Int31n(25)) + 2
+	}
+
+	w := &Writer{}
+	w.buf2.putBE32int(num)
+	w.writeCompressedPostings(ls)
+
+	dec := &Decoder{version: indexFormatV3}
+
+	t.Run("Iteration", func(t *testing.T) {
+		n, p, err := dec.Postings(w.buf2.get())
+		testutil.Ok(t, err)
+		testutil.Equals(t, num, n)
+
+		for i := 0; i < num; i++ {
+			testutil.Assert(t, p.Next() == true, "")
+			testutil.Equals(t, uint64(ls[i]), p.At())
+		}
+		testutil.Assert(t, p.Next() == false, "")
+		testutil.Assert(t, p.Err() == nil, "")
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		table := []struct {
+			seek  uint32
+			val   uint32
+			found bool
+		}{
+			{ls[0] - 1, ls[0], true},
+			{ls[4], ls[4], true},
+			{ls[63], ls[63], true},
+			{ls[64] - 1, ls[64], true},
+			{ls[500] - 1, ls[500], true},
+			{ls[600] + 1, ls[601], true},
+			{ls[600] + 1, ls[601], true},
+			{ls[0], ls[601], true},
+			{ls[600], ls[601], true},
+			{ls[999], ls[999], true},
+			{ls[999] + 10, ls[999], false},
+		}
+
+		_, p, err := dec.Postings(w.buf2.get())
+		testutil.Ok(t, err)
+
+		for _, v := range table {
+			testutil.Equals(t, v.found, p.Seek(uint64(v.seek)))
+			testutil.Equals(t, uint64(v.val), p.At())
+			testutil.Assert(t, p.Err() == nil, "")
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		w := &Writer{}
+		w.buf2.putBE32int(0)
+		w.writeCompressedPostings(nil)
+
+		_, p, err := dec.Postings(w.buf2.get())
+		testutil.Ok(t, err)
+		testutil.Assert(t, p.Next() == false, "")
+		testutil.Assert(t, p.Seek(1) == false, "")
+	})
+}
+
 func TestIntersectWithMerge(t *testing.T) {
 	// One of the reproduceable cases for:
 	// https://github.com/prometheus/prometheus/issues/2616
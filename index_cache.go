@@ -0,0 +1,248 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+const (
+	cacheTypePostings = "postings"
+	cacheTypeSeries   = "series"
+)
+
+type postingsCacheKey struct {
+	block    ulid.ULID
+	matchers string
+}
+
+type seriesCacheKey struct {
+	block ulid.ULID
+	ref   uint64
+}
+
+type cachedSeries struct {
+	lset labels.Labels
+	chks []chunks.Meta
+}
+
+type indexCacheEntry struct {
+	key   interface{}
+	block ulid.ULID
+	size  uint64
+	val   interface{}
+}
+
+// indexCache is a size-bounded LRU cache for decoded postings lists and series
+// of persisted blocks. It is safe for concurrent use and is shared by all blocks
+// of a DB.
+type indexCache struct {
+	mtx     sync.Mutex
+	lru     *list.List
+	items   map[interface{}]*list.Element
+	size    uint64
+	maxSize uint64
+
+	requests  *prometheus.CounterVec
+	hits      *prometheus.CounterVec
+	evicted   *prometheus.CounterVec
+	itemCount prometheus.GaugeFunc
+	sizeBytes prometheus.GaugeFunc
+}
+
+func newIndexCache(r prometheus.Registerer, maxSize uint64) *indexCache {
+	c := &indexCache{
+		lru:     list.New(),
+		items:   map[interface{}]*list.Element{},
+		maxSize: maxSize,
+	}
+	c.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_index_cache_requests_total",
+		Help: "Total number of requests to the index cache.",
+	}, []string{"item_type"})
+	c.hits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_index_cache_hits_total",
+		Help: "Total number of requests to the index cache that were a hit.",
+	}, []string{"item_type"})
+	c.evicted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_index_cache_items_evicted_total",
+		Help: "Total number of items that were evicted from the index cache.",
+	}, []string{"item_type"})
+	c.itemCount = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_index_cache_items",
+		Help: "Current number of items in the index cache.",
+	}, func() float64 {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		return float64(len(c.items))
+	})
+	c.sizeBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_index_cache_size_bytes",
+		Help: "Current approximate size of all items in the index cache.",
+	}, func() float64 {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		return float64(c.size)
+	})
+
+	if r != nil {
+		r.MustRegister(c.requests, c.hits, c.evicted, c.itemCount, c.sizeBytes)
+	}
+	return c
+}
+
+func cacheType(key interface{}) string {
+	if _, ok := key.(postingsCacheKey); ok {
+		return cacheTypePostings
+	}
+	return cacheTypeSeries
+}
+
+func (c *indexCache) get(key interface{}) (interface{}, bool) {
+	typ := cacheType(key)
+	c.requests.WithLabelValues(typ).Inc()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.hits.WithLabelValues(typ).Inc()
+	c.lru.MoveToFront(e)
+
+	return e.Value.(*indexCacheEntry).val, true
+}
+
+func (c *indexCache) set(block ulid.ULID, key, val interface{}, size uint64) {
+	// Items larger than the entire cache would just flush everything else.
+	if size > c.maxSize {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, ok := c.items[key]; ok {
+		return
+	}
+	for c.size+size > c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+	c.items[key] = c.lru.PushFront(&indexCacheEntry{
+		key:   key,
+		block: block,
+		size:  size,
+		val:   val,
+	})
+	c.size += size
+}
+
+// removeElement removes the element and counts it as an eviction.
+// The cache lock must be held.
+func (c *indexCache) removeElement(e *list.Element) {
+	entry := c.lru.Remove(e).(*indexCacheEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+	c.evicted.WithLabelValues(cacheType(entry.key)).Inc()
+}
+
+// dropBlock removes all cached items of the given block.
+func (c *indexCache) dropBlock(id ulid.ULID) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*indexCacheEntry)
+
+		if entry.block == id {
+			c.lru.Remove(e)
+			delete(c.items, entry.key)
+			c.size -= entry.size
+		}
+		e = next
+	}
+}
+
+func (c *indexCache) postings(block ulid.ULID, key string) ([]uint64, bool) {
+	v, ok := c.get(postingsCacheKey{block: block, matchers: key})
+	if !ok {
+		return nil, false
+	}
+	return v.([]uint64), true
+}
+
+func (c *indexCache) setPostings(block ulid.ULID, key string, refs []uint64) {
+	size := uint64(len(key) + 8*len(refs))
+	c.set(block, postingsCacheKey{block: block, matchers: key}, refs, size)
+}
+
+func (c *indexCache) series(block ulid.ULID, ref uint64) (*cachedSeries, bool) {
+	v, ok := c.get(seriesCacheKey{block: block, ref: ref})
+	if !ok {
+		return nil, false
+	}
+	return v.(*cachedSeries), true
+}
+
+func (c *indexCache) setSeries(block ulid.ULID, ref uint64, lset labels.Labels, chks []chunks.Meta) {
+	s := &cachedSeries{
+		lset: make(labels.Labels, len(lset)),
+		chks: make([]chunks.Meta, len(chks)),
+	}
+	copy(s.lset, lset)
+	copy(s.chks, chks)
+
+	// Chunk metas are cached without their data. The chunk reader always
+	// resolves them from the block itself.
+	size := uint64(24 * len(chks))
+	for i := range s.chks {
+		s.chks[i].Chunk = nil
+	}
+	for _, l := range lset {
+		size += uint64(len(l.Name) + len(l.Value) + 32)
+	}
+	c.set(block, seriesCacheKey{block: block, ref: ref}, s, size)
+}
+
+// matchersCacheKey returns a key that uniquely identifies the given set of matchers.
+// The key is only valid if all matchers have a string representation.
+func matchersCacheKey(ms []labels.Matcher) (string, bool) {
+	var b strings.Builder
+
+	for i, m := range ms {
+		s, ok := m.(fmt.Stringer)
+		if !ok {
+			return "", false
+		}
+		str := s.String()
+		if str == "" {
+			return "", false
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(str)
+	}
+	return b.String(), true
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestIndexCache_LRU(t *testing.T) {
+	c := newIndexCache(nil, 100)
+
+	b1 := ulid.MustNew(1, nil)
+	b2 := ulid.MustNew(2, nil)
+
+	c.setPostings(b1, "a", []uint64{1, 2, 3, 4}) // Size 33.
+	c.setPostings(b1, "b", []uint64{1, 2, 3, 4}) // Size 33.
+	c.setPostings(b2, "a", []uint64{5, 6, 7})    // Size 25.
+	testutil.Equals(t, 3, len(c.items))
+	testutil.Equals(t, uint64(91), c.size)
+
+	// Access the oldest item so the second one gets evicted next.
+	refs, ok := c.postings(b1, "a")
+	testutil.Assert(t, ok, "expected cache hit")
+	testutil.Equals(t, []uint64{1, 2, 3, 4}, refs)
+
+	c.setPostings(b2, "b", []uint64{8, 9}) // Size 17.
+	testutil.Equals(t, 3, len(c.items))
+
+	_, ok = c.postings(b1, "b")
+	testutil.Assert(t, !ok, "expected item to be evicted")
+	_, ok = c.postings(b1, "a")
+	testutil.Assert(t, ok, "expected cache hit")
+
+	// Items larger than the cache are never stored.
+	c.setPostings(b1, "c", make([]uint64, 20))
+	_, ok = c.postings(b1, "c")
+	testutil.Assert(t, !ok, "expected oversized item to be skipped")
+
+	c.dropBlock(b2)
+	testutil.Equals(t, 1, len(c.items))
+	testutil.Equals(t, uint64(33), c.size)
+}
+
+func TestIndexCache_Block(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	head, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	defer head.Close()
+
+	app := head.Appender()
+	for i := 0; i < 10; i++ {
+		_, err := app.Add(labels.FromStrings("a", "b", "i", string(rune('a'+i))), 0, float64(i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	compactor, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{1000}, nil)
+	testutil.Ok(t, err)
+	id, err := compactor.Write(tmpdir, head, head.MinTime(), head.MaxTime()+1, nil)
+	testutil.Ok(t, err)
+
+	b, err := OpenBlock(filepath.Join(tmpdir, id.String()), nil)
+	testutil.Ok(t, err)
+
+	// Without a cache, postings lists must not be expanded for caching.
+	ir, err := b.Index()
+	testutil.Ok(t, err)
+	_, ok := ir.(postingsCache)
+	testutil.Assert(t, !ok, "index reader of block without cache caches postings")
+	testutil.Ok(t, ir.Close())
+
+	b.cache = newIndexCache(nil, 1<<20)
+
+	matchers := []labels.Matcher{
+		labels.NewEqualMatcher("a", "b"),
+		labels.NewMustRegexpMatcher("i", "[a-e]"),
+	}
+	q, err := NewBlockQuerier(b, 0, 1)
+	testutil.Ok(t, err)
+	expected := query(t, q, matchers...)
+	testutil.Equals(t, 5, len(expected))
+	testutil.Ok(t, q.Close())
+
+	// One postings list and the five series must be cached now.
+	testutil.Equals(t, 6, len(b.cache.items))
+
+	q, err = NewBlockQuerier(b, 0, 1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, query(t, q, matchers...))
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 6, len(b.cache.items))
+
+	// Closing the block must invalidate all its items.
+	testutil.Ok(t, b.Close())
+	testutil.Equals(t, 0, len(b.cache.items))
+	testutil.Equals(t, uint64(0), b.cache.size)
+}
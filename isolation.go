@@ -0,0 +1,201 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math"
+	"sync"
+
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// isolationState holds the appends a reader must not see. It must be closed
+// once the reader is done.
+type isolationState struct {
+	// All appends with a higher ID started after the state was created.
+	maxAppendID uint64
+	// Appends that were still open when the state was created.
+	incompleteAppends map[uint64]struct{}
+	// Lowest append ID the state may hide.
+	lowWatermark uint64
+
+	iso *isolation
+}
+
+// visible returns true if samples of the append are visible to the reader.
+func (s *isolationState) visible(appendID uint64) bool {
+	if appendID > s.maxAppendID {
+		return false
+	}
+	_, ok := s.incompleteAppends[appendID]
+	return !ok
+}
+
+// Close releases the state.
+func (s *isolationState) Close() {
+	s.iso.readMtx.Lock()
+	delete(s.iso.readsOpen, s)
+	s.iso.readMtx.Unlock()
+}
+
+// isolation tracks the open appends of the head and the readers that must not
+// see some of them.
+type isolation struct {
+	appendMtx    sync.Mutex
+	lastAppendID uint64
+	appendsOpen  map[uint64]struct{}
+
+	readMtx   sync.Mutex
+	readsOpen map[*isolationState]struct{}
+}
+
+func newIsolation() *isolation {
+	return &isolation{
+		appendsOpen: map[uint64]struct{}{},
+		readsOpen:   map[*isolationState]struct{}{},
+	}
+}
+
+// lowWatermark returns the lowest append ID that is hidden from any current or
+// future reader. Samples of appends below it are visible to everyone.
+func (i *isolation) lowWatermark() uint64 {
+	i.appendMtx.Lock()
+	lw := i.lastAppendID + 1
+	for id := range i.appendsOpen {
+		if id < lw {
+			lw = id
+		}
+	}
+	i.appendMtx.Unlock()
+
+	i.readMtx.Lock()
+	defer i.readMtx.Unlock()
+
+	for s := range i.readsOpen {
+		if s.lowWatermark < lw {
+			lw = s.lowWatermark
+		}
+	}
+	return lw
+}
+
+// state returns an isolation state hiding all appends that are open at this
+// point and all that start later.
+func (i *isolation) state() *isolationState {
+	i.appendMtx.Lock()
+	defer i.appendMtx.Unlock()
+
+	s := &isolationState{
+		maxAppendID:       i.lastAppendID,
+		incompleteAppends: make(map[uint64]struct{}, len(i.appendsOpen)),
+		lowWatermark:      i.lastAppendID + 1,
+		iso:               i,
+	}
+	for id := range i.appendsOpen {
+		s.incompleteAppends[id] = struct{}{}
+		if id < s.lowWatermark {
+			s.lowWatermark = id
+		}
+	}
+	// Register the reader while holding the append lock so that the low
+	// watermark cannot advance past it in the meantime.
+	i.readMtx.Lock()
+	i.readsOpen[s] = struct{}{}
+	i.readMtx.Unlock()
+
+	return s
+}
+
+// newAppendID opens a new append and returns its ID.
+func (i *isolation) newAppendID() uint64 {
+	i.appendMtx.Lock()
+	defer i.appendMtx.Unlock()
+
+	i.lastAppendID++
+	i.appendsOpen[i.lastAppendID] = struct{}{}
+
+	return i.lastAppendID
+}
+
+// closeAppend makes the samples of the append visible to new readers.
+func (i *isolation) closeAppend(appendID uint64) {
+	i.appendMtx.Lock()
+	delete(i.appendsOpen, appendID)
+	i.appendMtx.Unlock()
+}
+
+// txEntry is the append ID of a sample committed to a series.
+type txEntry struct {
+	appendID uint64
+	t        int64
+}
+
+// addAppendID records the append ID of the sample at t.
+func (s *memSeries) addAppendID(appendID uint64, t int64) {
+	s.txs = append(s.txs, txEntry{appendID: appendID, t: t})
+}
+
+// cleanupAppendIDsBelow drops the append IDs of the oldest samples that are
+// visible to all readers.
+func (s *memSeries) cleanupAppendIDsBelow(lowWatermark uint64) {
+	var k int
+	for k < len(s.txs) && s.txs[k].appendID < lowWatermark {
+		k++
+	}
+	if k == 0 {
+		return
+	}
+	s.txs = append(s.txs[:0], s.txs[k:]...)
+}
+
+// isolationLimit returns the timestamp of the first sample of the series that
+// is hidden by the isolation state. All following samples are hidden as well.
+// It returns math.MaxInt64 if all samples are visible.
+func (s *memSeries) isolationLimit(iso *isolationState) int64 {
+	if iso == nil {
+		return math.MaxInt64
+	}
+	limit := int64(math.MaxInt64)
+
+	for _, tx := range s.txs {
+		if tx.t < limit && !iso.visible(tx.appendID) {
+			limit = tx.t
+		}
+	}
+	return limit
+}
+
+// isolationIterator stops at the first sample at or after limit.
+type isolationIterator struct {
+	chunkenc.Iterator
+	limit int64
+}
+
+func (it *isolationIterator) Next() bool {
+	if !it.Iterator.Next() {
+		return false
+	}
+	t, _ := it.Iterator.At()
+	return t < it.limit
+}
+
+// isolationChunk hides the samples of a chunk at or after limit.
+type isolationChunk struct {
+	chunkenc.Chunk
+	limit int64
+}
+
+func (c *isolationChunk) Iterator() chunkenc.Iterator {
+	return &isolationIterator{Iterator: c.Chunk.Iterator(), limit: c.limit}
+}
@@ -14,7 +14,9 @@
 package labels
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -53,6 +55,8 @@ func (m *EqualMatcher) Matches(v string) bool { return v == m.value }
 // Value returns the matched value.
 func (m *EqualMatcher) Value() string { return m.value }
 
+func (m *EqualMatcher) String() string { return m.name + "=" + strconv.Quote(m.value) }
+
 // NewEqualMatcher returns a new matcher matching an exact label value.
 func NewEqualMatcher(name, value string) Matcher {
 	return &EqualMatcher{name: name, value: value}
@@ -65,6 +69,9 @@ type regexpMatcher struct {
 
 func (m *regexpMatcher) Name() string          { return m.name }
 func (m *regexpMatcher) Matches(v string) bool { return m.re.MatchString(v) }
+func (m *regexpMatcher) String() string {
+	return m.name + "=~" + strconv.Quote(m.re.String())
+}
 
 // NewRegexpMatcher returns a new matcher verifying that a value matches
 // the regular expression pattern.
@@ -95,6 +102,13 @@ type notMatcher struct {
 
 func (m *notMatcher) Matches(v string) bool { return !m.Matcher.Matches(v) }
 
+func (m *notMatcher) String() string {
+	if s, ok := m.Matcher.(fmt.Stringer); ok {
+		return "!(" + s.String() + ")"
+	}
+	return ""
+}
+
 // Not inverts the matcher's matching result.
 func Not(m Matcher) Matcher {
 	return &notMatcher{m}
@@ -118,3 +132,5 @@ func (m *PrefixMatcher) Prefix() string { return m.prefix }
 
 // Matches implements Matcher interface.
 func (m *PrefixMatcher) Matches(v string) bool { return strings.HasPrefix(v, m.prefix) }
+
+func (m *PrefixMatcher) String() string { return m.name + "=^" + strconv.Quote(m.prefix) }
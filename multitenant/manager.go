@@ -0,0 +1,523 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package multitenant manages one tsdb.DB per tenant below a common root
+// directory.
+package multitenant
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+var (
+	// ErrInvalidTenant is returned for tenant IDs that cannot be used as a
+	// directory name.
+	ErrInvalidTenant = errors.New("invalid tenant ID")
+	// ErrClosed is returned when the manager was closed.
+	ErrClosed = errors.New("manager closed")
+)
+
+// Limits are per-tenant overrides of the DB options. Zero values keep the
+// options of the DB template.
+type Limits struct {
+	// MaxSeries is the maximum number of series in the head block.
+	MaxSeries int
+
+	// MaxSeriesPerMetric is the maximum number of series with the same metric
+	// name in the head block.
+	MaxSeriesPerMetric int
+
+	// RetentionDuration is the duration of persisted data to keep.
+	RetentionDuration uint64
+}
+
+// Options of the manager.
+type Options struct {
+	// DB is the template for the options of all tenant DBs.
+	// Defaults to tsdb.DefaultOptions.
+	DB *tsdb.Options
+
+	// Overrides holds the limits of individual tenants.
+	Overrides map[string]Limits
+
+	// MaxConcurrentCompactions is the number of tenants compacted at the
+	// same time. Defaults to 1.
+	MaxConcurrentCompactions int
+
+	// CompactionInterval is the interval at which all open tenants are
+	// checked for compactable data. Defaults to one minute.
+	CompactionInterval time.Duration
+
+	// IdleTimeout is the duration after which unused tenants are closed.
+	// Zero keeps tenants open until the manager is closed.
+	IdleTimeout time.Duration
+}
+
+// DefaultOptions used for the manager.
+var DefaultOptions = &Options{
+	MaxConcurrentCompactions: 1,
+	CompactionInterval:       time.Minute,
+}
+
+type tenant struct {
+	id string
+
+	// Closed once the DB was opened or failed to open. The DB and the error
+	// must not be accessed before.
+	ready chan struct{}
+	db    *tsdb.DB
+	err   error
+
+	// All fields below are guarded by the manager's mutex.
+	refs     int
+	lastUsed time.Time
+	queued   bool
+	// Set while the tenant is closed as it became idle. It is closed once
+	// the tenant's directory is released.
+	closing chan struct{}
+}
+
+// opened returns true if the tenant's DB was opened successfully.
+func (t *tenant) opened() bool {
+	select {
+	case <-t.ready:
+		return t.err == nil
+	default:
+		return false
+	}
+}
+
+// Manager lazily opens a DB per tenant in a subdirectory of its root
+// directory. All DBs share a chunk pool and are compacted by a bounded set of
+// workers.
+type Manager struct {
+	dir     string
+	logger  log.Logger
+	opts    *Options
+	pool    chunkenc.Pool
+	metrics *managerMetrics
+
+	mtx     sync.Mutex
+	tenants map[string]*tenant
+	closed  bool
+
+	compactc chan *tenant
+	stopc    chan struct{}
+	wg       sync.WaitGroup
+}
+
+type managerMetrics struct {
+	tenants            prometheus.Gauge
+	tenantsOpened      prometheus.Counter
+	tenantsClosed      prometheus.Counter
+	compactions        prometheus.Counter
+	compactionsFailed  prometheus.Counter
+	compactionDuration prometheus.Summary
+}
+
+func newManagerMetrics(r prometheus.Registerer) *managerMetrics {
+	m := &managerMetrics{}
+
+	m.tenants = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_multitenant_open_tenants",
+		Help: "Number of currently open tenant DBs.",
+	})
+	m.tenantsOpened = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_multitenant_tenants_opened_total",
+		Help: "Total number of tenant DBs opened.",
+	})
+	m.tenantsClosed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_multitenant_idle_tenants_closed_total",
+		Help: "Total number of tenant DBs closed as they were idle.",
+	})
+	m.compactions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_multitenant_compactions_total",
+		Help: "Total number of tenant compactions run.",
+	})
+	m.compactionsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_multitenant_compactions_failed_total",
+		Help: "Total number of tenant compactions that failed.",
+	})
+	m.compactionDuration = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "prometheus_tsdb_multitenant_compaction_duration_seconds",
+		Help: "Duration of tenant compactions.",
+	})
+
+	if r != nil {
+		r.MustRegister(
+			m.tenants,
+			m.tenantsOpened,
+			m.tenantsClosed,
+			m.compactions,
+			m.compactionsFailed,
+			m.compactionDuration,
+		)
+	}
+	return m
+}
+
+// New returns a manager for the tenants below dir.
+func New(dir string, l log.Logger, r prometheus.Registerer, opts *Options) (*Manager, error) {
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	if opts.MaxConcurrentCompactions < 0 || opts.CompactionInterval < 0 || opts.IdleTimeout < 0 {
+		return nil, errors.New("invalid manager options")
+	}
+	m := &Manager{
+		dir:      dir,
+		logger:   l,
+		opts:     opts,
+		pool:     chunkenc.NewPool(),
+		metrics:  newManagerMetrics(r),
+		tenants:  map[string]*tenant{},
+		compactc: make(chan *tenant),
+		stopc:    make(chan struct{}),
+	}
+	workers := opts.MaxConcurrentCompactions
+	if workers == 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.compactWorker()
+	}
+	m.wg.Add(1)
+	go m.run()
+
+	return m, nil
+}
+
+func validTenant(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+// dbOptions returns the options for the DB of the tenant.
+func (m *Manager) dbOptions(id string) *tsdb.Options {
+	opts := *tsdb.DefaultOptions
+	if m.opts.DB != nil {
+		opts = *m.opts.DB
+	}
+	opts.ChunkPool = m.pool
+	opts.NoAutoCompaction = true
+
+	if l, ok := m.opts.Overrides[id]; ok {
+		if l.MaxSeries != 0 {
+			opts.MaxHeadSeries = l.MaxSeries
+		}
+		if l.MaxSeriesPerMetric != 0 {
+			opts.MaxHeadSeriesPerMetric = l.MaxSeriesPerMetric
+		}
+		if l.RetentionDuration != 0 {
+			opts.RetentionDuration = l.RetentionDuration
+		}
+	}
+	return &opts
+}
+
+// acquire returns the tenant and opens it if necessary. The tenant cannot
+// be closed until it is released again. The DB is opened without holding the
+// manager's mutex so that other tenants are not blocked meanwhile.
+func (m *Manager) acquire(id string) (*tenant, error) {
+	if !validTenant(id) {
+		return nil, errors.Wrapf(ErrInvalidTenant, "tenant %q", id)
+	}
+	for {
+		m.mtx.Lock()
+		if m.closed {
+			m.mtx.Unlock()
+			return nil, ErrClosed
+		}
+		t, ok := m.tenants[id]
+		if ok && t.closing != nil {
+			// Wait for the idle tenant to release its directory before reopening it.
+			closing := t.closing
+			m.mtx.Unlock()
+			<-closing
+			continue
+		}
+		if !ok {
+			t = &tenant{id: id, ready: make(chan struct{})}
+			m.tenants[id] = t
+		}
+		t.refs++
+		t.lastUsed = time.Now()
+		m.mtx.Unlock()
+
+		if !ok {
+			m.open(t)
+		}
+		<-t.ready
+
+		if t.err != nil {
+			m.release(t)
+			return nil, t.err
+		}
+		return t, nil
+	}
+}
+
+// open opens the DB of a new tenant and marks it as ready.
+func (m *Manager) open(t *tenant) {
+	defer close(t.ready)
+
+	// Tenant DBs register no metrics as they would collide with each other.
+	db, err := tsdb.Open(filepath.Join(m.dir, t.id), log.With(m.logger, "tenant", t.id), nil, m.dbOptions(t.id))
+	if err != nil {
+		t.err = errors.Wrapf(err, "open tenant %q", t.id)
+
+		// The next acquire tries to open the tenant again.
+		m.mtx.Lock()
+		delete(m.tenants, t.id)
+		m.mtx.Unlock()
+		return
+	}
+	t.db = db
+
+	m.metrics.tenants.Inc()
+	m.metrics.tenantsOpened.Inc()
+}
+
+func (m *Manager) release(t *tenant) {
+	m.mtx.Lock()
+	t.refs--
+	t.lastUsed = time.Now()
+	m.mtx.Unlock()
+}
+
+// Appender returns a new appender for the tenant.
+func (m *Manager) Appender(id string) (tsdb.Appender, error) {
+	t, err := m.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+	return &tenantAppender{Appender: t.db.Appender(), release: func() { m.release(t) }}, nil
+}
+
+// Querier returns a new querier for the tenant over the given time range.
+func (m *Manager) Querier(id string, mint, maxt int64) (tsdb.Querier, error) {
+	t, err := m.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+	q, err := t.db.Querier(mint, maxt)
+	if err != nil {
+		m.release(t)
+		return nil, err
+	}
+	return &tenantQuerier{Querier: q, release: func() { m.release(t) }}, nil
+}
+
+// Tenants returns the IDs of the currently open tenants.
+func (m *Manager) Tenants() []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	ids := make([]string, 0, len(m.tenants))
+	for id, t := range m.tenants {
+		if t.opened() && t.closing == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (m *Manager) run() {
+	defer m.wg.Done()
+
+	interval := m.opts.CompactionInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	compactTicker := time.NewTicker(interval)
+	defer compactTicker.Stop()
+
+	// Without an idle timeout the channel stays nil and never fires.
+	var idlec <-chan time.Time
+	if m.opts.IdleTimeout > 0 {
+		idleTicker := time.NewTicker(m.opts.IdleTimeout / 2)
+		defer idleTicker.Stop()
+		idlec = idleTicker.C
+	}
+
+	for {
+		select {
+		case <-m.stopc:
+			return
+		case <-compactTicker.C:
+			m.scheduleCompactions()
+		case <-idlec:
+			m.closeIdle()
+		}
+	}
+}
+
+// scheduleCompactions queues all open tenants that are not queued yet.
+func (m *Manager) scheduleCompactions() {
+	m.mtx.Lock()
+	var queue []*tenant
+	for _, t := range m.tenants {
+		if t.queued || t.closing != nil || !t.opened() {
+			continue
+		}
+		// Keep the tenant open until it was compacted.
+		t.queued = true
+		t.refs++
+		queue = append(queue, t)
+	}
+	m.mtx.Unlock()
+
+	for i, t := range queue {
+		select {
+		case m.compactc <- t:
+		case <-m.stopc:
+			for _, t := range queue[i:] {
+				m.finishCompaction(t)
+			}
+			return
+		}
+	}
+}
+
+func (m *Manager) finishCompaction(t *tenant) {
+	m.mtx.Lock()
+	t.queued = false
+	t.refs--
+	m.mtx.Unlock()
+}
+
+func (m *Manager) compactWorker() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-m.stopc:
+			return
+		case t := <-m.compactc:
+			start := time.Now()
+			if err := t.db.Compact(); err != nil {
+				level.Error(m.logger).Log("msg", "compaction failed", "tenant", t.id, "err", err)
+				m.metrics.compactionsFailed.Inc()
+			}
+			m.metrics.compactions.Inc()
+			m.metrics.compactionDuration.Observe(time.Since(start).Seconds())
+
+			m.finishCompaction(t)
+		}
+	}
+}
+
+// closeIdle closes all tenants that have not been used for the idle timeout.
+func (m *Manager) closeIdle() {
+	m.mtx.Lock()
+	var idle []*tenant
+	for _, t := range m.tenants {
+		// Tenants that are still opening are referenced by their acquirer.
+		if t.refs > 0 || t.closing != nil || time.Since(t.lastUsed) < m.opts.IdleTimeout {
+			continue
+		}
+		// The tenant stays in the map so that it is not reopened before its
+		// directory was released.
+		t.closing = make(chan struct{})
+		idle = append(idle, t)
+	}
+	m.mtx.Unlock()
+
+	for _, t := range idle {
+		if err := t.db.Close(); err != nil {
+			level.Error(m.logger).Log("msg", "closing idle tenant failed", "tenant", t.id, "err", err)
+		}
+		m.mtx.Lock()
+		delete(m.tenants, t.id)
+		m.mtx.Unlock()
+		close(t.closing)
+
+		m.metrics.tenants.Dec()
+		m.metrics.tenantsClosed.Inc()
+	}
+}
+
+// Close stops all compactions and closes all tenants. Appenders and queriers
+// must be completed before.
+func (m *Manager) Close() error {
+	m.mtx.Lock()
+	if m.closed {
+		m.mtx.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.mtx.Unlock()
+
+	// No tenant is closed as idle once the workers stopped.
+	close(m.stopc)
+	m.wg.Wait()
+
+	m.mtx.Lock()
+	tenants := m.tenants
+	m.tenants = map[string]*tenant{}
+	m.mtx.Unlock()
+
+	var merr tsdb.MultiError
+	for id, t := range tenants {
+		// Wait for tenants that are still opening.
+		<-t.ready
+		if t.err != nil {
+			continue
+		}
+		merr.Add(errors.Wrapf(t.db.Close(), "close tenant %q", id))
+		m.metrics.tenants.Dec()
+	}
+	return merr.Err()
+}
+
+// tenantAppender releases the tenant once the appender is completed.
+type tenantAppender struct {
+	tsdb.Appender
+	release func()
+	once    sync.Once
+}
+
+func (a *tenantAppender) Commit() error {
+	defer a.once.Do(a.release)
+	return a.Appender.Commit()
+}
+
+func (a *tenantAppender) Rollback() error {
+	defer a.once.Do(a.release)
+	return a.Appender.Rollback()
+}
+
+// tenantQuerier releases the tenant once the querier is closed.
+type tenantQuerier struct {
+	tsdb.Querier
+	release func()
+	once    sync.Once
+}
+
+func (q *tenantQuerier) Close() error {
+	defer q.once.Do(q.release)
+	return q.Querier.Close()
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multitenant
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func openTestManager(t *testing.T, opts *Options) (*Manager, func()) {
+	dir, err := ioutil.TempDir("", "multitenant")
+	testutil.Ok(t, err)
+
+	m, err := New(dir, nil, nil, opts)
+	testutil.Ok(t, err)
+
+	return m, func() {
+		testutil.Ok(t, m.Close())
+		testutil.Ok(t, os.RemoveAll(dir))
+	}
+}
+
+// querySamples returns the number of samples per series of the tenant.
+func querySamples(t *testing.T, m *Manager, id string) map[string]int {
+	q, err := m.Querier(id, 0, 1<<62)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	ss, err := q.Select(labels.NewMustRegexpMatcher("a", ".*"))
+	testutil.Ok(t, err)
+
+	res := map[string]int{}
+	for ss.Next() {
+		it := ss.At().Iterator()
+		for it.Next() {
+			res[ss.At().Labels().String()]++
+		}
+		testutil.Ok(t, it.Err())
+	}
+	testutil.Ok(t, ss.Err())
+	return res
+}
+
+func TestManager_Tenants(t *testing.T) {
+	m, closeFn := openTestManager(t, nil)
+	defer closeFn()
+
+	for _, id := range []string{"a", "b"} {
+		app, err := m.Appender(id)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", id), 100, 1)
+		testutil.Ok(t, err)
+		testutil.Ok(t, app.Commit())
+	}
+	ids := m.Tenants()
+	sort.Strings(ids)
+	testutil.Equals(t, []string{"a", "b"}, ids)
+
+	testutil.Equals(t, map[string]int{`{a="a"}`: 1}, querySamples(t, m, "a"))
+	testutil.Equals(t, map[string]int{`{a="b"}`: 1}, querySamples(t, m, "b"))
+
+	_, err := os.Stat(filepath.Join(m.dir, "a", "wal"))
+	testutil.Ok(t, err)
+
+	for _, id := range []string{"", ".", "..", "a/b"} {
+		_, err := m.Appender(id)
+		testutil.Equals(t, ErrInvalidTenant, errors.Cause(err))
+	}
+}
+
+func TestManager_Overrides(t *testing.T) {
+	m, closeFn := openTestManager(t, &Options{
+		Overrides: map[string]Limits{"limited": {MaxSeries: 1}},
+	})
+	defer closeFn()
+
+	for _, c := range []struct {
+		id  string
+		err error
+	}{
+		{id: "limited", err: tsdb.ErrSeriesLimitExceeded},
+		{id: "other", err: nil},
+	} {
+		app, err := m.Appender(c.id)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", "1"), 100, 1)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", "2"), 100, 1)
+		testutil.Equals(t, c.err, err)
+		testutil.Ok(t, app.Commit())
+	}
+}
+
+func TestManager_CloseIdle(t *testing.T) {
+	m, closeFn := openTestManager(t, &Options{IdleTimeout: 50 * time.Millisecond})
+	defer closeFn()
+
+	app, err := m.Appender("a")
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("a", "1"), 100, 1)
+	testutil.Ok(t, err)
+
+	// Tenants are not closed while in use.
+	time.Sleep(200 * time.Millisecond)
+	testutil.Equals(t, []string{"a"}, m.Tenants())
+	testutil.Ok(t, app.Commit())
+
+	for i := 0; len(m.Tenants()) > 0; i++ {
+		testutil.Assert(t, i < 100, "idle tenant was not closed")
+		time.Sleep(20 * time.Millisecond)
+	}
+	// The data is restored when the tenant is reopened.
+	testutil.Equals(t, map[string]int{`{a="1"}`: 1}, querySamples(t, m, "a"))
+}
+
+func TestManager_OpenDoesNotBlockOtherTenants(t *testing.T) {
+	m, closeFn := openTestManager(t, nil)
+	defer closeFn()
+
+	// Simulate a tenant whose DB is still being opened.
+	slow := &tenant{id: "slow", ready: make(chan struct{})}
+	m.mtx.Lock()
+	m.tenants["slow"] = slow
+	slow.refs++
+	m.mtx.Unlock()
+
+	app, err := m.Appender("a")
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Rollback())
+	testutil.Equals(t, []string{"a"}, m.Tenants())
+
+	// Users of the opening tenant wait for it and get its error.
+	errc := make(chan error)
+	go func() {
+		_, err := m.Appender("slow")
+		errc <- err
+	}()
+	select {
+	case <-errc:
+		t.Fatal("appender of opening tenant returned early")
+	case <-time.After(50 * time.Millisecond):
+	}
+	m.mtx.Lock()
+	delete(m.tenants, "slow")
+	m.mtx.Unlock()
+
+	slow.err = errors.New("open failed")
+	close(slow.ready)
+	testutil.NotOk(t, <-errc)
+}
+
+func TestManager_Compaction(t *testing.T) {
+	m, closeFn := openTestManager(t, &Options{
+		DB: &tsdb.Options{
+			BlockRanges:       []int64{1000},
+			RetentionDuration: 100000,
+		},
+		MaxConcurrentCompactions: 2,
+		CompactionInterval:       20 * time.Millisecond,
+	})
+	defer closeFn()
+
+	app, err := m.Appender("a")
+	testutil.Ok(t, err)
+	for i := int64(0); i < 3000; i += 100 {
+		_, err = app.Add(labels.FromStrings("a", "1"), i, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	for i := 0; ; i++ {
+		testutil.Assert(t, i < 100, "tenant was not compacted")
+
+		m.mtx.Lock()
+		n := len(m.tenants["a"].db.Blocks())
+		m.mtx.Unlock()
+
+		if n > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	testutil.Equals(t, map[string]int{`{a="1"}`: 30}, querySamples(t, m, "a"))
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// FilesystemBucket implements a Bucket on top of a local directory.
+// It is mostly useful for testing.
+type FilesystemBucket struct {
+	dir string
+}
+
+// NewFilesystemBucket returns a new bucket that stores objects as files
+// below the given directory.
+func NewFilesystemBucket(dir string) (*FilesystemBucket, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "create bucket dir")
+	}
+	return &FilesystemBucket{dir: dir}, nil
+}
+
+func (b *FilesystemBucket) path(name string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(name))
+}
+
+// Get implements Bucket.
+func (b *FilesystemBucket) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(b.path(name))
+}
+
+// GetRange implements Bucket.
+func (b *FilesystemBucket) GetRange(_ context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(b.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rangeReader{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+// ObjectSize implements Bucket.
+func (b *FilesystemBucket) ObjectSize(_ context.Context, name string) (int64, error) {
+	fi, err := os.Stat(b.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Upload implements Bucket. The object is written to a temporary file
+// first that is renamed once complete.
+func (b *FilesystemBucket) Upload(_ context.Context, name string, r io.Reader) error {
+	fn := b.path(name)
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := fileutil.Fsync(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return fileutil.Rename(tmp, fn)
+}
+
+// Iter implements Bucket.
+func (b *FilesystemBucket) Iter(_ context.Context, dir string, f func(string) error) error {
+	files, err := ioutil.ReadDir(b.path(dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		name := path.Join(dir, fi.Name())
+		if fi.IsDir() {
+			name += DirDelim
+		}
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete implements Bucket. Directories that become empty are removed as well.
+func (b *FilesystemBucket) Delete(_ context.Context, name string) error {
+	fn := b.path(name)
+
+	if err := os.Remove(fn); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(fn); dir != filepath.Clean(b.dir); dir = filepath.Dir(dir) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil || len(files) > 0 {
+			break
+		}
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// IsObjNotFoundErr implements Bucket.
+func (b *FilesystemBucket) IsObjNotFoundErr(err error) bool {
+	return os.IsNotExist(errors.Cause(err))
+}
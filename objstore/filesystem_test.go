@@ -0,0 +1,107 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestFilesystemBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_bucket")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+
+	bkt, err := NewFilesystemBucket(filepath.Join(dir, "bucket"))
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, bkt.Upload(ctx, "a/b/obj1", strings.NewReader("hello world")))
+	testutil.Ok(t, bkt.Upload(ctx, "a/obj2", strings.NewReader("foo")))
+	testutil.Ok(t, bkt.Upload(ctx, "obj3", strings.NewReader("bar")))
+
+	r, err := bkt.Get(ctx, "a/b/obj1")
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(r)
+	testutil.Ok(t, err)
+	testutil.Ok(t, r.Close())
+	testutil.Equals(t, "hello world", string(b))
+
+	r, err = bkt.GetRange(ctx, "a/b/obj1", 6, 3)
+	testutil.Ok(t, err)
+	b, err = ioutil.ReadAll(r)
+	testutil.Ok(t, err)
+	testutil.Ok(t, r.Close())
+	testutil.Equals(t, "wor", string(b))
+
+	size, err := bkt.ObjectSize(ctx, "a/b/obj1")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(11), size)
+
+	_, err = bkt.Get(ctx, "missing")
+	testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected not found error but got %v", err)
+
+	iter := func(dir string) (names []string) {
+		testutil.Ok(t, bkt.Iter(ctx, dir, func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		return names
+	}
+	testutil.Equals(t, []string{"a/", "obj3"}, iter(""))
+	testutil.Equals(t, []string{"a/b/", "a/obj2"}, iter("a"))
+	testutil.Equals(t, []string(nil), iter("missing"))
+
+	// Deleting the last object in a directory removes the directory as well.
+	testutil.Ok(t, bkt.Delete(ctx, "a/b/obj1"))
+	testutil.Equals(t, []string{"a/obj2"}, iter("a"))
+
+	testutil.Ok(t, DeleteDir(ctx, bkt, "a"))
+	testutil.Equals(t, []string{"obj3"}, iter(""))
+}
+
+func TestUploadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_upload_dir")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+
+	src := filepath.Join(dir, "src")
+	testutil.Ok(t, os.MkdirAll(filepath.Join(src, "sub"), 0777))
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(src, "f1"), []byte("1"), 0666))
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(src, "sub", "f2"), []byte("2"), 0666))
+
+	bkt, err := NewFilesystemBucket(filepath.Join(dir, "bucket"))
+	testutil.Ok(t, err)
+	testutil.Ok(t, UploadDir(ctx, bkt, src, "dst"))
+
+	var names []string
+	testutil.Ok(t, bkt.Iter(ctx, "dst", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"dst/f1", "dst/sub/"}, names)
+
+	size, err := bkt.ObjectSize(ctx, "dst/sub/f2")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(1), size)
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package objstore provides an abstraction over object storage buckets that
+// blocks can be uploaded to and read from.
+package objstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DirDelim is the delimiter used to model a directory structure in an object store.
+const DirDelim = "/"
+
+// Bucket provides read and write access to an object storage bucket.
+// Object names use DirDelim to model a directory hierarchy.
+type Bucket interface {
+	// Get returns a reader for the object with the given name.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// GetRange returns a reader for length bytes of the object with the
+	// given name, starting at offset off.
+	GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error)
+
+	// ObjectSize returns the size of the object with the given name in bytes.
+	ObjectSize(ctx context.Context, name string) (int64, error)
+
+	// Upload writes the contents of the reader to the object with the given name.
+	// An existing object is replaced. The object must not become visible to
+	// readers before it was written completely.
+	Upload(ctx context.Context, name string, r io.Reader) error
+
+	// Iter calls f for each entry in the given directory in lexicographic order.
+	// Names are relative to the bucket root. Entries that are directories
+	// end with DirDelim.
+	Iter(ctx context.Context, dir string, f func(name string) error) error
+
+	// Delete removes the object with the given name.
+	Delete(ctx context.Context, name string) error
+
+	// IsObjNotFoundErr returns true if the error was caused by a missing object.
+	IsObjNotFoundErr(err error) bool
+}
+
+// UploadFile uploads the file at src to the object dst.
+func UploadFile(ctx context.Context, bkt Bucket, src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "open file %s", src)
+	}
+	defer f.Close()
+
+	return errors.Wrapf(bkt.Upload(ctx, dst, f), "upload file %s as %s", src, dst)
+}
+
+// UploadDir uploads all files in the directory src recursively as objects in the directory dst.
+func UploadDir(ctx context.Context, bkt Bucket, src, dst string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return errors.Wrapf(err, "read dir %s", src)
+	}
+	for _, fi := range files {
+		var (
+			srcPath = filepath.Join(src, fi.Name())
+			dstPath = path.Join(dst, fi.Name())
+		)
+		if fi.IsDir() {
+			err = UploadDir(ctx, bkt, srcPath, dstPath)
+		} else {
+			err = UploadFile(ctx, bkt, srcPath, dstPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteDir removes all objects in the given directory recursively.
+func DeleteDir(ctx context.Context, bkt Bucket, dir string) error {
+	return bkt.Iter(ctx, dir, func(name string) error {
+		if strings.HasSuffix(name, DirDelim) {
+			return DeleteDir(ctx, bkt, name)
+		}
+		return bkt.Delete(ctx, name)
+	})
+}
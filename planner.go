@@ -0,0 +1,188 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// TombstonePlanner compacts every block on its own whose number of tombstones
+// exceeds a ratio of its number of series. This removes the deleted data
+// from disk.
+type TombstonePlanner struct {
+	ratio float64
+}
+
+// NewTombstonePlanner returns a TombstonePlanner for the given ratio.
+func NewTombstonePlanner(ratio float64) *TombstonePlanner {
+	return &TombstonePlanner{ratio: ratio}
+}
+
+// Plan implements the Planner interface.
+func (p *TombstonePlanner) Plan(dms []DirMeta) ([][]string, error) {
+	var res [][]string
+
+	for _, dm := range dms {
+		if dm.Meta.Compaction.Failed || dm.Meta.Stats.NumTombstones == 0 {
+			continue
+		}
+		if float64(dm.Meta.Stats.NumTombstones)/float64(dm.Meta.Stats.NumSeries+1) > p.ratio {
+			res = append(res, []string{dm.Dir})
+		}
+	}
+	return res, nil
+}
+
+// MaxSizePlanner limits the groups of another planner so that the blocks
+// compacted together do not exceed a maximum size in bytes. Groups are cut
+// down to their longest prefix within the limit. Blocks that cannot be
+// compacted with their successor are left out and the blocks are planned
+// again without them. Groups spanning a block that is not part of them are
+// never returned.
+type MaxSizePlanner struct {
+	planner  Planner
+	maxBytes int64
+}
+
+// NewMaxSizePlanner returns a MaxSizePlanner limiting the groups of p.
+func NewMaxSizePlanner(p Planner, maxBytes int64) *MaxSizePlanner {
+	return &MaxSizePlanner{planner: p, maxBytes: maxBytes}
+}
+
+// Plan implements the Planner interface.
+func (p *MaxSizePlanner) Plan(dms []DirMeta) ([][]string, error) {
+	sizes := map[string]int64{}
+
+	size := func(dir string) (int64, error) {
+		if s, ok := sizes[dir]; ok {
+			return s, nil
+		}
+		s, err := blockSize(dir)
+		if err != nil {
+			return 0, errors.Wrapf(err, "get size of block %s", dir)
+		}
+		sizes[dir] = s
+		return s, nil
+	}
+
+	all := make(map[string]*BlockMeta, len(dms))
+	for _, dm := range dms {
+		all[dm.Dir] = dm.Meta
+	}
+	// overlapsOthers returns true if the time range of the group overlaps a
+	// block that is not part of it. Compacting it would create overlapping blocks.
+	overlapsOthers := func(g []string) bool {
+		in := make(map[string]struct{}, len(g))
+		mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+		for _, dir := range g {
+			in[dir] = struct{}{}
+
+			m := all[dir]
+			if m.MinTime < mint {
+				mint = m.MinTime
+			}
+			if m.MaxTime > maxt {
+				maxt = m.MaxTime
+			}
+		}
+		for dir, m := range all {
+			if _, ok := in[dir]; !ok && m.MinTime < maxt && mint < m.MaxTime {
+				return true
+			}
+		}
+		return false
+	}
+
+	for {
+		groups, err := p.planner.Plan(dms)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			res      [][]string
+			excluded = map[string]struct{}{}
+		)
+		for _, g := range groups {
+			for _, dir := range g {
+				if _, ok := all[dir]; !ok {
+					return nil, errors.Errorf("planned unknown block %s", dir)
+				}
+			}
+			// Compacting a single block does not grow it.
+			if len(g) < 2 {
+				res = append(res, g)
+				continue
+			}
+			var total int64
+			n := 0
+			for ; n < len(g); n++ {
+				s, err := size(g[n])
+				if err != nil {
+					return nil, err
+				}
+				if total+s > p.maxBytes {
+					break
+				}
+				total += s
+			}
+			if n < 2 {
+				excluded[g[0]] = struct{}{}
+				continue
+			}
+			// Blocks left out before may lie within the range of the group.
+			if overlapsOthers(g[:n]) {
+				for _, dir := range g {
+					excluded[dir] = struct{}{}
+				}
+				continue
+			}
+			res = append(res, g[:n])
+		}
+		if len(res) > 0 || len(excluded) == 0 {
+			return res, nil
+		}
+
+		remaining := make([]DirMeta, 0, len(dms))
+		for _, dm := range dms {
+			if _, ok := excluded[dm.Dir]; !ok {
+				remaining = append(remaining, dm)
+			}
+		}
+		// Nothing was left out of the planned blocks.
+		if len(remaining) == len(dms) {
+			return nil, nil
+		}
+		dms = remaining
+	}
+}
+
+// blockSize returns the size of all files in the block directory.
+func blockSize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
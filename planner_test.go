@@ -0,0 +1,149 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestTombstonePlanner(t *testing.T) {
+	failed := metaRange("4", 60, 80, &BlockStats{NumSeries: 10, NumTombstones: 5})
+	failed.Meta.Compaction.Failed = true
+
+	res, err := NewTombstonePlanner(0.2).Plan([]DirMeta{
+		metaRange("1", 0, 20, &BlockStats{NumSeries: 10, NumTombstones: 5}),
+		metaRange("2", 20, 40, &BlockStats{NumSeries: 10, NumTombstones: 1}),
+		metaRange("3", 40, 60, &BlockStats{NumSeries: 0, NumTombstones: 0}),
+		failed,
+		metaRange("5", 80, 100, &BlockStats{NumSeries: 1, NumTombstones: 1}),
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, [][]string{{"1"}, {"5"}}, res)
+}
+
+func TestMaxSizePlanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	leveled, err := NewLeveledPlanner([]int64{20, 60, 180})
+	testutil.Ok(t, err)
+
+	cases := []struct {
+		blocks   [][3]int64 // Min time, max time and size of the blocks.
+		expected [][]string
+	}{
+		{
+			// All blocks fit.
+			blocks:   [][3]int64{{0, 20, 10}, {20, 40, 10}, {40, 60, 10}, {60, 80, 10}},
+			expected: [][]string{{"1", "2", "3"}},
+		},
+		{
+			// The group is cut down.
+			blocks:   [][3]int64{{0, 20, 40}, {20, 40, 40}, {40, 60, 40}, {60, 80, 10}},
+			expected: [][]string{{"1", "2"}},
+		},
+		{
+			// The first block is too large and left out.
+			blocks:   [][3]int64{{0, 20, 90}, {20, 40, 40}, {40, 60, 40}, {60, 80, 10}},
+			expected: [][]string{{"2", "3"}},
+		},
+		{
+			// No block can be compacted with another one.
+			blocks:   [][3]int64{{0, 20, 90}, {20, 40, 90}, {40, 60, 90}, {60, 80, 10}},
+			expected: nil,
+		},
+		{
+			// Without the left out blocks "2" and "3", the next level's range
+			// would span them.
+			blocks: [][3]int64{
+				{0, 60, 10}, {60, 80, 10}, {80, 100, 200}, {100, 120, 10}, {120, 180, 10}, {180, 200, 10},
+			},
+			expected: nil,
+		},
+	}
+	for _, c := range cases {
+		var metas []DirMeta
+		for i, b := range c.blocks {
+			bdir := filepath.Join(dir, strconv.Itoa(i+1))
+			testutil.Ok(t, os.MkdirAll(filepath.Join(bdir, "chunks"), 0777))
+			testutil.Ok(t, ioutil.WriteFile(filepath.Join(bdir, "chunks", "000001"), make([]byte, b[2]), 0666))
+
+			metas = append(metas, metaRange(bdir, b[0], b[1], nil))
+		}
+		res, err := NewMaxSizePlanner(leveled, 100).Plan(metas)
+		testutil.Ok(t, err)
+
+		var exp [][]string
+		for _, g := range c.expected {
+			var dirs []string
+			for _, name := range g {
+				dirs = append(dirs, filepath.Join(dir, name))
+			}
+			exp = append(exp, dirs)
+		}
+		testutil.Equals(t, exp, res)
+	}
+
+	// Blocks planned by the inner planner must be part of the input.
+	_, err = NewMaxSizePlanner(unknownBlockPlanner{}, 100).Plan([]DirMeta{metaRange(filepath.Join(dir, "1"), 0, 20, nil)})
+	testutil.NotOk(t, err)
+}
+
+type unknownBlockPlanner struct{}
+
+func (unknownBlockPlanner) Plan([]DirMeta) ([][]string, error) {
+	return [][]string{{"a", "b"}}, nil
+}
+
+type recordingPlanner struct {
+	planned [][]DirMeta
+}
+
+func (p *recordingPlanner) Plan(dms []DirMeta) ([][]string, error) {
+	p.planned = append(p.planned, dms)
+	return nil, nil
+}
+
+func TestDB_CompactionPlanner(t *testing.T) {
+	p := &recordingPlanner{}
+
+	db, closeFn := openTestDB(t, &Options{
+		BlockRanges:       []int64{1000},
+		NoAutoCompaction:  true,
+		CompactionPlanner: p,
+	})
+	defer closeFn()
+	defer db.Close()
+
+	app := db.Appender()
+	for i := int64(0); i < 5000; i += 100 {
+		_, err := app.Add(labels.FromStrings("a", "b"), i, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.Compact())
+
+	testutil.Assert(t, len(p.planned) > 0, "planner was not called")
+	// The most recent block is never passed to the planner.
+	last := p.planned[len(p.planned)-1]
+	testutil.Equals(t, len(db.Blocks())-1, len(last))
+}
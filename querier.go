@@ -23,6 +23,7 @@ import (
 	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/index"
 	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/value"
 )
 
 // Querier provides querying access over time series data of a fixed
@@ -54,6 +55,10 @@ type Series interface {
 // a single partition.
 type querier struct {
 	blocks []Querier
+
+	// Isolation state of the head's querier, released on Close. Nil if the
+	// querier does not read from the head.
+	iso *isolationState
 }
 
 func (q *querier) LabelValues(n string) ([]string, error) {
@@ -114,11 +119,27 @@ func (q *querier) Close() error {
 	for _, bq := range q.blocks {
 		merr.Add(bq.Close())
 	}
+	if q.iso != nil {
+		q.iso.Close()
+	}
 	return merr.Err()
 }
 
+// QuerierOptions control the data returned by a querier.
+type QuerierOptions struct {
+	// SkipStaleMarkers hides stale marker samples, as defined by the value
+	// package, from series iterators. By default they are returned like any
+	// other sample.
+	SkipStaleMarkers bool
+}
+
 // NewBlockQuerier returns a querier against the reader.
 func NewBlockQuerier(b BlockReader, mint, maxt int64) (Querier, error) {
+	return NewBlockQuerierWithOptions(b, mint, maxt, QuerierOptions{})
+}
+
+// NewBlockQuerierWithOptions returns a querier against the reader with the given options.
+func NewBlockQuerierWithOptions(b BlockReader, mint, maxt int64, opts QuerierOptions) (Querier, error) {
 	indexr, err := b.Index()
 	if err != nil {
 		return nil, errors.Wrapf(err, "open index reader")
@@ -140,6 +161,7 @@ func NewBlockQuerier(b BlockReader, mint, maxt int64) (Querier, error) {
 		index:      indexr,
 		chunks:     chunkr,
 		tombstones: tombsr,
+		skipStale:  opts.SkipStaleMarkers,
 	}, nil
 }
 
@@ -150,6 +172,7 @@ type blockQuerier struct {
 	tombstones TombstoneReader
 
 	mint, maxt int64
+	skipStale  bool
 }
 
 func (q *blockQuerier) Select(ms ...labels.Matcher) (SeriesSet, error) {
@@ -165,8 +188,9 @@ func (q *blockQuerier) Select(ms ...labels.Matcher) (SeriesSet, error) {
 			maxt:   q.maxt,
 		},
 
-		mint: q.mint,
-		maxt: q.maxt,
+		mint:      q.mint,
+		maxt:      q.maxt,
+		skipStale: q.skipStale,
 	}, nil
 }
 
@@ -205,6 +229,32 @@ func (q *blockQuerier) Close() error {
 // based on the given matchers. It returns a list of label names that must be manually
 // checked to not exist in series the postings list points to.
 func PostingsForMatchers(ix IndexReader, ms ...labels.Matcher) (index.Postings, error) {
+	if pc, ok := ix.(postingsCache); ok {
+		if refs, ok := pc.cachedPostings(ms); ok {
+			return index.NewListPostings(refs), nil
+		}
+		p, err := postingsForMatchers(ix, ms...)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := index.ExpandPostings(p)
+		if err != nil {
+			return nil, err
+		}
+		pc.cachePostings(ms, refs)
+		return index.NewListPostings(refs), nil
+	}
+	return postingsForMatchers(ix, ms...)
+}
+
+// postingsCache is implemented by index readers that can cache the
+// resulting postings lists of PostingsForMatchers.
+type postingsCache interface {
+	cachedPostings(ms []labels.Matcher) ([]uint64, bool)
+	cachePostings(ms []labels.Matcher, refs []uint64)
+}
+
+func postingsForMatchers(ix IndexReader, ms ...labels.Matcher) (index.Postings, error) {
 	var its []index.Postings
 
 	for _, m := range ms {
@@ -388,6 +438,8 @@ func EmptySeriesSet() SeriesSet {
 // the datapoints of a must be before the datapoints of b.
 type mergedSeriesSet struct {
 	a, b SeriesSet
+	// Combines series with the same labels. Defaults to chaining them.
+	merge func(a, b Series) Series
 
 	cur          Series
 	adone, bdone bool
@@ -446,7 +498,11 @@ func (s *mergedSeriesSet) Next() bool {
 		s.cur = s.a.At()
 		s.adone = !s.a.Next()
 	} else {
-		s.cur = &chainedSeries{series: []Series{s.a.At(), s.b.At()}}
+		if s.merge != nil {
+			s.cur = s.merge(s.a.At(), s.b.At())
+		} else {
+			s.cur = &chainedSeries{series: []Series{s.a.At(), s.b.At()}}
+		}
 		s.adone = !s.a.Next()
 		s.bdone = !s.b.Next()
 	}
@@ -622,6 +678,7 @@ type blockSeriesSet struct {
 	cur Series
 
 	mint, maxt int64
+	skipStale  bool
 }
 
 func (s *blockSeriesSet) Next() bool {
@@ -634,6 +691,7 @@ func (s *blockSeriesSet) Next() bool {
 			maxt:   s.maxt,
 
 			intervals: dranges,
+			skipStale: s.skipStale,
 		}
 		return true
 	}
@@ -655,6 +713,7 @@ type chunkSeries struct {
 	mint, maxt int64
 
 	intervals Intervals
+	skipStale bool
 }
 
 func (s *chunkSeries) Labels() labels.Labels {
@@ -662,7 +721,11 @@ func (s *chunkSeries) Labels() labels.Labels {
 }
 
 func (s *chunkSeries) Iterator() SeriesIterator {
-	return newChunkSeriesIterator(s.chunks, s.intervals, s.mint, s.maxt)
+	it := newChunkSeriesIterator(s.chunks, s.intervals, s.mint, s.maxt)
+	if s.skipStale {
+		it.skipStaleMarkers()
+	}
+	return it
 }
 
 // SeriesIterator iterates over the data of a time series.
@@ -761,24 +824,42 @@ type chunkSeriesIterator struct {
 	maxt, mint int64
 
 	intervals Intervals
+	skipStale bool
 }
 
 func newChunkSeriesIterator(cs []chunks.Meta, dranges Intervals, mint, maxt int64) *chunkSeriesIterator {
-	it := cs[0].Chunk.Iterator()
-
-	if len(dranges) > 0 {
-		it = &deletedIterator{it: it, intervals: dranges}
-	}
-	return &chunkSeriesIterator{
+	it := &chunkSeriesIterator{
 		chunks: cs,
 		i:      0,
-		cur:    it,
 
 		mint: mint,
 		maxt: maxt,
 
 		intervals: dranges,
 	}
+	it.cur = it.chunkIterator(0)
+	return it
+}
+
+// skipStaleMarkers makes the iterator skip stale marker samples. It must be
+// called before the iterator is used.
+func (it *chunkSeriesIterator) skipStaleMarkers() {
+	it.skipStale = true
+	it.cur = it.chunkIterator(it.i)
+}
+
+// chunkIterator returns an iterator over the i-th chunk without deleted and,
+// if enabled, stale marker samples.
+func (it *chunkSeriesIterator) chunkIterator(i int) chunkenc.Iterator {
+	cit := it.chunks[i].Chunk.Iterator()
+
+	if len(it.intervals) > 0 {
+		cit = &deletedIterator{it: cit, intervals: it.intervals}
+	}
+	if it.skipStale {
+		cit = &staleSkippingIterator{Iterator: cit}
+	}
+	return cit
 }
 
 func (it *chunkSeriesIterator) Seek(t int64) (ok bool) {
@@ -797,18 +878,22 @@ func (it *chunkSeriesIterator) Seek(t int64) (ok bool) {
 		}
 	}
 
-	it.cur = it.chunks[it.i].Chunk.Iterator()
-	if len(it.intervals) > 0 {
-		it.cur = &deletedIterator{it: it.cur, intervals: it.intervals}
-	}
+	it.cur = it.chunkIterator(it.i)
 
-	for it.cur.Next() {
-		t0, _ := it.cur.At()
-		if t0 >= t {
-			return true
+	for {
+		for it.cur.Next() {
+			t0, _ := it.cur.At()
+			if t0 >= t {
+				return true
+			}
+		}
+		// All remaining samples of the chunk may have been deleted or skipped.
+		if it.cur.Err() != nil || it.i == len(it.chunks)-1 {
+			return false
 		}
+		it.i++
+		it.cur = it.chunkIterator(it.i)
 	}
-	return false
 }
 
 func (it *chunkSeriesIterator) At() (t int64, v float64) {
@@ -840,10 +925,7 @@ func (it *chunkSeriesIterator) Next() bool {
 	}
 
 	it.i++
-	it.cur = it.chunks[it.i].Chunk.Iterator()
-	if len(it.intervals) > 0 {
-		it.cur = &deletedIterator{it: it.cur, intervals: it.intervals}
-	}
+	it.cur = it.chunkIterator(it.i)
 
 	return it.Next()
 }
@@ -852,6 +934,20 @@ func (it *chunkSeriesIterator) Err() error {
 	return it.cur.Err()
 }
 
+// staleSkippingIterator wraps an Iterator and skips stale marker samples.
+type staleSkippingIterator struct {
+	chunkenc.Iterator
+}
+
+func (it *staleSkippingIterator) Next() bool {
+	for it.Iterator.Next() {
+		if _, v := it.Iterator.At(); !value.IsStaleNaN(v) {
+			return true
+		}
+	}
+	return false
+}
+
 // deletedIterator wraps an Iterator and makes sure any deleted metrics are not
 // returned.
 type deletedIterator struct {
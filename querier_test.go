@@ -30,6 +30,7 @@ import (
 	"github.com/prometheus/tsdb/labels"
 	"github.com/prometheus/tsdb/testutil"
 	"github.com/prometheus/tsdb/tsdbutil"
+	"github.com/prometheus/tsdb/value"
 )
 
 type mockSeriesSet struct {
@@ -1151,6 +1152,40 @@ func TestChunkSeriesIterator_NextWithMinTime(t *testing.T) {
 	testutil.Assert(t, it.Next() == false, "")
 }
 
+func TestChunkSeriesIterator_SkipStaleMarkers(t *testing.T) {
+	stale := value.StaleMarker()
+	metas := []chunks.Meta{
+		tsdbutil.ChunkFromSamples([]Sample{sample{1, 2}, sample{2, stale}, sample{3, 4}}),
+		tsdbutil.ChunkFromSamples([]Sample{sample{5, stale}, sample{6, stale}}),
+		tsdbutil.ChunkFromSamples([]Sample{sample{7, 8}, sample{9, stale}}),
+	}
+
+	it := newChunkSeriesIterator(metas, nil, 1, 9)
+	it.skipStaleMarkers()
+
+	var res []sample
+	for it.Next() {
+		ts, v := it.At()
+		res = append(res, sample{ts, v})
+	}
+	testutil.Ok(t, it.Err())
+	testutil.Equals(t, []sample{{1, 2}, {3, 4}, {7, 8}}, res)
+
+	it = newChunkSeriesIterator(metas, nil, 1, 9)
+	it.skipStaleMarkers()
+
+	testutil.Assert(t, it.Seek(5), "")
+	ts, v := it.At()
+	testutil.Equals(t, int64(7), ts)
+	testutil.Equals(t, float64(8), v)
+
+	// By default stale markers are returned.
+	it = newChunkSeriesIterator(metas, nil, 1, 9)
+	testutil.Assert(t, it.Seek(2), "")
+	_, v = it.At()
+	testutil.Assert(t, value.IsStaleNaN(v), "expected stale marker")
+}
+
 func TestPopulatedCSReturnsValidChunkSlice(t *testing.T) {
 	lbls := []labels.Labels{labels.New(labels.Label{"a", "b"})}
 	chunkMetas := [][]chunks.Meta{
@@ -0,0 +1,221 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package relabel rewrites and filters label sets based on regular expressions.
+package relabel
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Action is the action applied by a relabel configuration.
+type Action string
+
+const (
+	// Replace sets the target label to the replacement if the regex matches
+	// the concatenated source label values.
+	Replace Action = "replace"
+	// Keep drops the label set if the regex does not match the concatenated
+	// source label values.
+	Keep Action = "keep"
+	// Drop drops the label set if the regex matches the concatenated source
+	// label values.
+	Drop Action = "drop"
+	// LabelDrop removes all labels whose name matches the regex.
+	LabelDrop Action = "labeldrop"
+	// LabelMap copies the values of all labels whose name matches the regex
+	// to labels named by the replacement.
+	LabelMap Action = "labelmap"
+)
+
+// Defaults for the zero values of a Config.
+const (
+	DefaultSeparator   = ";"
+	DefaultRegex       = "(.*)"
+	DefaultReplacement = "$1"
+)
+
+// Regexp is an anchored regular expression.
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+// NewRegexp compiles the expression anchored at both ends.
+func NewRegexp(s string) (Regexp, error) {
+	re, err := regexp.Compile("^(?:" + s + ")$")
+	if err != nil {
+		return Regexp{}, err
+	}
+	return Regexp{Regexp: re, original: s}, nil
+}
+
+// MustNewRegexp works like NewRegexp but panics if the expression is invalid.
+func MustNewRegexp(s string) Regexp {
+	re, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// String returns the expression as it was passed to NewRegexp.
+func (re Regexp) String() string {
+	return re.original
+}
+
+var defaultRegexp = MustNewRegexp(DefaultRegex)
+
+// Config is a relabeling step. Empty fields take their default values,
+// an empty action is Replace.
+type Config struct {
+	// SourceLabels whose values are concatenated and matched by the regex.
+	SourceLabels []string
+	// Separator placed between the concatenated source label values.
+	Separator string
+	// Regex matched against the concatenated source values for the replace,
+	// keep and drop actions and against label names for labeldrop and labelmap.
+	Regex Regexp
+	// TargetLabel written by the replace action.
+	TargetLabel string
+	// Replacement expanded with the regex's capture groups.
+	Replacement string
+	// Action to perform.
+	Action Action
+}
+
+func (c *Config) action() Action {
+	if c.Action == "" {
+		return Replace
+	}
+	return c.Action
+}
+
+func (c *Config) regex() Regexp {
+	if c.Regex.Regexp == nil {
+		return defaultRegexp
+	}
+	return c.Regex
+}
+
+func (c *Config) separator() string {
+	if c.Separator == "" {
+		return DefaultSeparator
+	}
+	return c.Separator
+}
+
+func (c *Config) replacement() string {
+	if c.Replacement == "" {
+		return DefaultReplacement
+	}
+	return c.Replacement
+}
+
+// Validate returns an error if the configuration cannot be applied.
+func (c *Config) Validate() error {
+	switch c.action() {
+	case Replace:
+		if c.TargetLabel == "" {
+			return errors.New("relabel replace action requires a target label")
+		}
+	case Keep, Drop:
+		if len(c.SourceLabels) == 0 {
+			return errors.Errorf("relabel %s action requires source labels", c.action())
+		}
+	case LabelDrop, LabelMap:
+	default:
+		return errors.Errorf("unknown relabel action %q", c.Action)
+	}
+	return nil
+}
+
+// Process applies the configurations to the label set in order. It returns
+// nil if the label set is dropped. The input label set is not modified.
+func Process(lset labels.Labels, cfgs ...*Config) labels.Labels {
+	m := lset.Map()
+
+	for _, c := range cfgs {
+		if !relabel(m, c) {
+			return nil
+		}
+	}
+	res := make(labels.Labels, 0, len(m))
+	for n, v := range m {
+		// Labels with empty values are equivalent to unset ones.
+		if v != "" {
+			res = append(res, labels.Label{Name: n, Value: v})
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	sort.Sort(res)
+	return res
+}
+
+// relabel applies a single configuration to the labels in m. It returns false
+// if the labels are dropped.
+func relabel(m map[string]string, c *Config) bool {
+	re := c.regex()
+
+	switch c.action() {
+	case Keep, Drop, Replace:
+		vals := make([]string, 0, len(c.SourceLabels))
+		for _, n := range c.SourceLabels {
+			vals = append(vals, m[n])
+		}
+		val := strings.Join(vals, c.separator())
+
+		switch c.action() {
+		case Keep:
+			return re.MatchString(val)
+		case Drop:
+			return !re.MatchString(val)
+		}
+		idx := re.FindStringSubmatchIndex(val)
+		if idx == nil {
+			return true
+		}
+		target := string(re.ExpandString(nil, c.TargetLabel, val, idx))
+		res := string(re.ExpandString(nil, c.replacement(), val, idx))
+
+		if res == "" {
+			delete(m, target)
+		} else if target != "" {
+			m[target] = res
+		}
+	case LabelDrop:
+		for n := range m {
+			if re.MatchString(n) {
+				delete(m, n)
+			}
+		}
+	case LabelMap:
+		mapped := map[string]string{}
+		for n, v := range m {
+			if re.MatchString(n) {
+				mapped[re.ReplaceAllString(n, c.replacement())] = v
+			}
+		}
+		for n, v := range mapped {
+			m[n] = v
+		}
+	}
+	return true
+}
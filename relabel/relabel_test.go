@@ -0,0 +1,164 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package relabel
+
+import (
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestProcess(t *testing.T) {
+	cases := []struct {
+		input  labels.Labels
+		cfgs   []*Config
+		output labels.Labels
+	}{
+		{
+			input: labels.FromStrings("a", "foo", "b", "bar"),
+			cfgs: []*Config{
+				{
+					SourceLabels: []string{"a"},
+					Regex:        MustNewRegexp("f(.*)"),
+					TargetLabel:  "d",
+					Replacement:  "ch${1}-ch${1}",
+				},
+			},
+			output: labels.FromStrings("a", "foo", "b", "bar", "d", "choo-choo"),
+		},
+		{
+			// The regex is anchored and does not match.
+			input: labels.FromStrings("a", "foo"),
+			cfgs: []*Config{
+				{
+					SourceLabels: []string{"a"},
+					Regex:        MustNewRegexp("o+"),
+					TargetLabel:  "d",
+				},
+			},
+			output: labels.FromStrings("a", "foo"),
+		},
+		{
+			// Source label values are joined by the separator.
+			input: labels.FromStrings("a", "foo", "b", "bar"),
+			cfgs: []*Config{
+				{
+					SourceLabels: []string{"a", "b"},
+					TargetLabel:  "c",
+				},
+			},
+			output: labels.FromStrings("a", "foo", "b", "bar", "c", "foo;bar"),
+		},
+		{
+			// An empty replacement result removes the target label.
+			input: labels.FromStrings("a", "foo", "b", ""),
+			cfgs: []*Config{
+				{
+					SourceLabels: []string{"b"},
+					TargetLabel:  "a",
+				},
+			},
+			output: nil,
+		},
+		{
+			input: labels.FromStrings("a", "foo"),
+			cfgs: []*Config{
+				{
+					SourceLabels: []string{"a"},
+					Regex:        MustNewRegexp("f.*"),
+					Action:       Drop,
+				},
+			},
+			output: nil,
+		},
+		{
+			input: labels.FromStrings("a", "foo"),
+			cfgs: []*Config{
+				{
+					SourceLabels: []string{"a"},
+					Regex:        MustNewRegexp("b.*"),
+					Action:       Drop,
+				},
+			},
+			output: labels.FromStrings("a", "foo"),
+		},
+		{
+			input: labels.FromStrings("a", "foo"),
+			cfgs: []*Config{
+				{
+					SourceLabels: []string{"a"},
+					Regex:        MustNewRegexp("b.*"),
+					Action:       Keep,
+				},
+			},
+			output: nil,
+		},
+		{
+			input: labels.FromStrings("a", "foo", "b", "bar", "instance_id", "1234"),
+			cfgs: []*Config{
+				{
+					Regex:  MustNewRegexp("instance_.*|b"),
+					Action: LabelDrop,
+				},
+			},
+			output: labels.FromStrings("a", "foo"),
+		},
+		{
+			input: labels.FromStrings("a", "foo", "__meta_b", "bar"),
+			cfgs: []*Config{
+				{
+					Regex:  MustNewRegexp("__meta_(.+)"),
+					Action: LabelMap,
+				},
+			},
+			output: labels.FromStrings("a", "foo", "__meta_b", "bar", "b", "bar"),
+		},
+		{
+			// Configurations are applied in order.
+			input: labels.FromStrings("a", "foo", "__meta_b", "bar"),
+			cfgs: []*Config{
+				{
+					Regex:       MustNewRegexp("__meta_(.+)"),
+					Replacement: "meta_$1",
+					Action:      LabelMap,
+				},
+				{
+					Regex:  MustNewRegexp("__meta_.+"),
+					Action: LabelDrop,
+				},
+				{
+					SourceLabels: []string{"meta_b"},
+					Regex:        MustNewRegexp("bar"),
+					Action:       Keep,
+				},
+			},
+			output: labels.FromStrings("a", "foo", "meta_b", "bar"),
+		},
+	}
+	for i, c := range cases {
+		input := append(labels.Labels{}, c.input...)
+
+		testutil.Equals(t, c.output, Process(c.input, c.cfgs...), "case %d", i)
+		testutil.Equals(t, input, c.input, "case %d modified the input", i)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	testutil.Ok(t, (&Config{TargetLabel: "a"}).Validate())
+	testutil.Ok(t, (&Config{Action: LabelDrop}).Validate())
+	testutil.NotOk(t, (&Config{}).Validate())
+	testutil.NotOk(t, (&Config{Action: Keep}).Validate())
+	testutil.NotOk(t, (&Config{Action: "unknown"}).Validate())
+}
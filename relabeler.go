@@ -0,0 +1,193 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/relabel"
+)
+
+// droppedSeriesRef is returned by the DB's appenders for series dropped by
+// relabeling. Samples added for it are discarded.
+const droppedSeriesRef = math.MaxUint64
+
+// relabeler applies the relabel configurations to appended series. The
+// results are cached by the appended label set together with the head
+// reference of the relabeled series, so that further appends of the label
+// set skip relabeling and the series lookup. Entries are removed along with
+// the head series they refer to.
+type relabeler struct {
+	cfgs    []*relabel.Config
+	metrics *relabelerMetrics
+
+	// Striped like the head's series to avoid lock contention.
+	cache [stripeSize]map[uint64][]*relabelEntry
+	locks [stripeSize]stripeLock
+}
+
+type relabelEntry struct {
+	in   labels.Labels
+	ref  uint64 // Head reference of the relabeled series or droppedSeriesRef.
+	seen uint32 // Set if a dropped series was appended since the last purge.
+}
+
+type relabelerMetrics struct {
+	droppedSeries   prometheus.Counter
+	rewrittenSeries prometheus.Counter
+}
+
+func newRelabelerMetrics(r prometheus.Registerer) *relabelerMetrics {
+	m := &relabelerMetrics{}
+
+	m.droppedSeries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_relabel_dropped_series_total",
+		Help: "Total number of appended series dropped by relabeling.",
+	})
+	m.rewrittenSeries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_relabel_rewritten_series_total",
+		Help: "Total number of appended series whose labels were changed by relabeling.",
+	})
+
+	if r != nil {
+		r.MustRegister(
+			m.droppedSeries,
+			m.rewrittenSeries,
+		)
+	}
+	return m
+}
+
+func newRelabeler(r prometheus.Registerer, cfgs []*relabel.Config) (*relabeler, error) {
+	for i, c := range cfgs {
+		if err := c.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "relabel config %d", i)
+		}
+	}
+	rl := &relabeler{
+		cfgs:    cfgs,
+		metrics: newRelabelerMetrics(r),
+	}
+	for i := range rl.cache {
+		rl.cache[i] = map[uint64][]*relabelEntry{}
+	}
+	return rl, nil
+}
+
+// add relabels the label set and adds the sample to the relabeled series.
+// It returns droppedSeriesRef if the series is dropped.
+func (r *relabeler) add(app Appender, head *Head, lset labels.Labels, t int64, v float64) (uint64, error) {
+	hash := lset.Hash()
+
+	if ref, ok := r.get(hash, lset); ok {
+		if ref == droppedSeriesRef {
+			return ref, nil
+		}
+		err := app.AddFast(ref, t, v)
+		if errors.Cause(err) != ErrNotFound {
+			return ref, err
+		}
+		// The series was removed from the head in the meantime.
+	}
+
+	out := relabel.Process(lset, r.cfgs...)
+	if out == nil {
+		// The appended label set may be reused by the caller.
+		if r.set(hash, append(labels.Labels{}, lset...), droppedSeriesRef) {
+			r.metrics.droppedSeries.Inc()
+		}
+		return droppedSeriesRef, nil
+	}
+	ref, err := app.Add(out, t, v)
+	if err != nil {
+		return ref, err
+	}
+	if !out.Equals(lset) {
+		if r.set(hash, append(labels.Labels{}, lset...), ref) {
+			r.metrics.rewrittenSeries.Inc()
+		}
+		return ref, nil
+	}
+	// Unchanged label sets share the labels of the head series.
+	if s := head.series.getByID(ref); s != nil {
+		r.set(hash, s.lset, ref)
+	}
+	return ref, nil
+}
+
+// get returns the cached reference for the label set.
+func (r *relabeler) get(hash uint64, lset labels.Labels) (uint64, bool) {
+	i := hash & stripeMask
+
+	r.locks[i].RLock()
+	defer r.locks[i].RUnlock()
+
+	for _, e := range r.cache[i][hash] {
+		if e.in.Equals(lset) {
+			atomic.StoreUint32(&e.seen, 1)
+			return e.ref, true
+		}
+	}
+	return 0, false
+}
+
+// set caches the reference for the label set. It returns true if the label
+// set was not cached before.
+func (r *relabeler) set(hash uint64, lset labels.Labels, ref uint64) bool {
+	i := hash & stripeMask
+
+	r.locks[i].Lock()
+	defer r.locks[i].Unlock()
+
+	for _, e := range r.cache[i][hash] {
+		if e.in.Equals(lset) {
+			e.ref = ref
+			return false
+		}
+	}
+	r.cache[i][hash] = append(r.cache[i][hash], &relabelEntry{in: lset, ref: ref, seen: 1})
+	return true
+}
+
+// purge removes the entries of series that were garbage collected from the
+// head and of dropped series that were not appended since the last purge.
+func (r *relabeler) purge(head *Head) {
+	for i := range r.cache {
+		r.locks[i].Lock()
+
+		for hash, es := range r.cache[i] {
+			keep := es[:0]
+			for _, e := range es {
+				if e.ref == droppedSeriesRef {
+					if atomic.SwapUint32(&e.seen, 0) == 1 {
+						keep = append(keep, e)
+					}
+				} else if head.series.getByID(e.ref) != nil {
+					keep = append(keep, e)
+				}
+			}
+			if len(keep) == 0 {
+				delete(r.cache[i], hash)
+			} else {
+				r.cache[i][hash] = keep
+			}
+		}
+
+		r.locks[i].Unlock()
+	}
+}
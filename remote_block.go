@@ -0,0 +1,373 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/objstore"
+)
+
+const (
+	// remotePageSize is the granularity in which index data is fetched from a bucket.
+	remotePageSize = 32 * 1024
+
+	// remoteChunkReadSize is the number of bytes initially fetched for a chunk.
+	// Larger chunks require a second request.
+	remoteChunkReadSize = 1024
+)
+
+// RemoteBlock provides read access to a block in an object storage bucket.
+// Index and chunk data is fetched on demand. Fetched index data is kept in
+// memory until the block is closed.
+type RemoteBlock struct {
+	meta       BlockMeta
+	indexr     *remoteIndexReader
+	chunkr     *remoteChunkReader
+	tombstones TombstoneReader
+}
+
+// OpenRemoteBlock opens the block with the given ID in the bucket. It can be passed a
+// chunk pool, which is used to instantiate chunk structs.
+func OpenRemoteBlock(ctx context.Context, bkt objstore.Bucket, id ulid.ULID, pool chunkenc.Pool) (*RemoteBlock, error) {
+	if pool == nil {
+		pool = chunkenc.NewPool()
+	}
+	dir := id.String()
+
+	b, err := readObject(ctx, bkt, path.Join(dir, metaFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "read meta file")
+	}
+	meta, err := decodeMeta(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode meta file")
+	}
+
+	tr := NewMemTombstones()
+
+	b, err = readObject(ctx, bkt, path.Join(dir, tombstoneFilename))
+	if err != nil && !bkt.IsObjNotFoundErr(errors.Cause(err)) {
+		return nil, errors.Wrap(err, "read tombstones")
+	}
+	if err == nil {
+		if tr, err = decodeTombstones(b); err != nil {
+			return nil, errors.Wrap(err, "decode tombstones")
+		}
+	}
+
+	indexName := path.Join(dir, indexFilename)
+
+	size, err := bkt.ObjectSize(ctx, indexName)
+	if err != nil {
+		return nil, errors.Wrap(err, "get index size")
+	}
+	bs := &bucketByteSlice{
+		bkt:   bkt,
+		name:  indexName,
+		size:  int(size),
+		pages: map[int][]byte{},
+	}
+	ir, err := index.NewReader(bs)
+	if err = bs.fetchErr(0, err); err != nil {
+		return nil, errors.Wrap(err, "open index")
+	}
+
+	cr := &remoteChunkReader{bkt: bkt, pool: pool}
+
+	err = bkt.Iter(ctx, path.Join(dir, "chunks"), func(name string) error {
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			return nil
+		}
+		size, err := bkt.ObjectSize(ctx, name)
+		if err != nil {
+			return err
+		}
+		cr.files = append(cr.files, name)
+		cr.sizes = append(cr.sizes, int(size))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "list chunk files")
+	}
+
+	return &RemoteBlock{
+		meta:       *meta,
+		indexr:     &remoteIndexReader{IndexReader: ir, bs: bs},
+		chunkr:     cr,
+		tombstones: tr,
+	}, nil
+}
+
+func readObject(ctx context.Context, bkt objstore.Bucket, name string) ([]byte, error) {
+	r, err := bkt.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// Meta returns meta information about the block.
+func (b *RemoteBlock) Meta() BlockMeta { return b.meta }
+
+// Index returns an IndexReader over the block's index. Closing it is a no-op.
+func (b *RemoteBlock) Index() (IndexReader, error) {
+	return nopCloseIndexReader{b.indexr}, nil
+}
+
+// Chunks returns a ChunkReader over the block's chunks. Closing it is a no-op.
+func (b *RemoteBlock) Chunks() (ChunkReader, error) {
+	return nopCloseChunkReader{b.chunkr}, nil
+}
+
+// Tombstones returns a TombstoneReader over the block's deleted data.
+func (b *RemoteBlock) Tombstones() (TombstoneReader, error) {
+	return b.tombstones, nil
+}
+
+// Close releases all fetched data. Readers of the block must not be used afterwards.
+func (b *RemoteBlock) Close() error {
+	var merr MultiError
+
+	merr.Add(b.indexr.IndexReader.Close())
+	merr.Add(b.tombstones.Close())
+
+	b.indexr.bs.reset()
+
+	return merr.Err()
+}
+
+type nopCloseIndexReader struct{ IndexReader }
+
+func (nopCloseIndexReader) Close() error { return nil }
+
+type nopCloseChunkReader struct{ ChunkReader }
+
+func (nopCloseChunkReader) Close() error { return nil }
+
+// remoteIndexReader reports failures to fetch index data instead of the
+// decoding errors they caused.
+type remoteIndexReader struct {
+	IndexReader
+	bs *bucketByteSlice
+}
+
+func (r *remoteIndexReader) LabelValues(names ...string) (index.StringTuples, error) {
+	n := r.bs.fetchFailures()
+	st, err := r.IndexReader.LabelValues(names...)
+	return st, r.bs.fetchErr(n, err)
+}
+
+func (r *remoteIndexReader) Postings(name, value string) (index.Postings, error) {
+	n := r.bs.fetchFailures()
+	p, err := r.IndexReader.Postings(name, value)
+	return p, r.bs.fetchErr(n, err)
+}
+
+func (r *remoteIndexReader) Series(ref uint64, lset *labels.Labels, chks *[]chunks.Meta) error {
+	n := r.bs.fetchFailures()
+	return r.bs.fetchErr(n, r.IndexReader.Series(ref, lset, chks))
+}
+
+// bucketByteSlice implements index.ByteSlice over an object in a bucket.
+// Data is fetched in pages of remotePageSize bytes, which are cached.
+// As ranges cannot return errors, pages that failed to fetch read as zeros and
+// the fetch error is returned by the index read instead. Failed pages are
+// fetched again by the next read.
+type bucketByteSlice struct {
+	bkt  objstore.Bucket
+	name string
+	size int
+
+	mtx      sync.Mutex
+	pages    map[int][]byte
+	failures int   // Number of failed fetches.
+	err      error // Error of the last failed fetch.
+}
+
+func (b *bucketByteSlice) Len() int {
+	return b.size
+}
+
+func (b *bucketByteSlice) Range(start, end int) []byte {
+	if start >= end {
+		return []byte{}
+	}
+	first, last := start/remotePageSize, (end-1)/remotePageSize
+
+	// Avoid copying ranges that lie within a single page.
+	if first == last {
+		if p := b.page(first); p != nil {
+			return p[start-first*remotePageSize : end-first*remotePageSize]
+		}
+		return make([]byte, end-start)
+	}
+	res := make([]byte, end-start)
+
+	for i := first; i <= last; i++ {
+		var (
+			lo = i * remotePageSize
+			hi = lo + remotePageSize
+		)
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		if p := b.page(i); p != nil {
+			copy(res[lo-start:], p[lo-i*remotePageSize:hi-i*remotePageSize])
+		}
+	}
+	return res
+}
+
+// page returns the i-th page of the object or nil if it could not be fetched.
+func (b *bucketByteSlice) page(i int) []byte {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if p, ok := b.pages[i]; ok {
+		return p
+	}
+	var (
+		off    = i * remotePageSize
+		length = remotePageSize
+	)
+	if off+length > b.size {
+		length = b.size - off
+	}
+	r, err := b.bkt.GetRange(context.Background(), b.name, int64(off), int64(length))
+	if err != nil {
+		b.failed(errors.Wrapf(err, "fetch %s at offset %d", b.name, off))
+		return nil
+	}
+	defer r.Close()
+
+	p, err := ioutil.ReadAll(r)
+	if err == nil && len(p) != length {
+		err = errors.Errorf("expected %d bytes but got %d", length, len(p))
+	}
+	if err != nil {
+		b.failed(errors.Wrapf(err, "fetch %s at offset %d", b.name, off))
+		return nil
+	}
+	b.pages[i] = p
+	return p
+}
+
+func (b *bucketByteSlice) failed(err error) {
+	b.failures++
+	b.err = err
+}
+
+// fetchFailures returns the number of failed fetches so far.
+func (b *bucketByteSlice) fetchFailures() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.failures
+}
+
+// fetchErr returns the last fetch error instead of err if a fetch failed after
+// the given number of failures. Zeroed pages may decode without error.
+func (b *bucketByteSlice) fetchErr(since int, err error) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.failures > since {
+		return b.err
+	}
+	return err
+}
+
+func (b *bucketByteSlice) reset() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.pages = map[int][]byte{}
+}
+
+// remoteChunkReader implements ChunkReader over the chunk files of a block in a bucket.
+type remoteChunkReader struct {
+	bkt   objstore.Bucket
+	files []string
+	sizes []int
+	pool  chunkenc.Pool
+}
+
+func (r *remoteChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	var (
+		seq = int(ref >> 32)
+		off = int((ref << 32) >> 32)
+	)
+	if seq >= len(r.files) {
+		return nil, errors.Errorf("reference sequence %d out of range", seq)
+	}
+	if off >= r.sizes[seq] {
+		return nil, errors.Errorf("offset %d beyond data size %d", off, r.sizes[seq])
+	}
+	b, err := r.read(seq, off, remoteChunkReadSize)
+	if err != nil {
+		return nil, err
+	}
+	l, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errors.Errorf("reading chunk length failed with %d", n)
+	}
+	// The chunk data is preceded by its encoding.
+	size := n + 1 + int(l)
+
+	if len(b) < size {
+		if b, err = r.read(seq, off, size); err != nil {
+			return nil, err
+		}
+		if len(b) < size {
+			return nil, errors.Errorf("chunk of %d bytes exceeds file size", size)
+		}
+	}
+	return r.pool.Get(chunkenc.Encoding(b[n]), b[n+1:size])
+}
+
+// read fetches up to length bytes of the seq-th chunk file starting at off.
+func (r *remoteChunkReader) read(seq, off, length int) ([]byte, error) {
+	if off+length > r.sizes[seq] {
+		length = r.sizes[seq] - off
+	}
+	rc, err := r.bkt.GetRange(context.Background(), r.files[seq], int64(off), int64(length))
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetch %s at offset %d", r.files[seq], off)
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	return b, errors.Wrapf(err, "fetch %s at offset %d", r.files[seq], off)
+}
+
+func (r *remoteChunkReader) Close() error {
+	return nil
+}
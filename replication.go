@@ -0,0 +1,522 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/wal"
+)
+
+// ErrReadOnly is returned for writes to a DB that replicates a leader.
+var ErrReadOnly = errors.New("read-only replica")
+
+const (
+	// Maximum number of bytes returned for a single segment request.
+	replicationMaxFetchSize = 4 * 1024 * 1024
+
+	followerPollInterval = 250 * time.Millisecond
+
+	checkpointIndexHeader = "X-Checkpoint-Index"
+)
+
+// replicationState describes the WAL of a leader.
+type replicationState struct {
+	FirstSegment int `json:"firstSegment"`
+	LastSegment  int `json:"lastSegment"`
+	Checkpoint   int `json:"checkpoint"` // -1 if there is none.
+}
+
+// ReplicationHandler returns an HTTP handler exposing the WAL of the DB to followers.
+// It serves the following paths, which may be mounted under a common prefix
+// with http.StripPrefix:
+//
+//	/segments             the replicationState as JSON
+//	/segments/<n>?offset= the data of segment n from the given offset
+//	/checkpoint           the data of the most recent checkpoint
+func (db *DB) ReplicationHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/segments", db.serveReplicationState)
+	mux.HandleFunc("/segments/", db.serveSegment)
+	mux.HandleFunc("/checkpoint", db.serveCheckpoint)
+	return mux
+}
+
+func (db *DB) serveReplicationState(w http.ResponseWriter, r *http.Request) {
+	first, last, err := db.head.wal.Segments()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	st := replicationState{FirstSegment: first, LastSegment: last, Checkpoint: -1}
+
+	_, idx, err := LastCheckpoint(db.head.wal.Dir())
+	if err != nil && err != ErrNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		st.Checkpoint = idx
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func (db *DB) serveSegment(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/segments/"))
+	if err != nil {
+		http.Error(w, "invalid segment", http.StatusBadRequest)
+		return
+	}
+	var offset int64
+	if s := r.URL.Query().Get("offset"); s != "" {
+		if offset, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	f, err := os.Open(wal.SegmentName(db.head.wal.Dir(), n))
+	if os.IsNotExist(err) {
+		http.Error(w, "segment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, io.LimitReader(f, replicationMaxFetchSize))
+}
+
+func (db *DB) serveCheckpoint(w http.ResponseWriter, r *http.Request) {
+	dir, idx, err := LastCheckpoint(db.head.wal.Dir())
+	if err == ErrNotFound {
+		http.Error(w, "checkpoint not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sr, err := wal.NewSegmentsReader(filepath.Join(db.head.wal.Dir(), dir))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer sr.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(checkpointIndexHeader, strconv.Itoa(idx))
+	io.Copy(w, sr)
+}
+
+// Follower replicates the WAL of a leader into a local DB. The records are
+// applied to the head and written to the WAL of the DB, which compacts them
+// into its own blocks. The DB rejects writes until the follower is promoted.
+// The position in the WAL of the leader is saved in the DB directory after
+// every applied batch of records, so a restarted follower continues where it
+// stopped.
+type Follower struct {
+	db      *DB
+	url     string
+	client  *http.Client
+	logger  log.Logger
+	metrics *followerMetrics
+
+	// Position in the WAL of the leader. The segment is -1 until the
+	// first checkpoint or segment was fetched. The offset is the number of
+	// bytes fetched, which may include a partial record.
+	segment int
+	offset  int64
+	buf     bytes.Buffer
+	rdr     *wal.LiveReader
+}
+
+// followerPosition is the saved position of a follower. The offset is the
+// end of the last record of the segment that was applied.
+type followerPosition struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+const followerPositionFilename = "follower.json"
+
+type followerMetrics struct {
+	recordsApplied prometheus.Counter
+	fetchFailures  prometheus.Counter
+	segment        prometheus.Gauge
+}
+
+func newFollowerMetrics(r prometheus.Registerer) *followerMetrics {
+	m := &followerMetrics{}
+
+	m.recordsApplied = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_replication_records_applied_total",
+		Help: "Total number of WAL records replicated from the leader.",
+	})
+	m.fetchFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_replication_failures_total",
+		Help: "Total number of failed attempts to replicate from the leader.",
+	})
+	m.segment = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_replication_segment",
+		Help: "Index of the leader's WAL segment currently being replicated.",
+	})
+
+	if r != nil {
+		r.MustRegister(
+			m.recordsApplied,
+			m.fetchFailures,
+			m.segment,
+		)
+	}
+	return m
+}
+
+// NewFollower returns a follower that replicates the leader serving its
+// ReplicationHandler at the given URL into db. The DB becomes read-only.
+func NewFollower(l log.Logger, r prometheus.Registerer, db *DB, leaderURL string) (*Follower, error) {
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+	f := &Follower{
+		db:      db,
+		url:     strings.TrimSuffix(leaderURL, "/"),
+		client:  http.DefaultClient,
+		logger:  l,
+		metrics: newFollowerMetrics(r),
+		segment: -1,
+	}
+	pos, err := readFollowerPosition(db.Dir())
+	if err != nil {
+		return nil, errors.Wrap(err, "read follower position")
+	}
+	if pos != nil {
+		f.seek(pos.Segment, pos.Offset)
+	}
+	atomic.StoreUint32(&db.replica, 1)
+
+	return f, nil
+}
+
+// Run replicates the leader until the context is canceled.
+func (f *Follower) Run(ctx context.Context) {
+	for {
+		caughtUp, err := f.sync(ctx)
+		if err != nil {
+			f.metrics.fetchFailures.Inc()
+			level.Error(f.logger).Log("msg", "replicating from leader failed", "err", err)
+		}
+		if !caughtUp && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(followerPollInterval):
+		}
+	}
+}
+
+// Promote makes the DB writable. It must only be called after Run returned.
+// Writes continue with the series references of the leader.
+func (f *Follower) Promote() {
+	atomic.StoreUint32(&f.db.replica, 0)
+}
+
+// sync replicates the available data of the current segment. It returns true
+// if the follower caught up with the leader.
+func (f *Follower) sync(ctx context.Context) (bool, error) {
+	var st replicationState
+	if err := f.get(ctx, "/segments", func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&st)
+	}); err != nil {
+		return false, errors.Wrap(err, "get leader state")
+	}
+	// Start with the checkpoint or continue with it if the segments we were
+	// about to read were truncated.
+	if f.segment < st.FirstSegment {
+		if st.Checkpoint >= 0 && st.Checkpoint >= f.segment {
+			if err := f.syncCheckpoint(ctx); err != nil && err != ErrNotFound {
+				return false, err
+			}
+		}
+		if f.segment < st.FirstSegment {
+			if f.segment >= 0 {
+				level.Warn(f.logger).Log("msg", "leader truncated segments without checkpoint", "from", f.segment, "to", st.FirstSegment-1)
+			}
+			if err := f.setSegment(st.FirstSegment); err != nil {
+				return false, err
+			}
+		}
+	}
+	if st.LastSegment < 0 || f.segment > st.LastSegment {
+		return true, nil
+	}
+	// A later segment is only created after the current one was written completely.
+	done := st.LastSegment > f.segment
+
+	for {
+		var n int64
+		err := f.get(ctx, fmt.Sprintf("/segments/%d?offset=%d", f.segment, f.offset), func(resp *http.Response) (err error) {
+			n, err = io.Copy(&f.buf, resp.Body)
+			return err
+		})
+		if err == ErrNotFound {
+			return false, nil // Truncated in the meantime.
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "get segment %d", f.segment)
+		}
+		f.offset += n
+
+		applied, err := f.apply(f.rdr)
+		if err != nil {
+			return false, err
+		}
+		if applied > 0 {
+			if err := f.savePosition(f.segment, f.rdr.RecordEnd()); err != nil {
+				return false, err
+			}
+		}
+		if n < replicationMaxFetchSize {
+			break
+		}
+	}
+	if !done {
+		return true, nil
+	}
+	return false, f.setSegment(f.segment + 1)
+}
+
+func (f *Follower) syncCheckpoint(ctx context.Context) error {
+	return f.get(ctx, "/checkpoint", func(resp *http.Response) error {
+		idx, err := strconv.Atoi(resp.Header.Get(checkpointIndexHeader))
+		if err != nil {
+			return errors.Wrap(err, "invalid checkpoint index")
+		}
+		if _, err := f.apply(wal.NewReader(resp.Body)); err != nil {
+			return errors.Wrap(err, "apply checkpoint")
+		}
+		return f.setSegment(idx + 1)
+	})
+}
+
+// setSegment moves the follower to the start of the given segment and saves
+// the position.
+func (f *Follower) setSegment(i int) error {
+	f.seek(i, 0)
+	return f.savePosition(i, 0)
+}
+
+func (f *Follower) seek(segment int, offset int64) {
+	f.segment = segment
+	f.offset = offset
+	f.buf.Reset()
+	f.rdr = wal.NewLiveReaderAt(&f.buf, offset)
+	f.metrics.segment.Set(float64(segment))
+}
+
+// savePosition writes the position atomically to the DB directory.
+func (f *Follower) savePosition(segment int, offset int64) error {
+	path := filepath.Join(f.db.Dir(), followerPositionFilename)
+	tmp := path + ".tmp"
+
+	b, err := json.Marshal(followerPosition{Segment: segment, Offset: offset})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return errors.Wrap(err, "write follower position")
+	}
+	return renameFile(tmp, path)
+}
+
+// readFollowerPosition returns the saved position of a follower or nil if
+// there is none.
+func readFollowerPosition(dir string) (*followerPosition, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, followerPositionFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pos followerPosition
+	if err := json.Unmarshal(b, &pos); err != nil {
+		return nil, err
+	}
+	return &pos, nil
+}
+
+// apply applies the available records of r to the head and writes them to
+// the WAL. It returns the number of applied records.
+func (f *Follower) apply(r recordReader) (int, error) {
+	var recs [][]byte
+	for r.Next() {
+		recs = append(recs, append([]byte(nil), r.Record()...))
+	}
+	if err := r.Err(); err != nil {
+		return 0, errors.Wrap(err, "read records")
+	}
+	if len(recs) == 0 {
+		return 0, nil
+	}
+	if err := f.db.head.applyReplicated(recs); err != nil {
+		return 0, errors.Wrap(err, "apply records")
+	}
+	f.metrics.recordsApplied.Add(float64(len(recs)))
+	f.db.triggerCompaction()
+
+	return len(recs), nil
+}
+
+// applyReplicated applies records of a leader to the head and writes them to
+// the WAL. Unlike loadWAL, series and samples go through the same paths as
+// appends, so they get isolation append IDs, count towards the series limits
+// and are passed on to the listener and subscribers.
+func (h *Head) applyReplicated(recs [][]byte) error {
+	var (
+		dec     RecordDecoder
+		series  []RefSeries
+		samples []RefSample
+		tstones []Stone
+		dropped int
+		err     error
+	)
+	for _, rec := range recs {
+		switch dec.Type(rec) {
+		case RecordSeries:
+			series, err = dec.Series(rec, series[:0])
+			if err != nil {
+				return errors.Wrap(err, "decode series")
+			}
+			for _, s := range series {
+				h.getOrCreateWithID(s.Ref, s.Labels.Hash(), s.Labels)
+
+				if atomic.LoadUint64(&h.lastSeriesID) < s.Ref {
+					atomic.StoreUint64(&h.lastSeriesID, s.Ref)
+				}
+			}
+			if err := h.logReplicated(rec); err != nil {
+				return errors.Wrap(err, "log series")
+			}
+		case RecordSamples:
+			samples, err = dec.Samples(rec, samples[:0])
+			if err != nil {
+				return errors.Wrap(err, "decode samples")
+			}
+			if len(samples) == 0 {
+				continue
+			}
+			h.initTime(samples[0].T)
+			h.metrics.activeAppenders.Inc()
+
+			app := h.appender()
+			// The leader validated the samples when they were appended. Only
+			// drop samples the head no longer holds, like loadWAL does.
+			app.minValidTime = h.MinTime()
+
+			for _, s := range samples {
+				if app.AddFast(s.Ref, s.T, s.V) != nil {
+					dropped++
+				}
+			}
+			if err := app.Commit(); err != nil {
+				return errors.Wrap(err, "commit samples")
+			}
+		case RecordTombstones:
+			tstones, err = dec.Tombstones(rec, tstones[:0])
+			if err != nil {
+				return errors.Wrap(err, "decode tombstones")
+			}
+			// Like loadWAL, accept all tombstones while the head is empty.
+			mint := h.MinTime()
+			if mint == math.MaxInt64 {
+				mint = math.MinInt64
+			}
+			for _, s := range tstones {
+				for _, itv := range s.intervals {
+					if itv.Maxt < mint {
+						continue
+					}
+					h.tombstones.addInterval(s.ref, itv)
+				}
+			}
+			if err := h.logReplicated(rec); err != nil {
+				return errors.Wrap(err, "log tombstones")
+			}
+		default:
+			return errors.Errorf("invalid record type %v", dec.Type(rec))
+		}
+	}
+	if dropped > 0 {
+		level.Warn(h.logger).Log("msg", "dropped replicated samples", "count", dropped)
+	}
+	return nil
+}
+
+func (h *Head) logReplicated(rec []byte) error {
+	if h.wal == nil {
+		return nil
+	}
+	return h.wal.Log(rec)
+}
+
+// get requests the given path from the leader and passes a successful
+// response to f. It returns ErrNotFound if the leader does not have the
+// requested resource.
+func (f *Follower) get(ctx context.Context, path string, fn func(*http.Response) error) error {
+	req, err := http.NewRequest(http.MethodGet, f.url+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return fn(resp)
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/prometheus/tsdb/wal"
+)
+
+func TestFollower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_replication")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	// Prepare a WAL with a checkpoint and several segments for the leader.
+	w, err := wal.NewSize(nil, nil, filepath.Join(dir, "leader", "wal"), 32*1024)
+	testutil.Ok(t, err)
+	h, err := NewHead(nil, nil, w, 1000)
+	testutil.Ok(t, err)
+	testutil.Ok(t, h.Init())
+
+	for i := 0; i < 5000; i++ {
+		app := h.Appender()
+		for _, v := range []string{"1", "2", "3"} {
+			_, err := app.Add(labels.FromStrings("a", v), int64(i), float64(i))
+			testutil.Ok(t, err)
+		}
+		testutil.Ok(t, app.Commit())
+	}
+	testutil.Ok(t, h.Truncate(2500))
+	testutil.Ok(t, h.Close())
+
+	_, _, err = LastCheckpoint(filepath.Join(dir, "leader", "wal"))
+	testutil.Ok(t, err)
+
+	leader, err := Open(filepath.Join(dir, "leader"), nil, nil, nil)
+	testutil.Ok(t, err)
+	defer leader.Close()
+
+	srv := httptest.NewServer(leader.ReplicationHandler())
+	defer srv.Close()
+
+	follower, err := Open(filepath.Join(dir, "follower"), nil, nil, nil)
+	testutil.Ok(t, err)
+	defer follower.Close()
+
+	f, err := NewFollower(nil, nil, follower, srv.URL)
+	testutil.Ok(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	donec := make(chan struct{})
+	go func() {
+		f.Run(ctx)
+		close(donec)
+	}()
+
+	// The follower catches up with the leader and keeps following it.
+	waitReplicated := func() map[string][]sample {
+		var exp, got map[string][]sample
+
+		for i := 0; i < 100; i++ {
+			q, err := leader.Querier(math.MinInt64, math.MaxInt64)
+			testutil.Ok(t, err)
+			exp = query(t, q, labels.NewMustRegexpMatcher("a", ".*"))
+			testutil.Ok(t, q.Close())
+
+			q, err = follower.Querier(math.MinInt64, math.MaxInt64)
+			testutil.Ok(t, err)
+			got = query(t, q, labels.NewMustRegexpMatcher("a", ".*"))
+			testutil.Ok(t, q.Close())
+
+			if reflect.DeepEqual(exp, got) {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		testutil.Equals(t, exp, got)
+		return got
+	}
+	res := waitReplicated()
+	testutil.Equals(t, 3, len(res))
+
+	// Replicated samples are passed on to subscribers of the follower.
+	subc, cancelSub := follower.Head().Subscribe(labels.NewEqualMatcher("a", "4"))
+	defer cancelSub()
+
+	app := leader.Appender()
+	for i := 5000; i < 5100; i++ {
+		_, err := app.Add(labels.FromStrings("a", "4"), int64(i), float64(i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	res = waitReplicated()
+	testutil.Equals(t, 4, len(res))
+	testutil.Equals(t, 100, len(res[`{a="4"}`]))
+
+	select {
+	case smpls := <-subc:
+		testutil.Equals(t, 100, len(smpls))
+	case <-time.After(5 * time.Second):
+		t.Fatalf("replicated samples were not published")
+	}
+
+	// Writes to the follower are rejected until it is promoted.
+	_, err = follower.Appender().Add(labels.FromStrings("a", "5"), 6000, 1)
+	testutil.Equals(t, ErrReadOnly, err)
+	testutil.Equals(t, ErrReadOnly, follower.Delete(0, 1000, labels.NewEqualMatcher("a", "1")))
+
+	cancel()
+	<-donec
+	f.Promote()
+
+	app = follower.Appender()
+	_, err = app.Add(labels.FromStrings("a", "5"), 6000, 1)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("a", "4"), 6000, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	q, err := follower.Querier(math.MinInt64, math.MaxInt64)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	res = query(t, q, labels.NewMustRegexpMatcher("a", ".*"))
+	testutil.Equals(t, 5, len(res))
+	testutil.Equals(t, 101, len(res[`{a="4"}`]))
+	testutil.Equals(t, []sample{{t: 6000, v: 1}}, res[`{a="5"}`])
+}
+
+func TestFollower_Restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_replication")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	leader, err := Open(filepath.Join(dir, "leader"), nil, nil, nil)
+	testutil.Ok(t, err)
+	defer leader.Close()
+
+	srv := httptest.NewServer(leader.ReplicationHandler())
+	defer srv.Close()
+
+	appendSeries := func(v string) {
+		app := leader.Appender()
+		for i := 0; i < 100; i++ {
+			_, err := app.Add(labels.FromStrings("a", v), int64(i), float64(i))
+			testutil.Ok(t, err)
+		}
+		testutil.Ok(t, app.Commit())
+	}
+	// replicate opens the follower DB and replicates the leader until the DB
+	// holds the given number of series. It returns the records of its WAL.
+	replicate := func(series int) []interface{} {
+		db, err := Open(filepath.Join(dir, "follower"), nil, nil, nil)
+		testutil.Ok(t, err)
+
+		f, err := NewFollower(nil, nil, db, srv.URL)
+		testutil.Ok(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		donec := make(chan struct{})
+		go func() {
+			f.Run(ctx)
+			close(donec)
+		}()
+
+		var res map[string][]sample
+		for i := 0; i < 100; i++ {
+			q, err := db.Querier(math.MinInt64, math.MaxInt64)
+			testutil.Ok(t, err)
+			res = query(t, q, labels.NewMustRegexpMatcher("a", ".*"))
+			testutil.Ok(t, q.Close())
+
+			if len(res) == series {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		cancel()
+		<-donec
+
+		testutil.Equals(t, series, len(res))
+		testutil.Ok(t, db.Close())
+
+		return readTestWAL(t, filepath.Join(dir, "follower", "wal"))
+	}
+
+	appendSeries("1")
+	testutil.Equals(t, 2, len(replicate(1)))
+
+	// The restarted follower continues after the records it already applied.
+	appendSeries("2")
+	testutil.Equals(t, 4, len(replicate(2)))
+}
+
+func TestFollower_RestartWithinRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_replication")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	leader, err := Open(filepath.Join(dir, "leader"), nil, nil, nil)
+	testutil.Ok(t, err)
+	defer leader.Close()
+
+	// Write a small record followed by a samples record spanning several pages.
+	for _, n := range []int{100, 5000} {
+		app := leader.Appender()
+		for i := 0; i < n; i++ {
+			_, err := app.Add(labels.FromStrings("a", strconv.Itoa(n)), int64(i), float64(i))
+			testutil.Ok(t, err)
+		}
+		testutil.Ok(t, app.Commit())
+	}
+	_, last, err := leader.head.wal.Segments()
+	testutil.Ok(t, err)
+	fi, err := os.Stat(wal.SegmentName(leader.head.wal.Dir(), last))
+	testutil.Ok(t, err)
+	testutil.Assert(t, fi.Size() > 32*1024, "expected samples record to span several pages")
+
+	// The leader initially only serves the segment up to the middle of the
+	// large record, as if it was still being written.
+	limit := fi.Size() - 16*1024
+	handler := leader.ReplicationHandler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		body := rec.Body.Bytes()
+		limit := atomic.LoadInt64(&limit)
+		if off, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64); err == nil && limit > 0 {
+			if n := limit - off; n < int64(len(body)) {
+				body = body[:n]
+			}
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	// replicate opens the follower DB and replicates the leader until the DB
+	// holds the given number of samples.
+	replicate := func(samples int) {
+		db, err := Open(filepath.Join(dir, "follower"), nil, nil, nil)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, db.Close()) }()
+
+		f, err := NewFollower(nil, nil, db, srv.URL)
+		testutil.Ok(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		donec := make(chan struct{})
+		go func() {
+			f.Run(ctx)
+			close(donec)
+		}()
+		defer func() {
+			cancel()
+			<-donec
+		}()
+
+		var got int
+		for i := 0; i < 100; i++ {
+			q, err := db.Querier(math.MinInt64, math.MaxInt64)
+			testutil.Ok(t, err)
+			got = 0
+			for _, s := range query(t, q, labels.NewMustRegexpMatcher("a", ".*")) {
+				got += len(s)
+			}
+			testutil.Ok(t, q.Close())
+
+			if got == samples {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		testutil.Equals(t, samples, got)
+	}
+
+	replicate(100)
+
+	// The restarted follower reads the large record from its start.
+	atomic.StoreInt64(&limit, 0)
+	replicate(5100)
+}
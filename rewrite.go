@@ -0,0 +1,254 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/relabel"
+)
+
+// Rewrite writes a copy of the block into dest with the relabel configs
+// applied to all series. Dropped series are left out and series with the same
+// labels after relabeling are merged. Deleted data is not copied.
+// The new block has the rewritten one as its parent so that the latter is
+// deleted on the next reload of the DB.
+func (c *LeveledCompactor) Rewrite(dest string, b BlockReader, parent *BlockMeta, cfgs ...*relabel.Config) (ulid.ULID, error) {
+	for i, cfg := range cfgs {
+		if err := cfg.Validate(); err != nil {
+			return ulid.ULID{}, errors.Wrapf(err, "relabel config %d", i)
+		}
+	}
+	entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
+	uid := ulid.MustNew(ulid.Now(), entropy)
+
+	meta := &BlockMeta{
+		ULID:    uid,
+		MinTime: parent.MinTime,
+		MaxTime: parent.MaxTime,
+	}
+	meta.Compaction.Level = parent.Compaction.Level
+	meta.Compaction.Sources = parent.Compaction.Sources
+	meta.Compaction.Parents = []BlockDesc{
+		{ULID: parent.ULID, MinTime: parent.MinTime, MaxTime: parent.MaxTime},
+	}
+
+	err := c.writeBlock(dest, meta, func(indexw IndexWriter, chunkw ChunkWriter) error {
+		return c.populateRewrittenBlock(b, meta, cfgs, indexw, chunkw)
+	})
+	if err != nil {
+		return uid, err
+	}
+	level.Info(c.logger).Log("msg", "rewrite block", "parent", parent.ULID, "ulid", uid, "series", meta.Stats.NumSeries)
+	return uid, nil
+}
+
+// rewrittenSeries collects the chunks of all series with the same labels
+// after relabeling.
+type rewrittenSeries struct {
+	lset   labels.Labels
+	chks   []chunks.Meta
+	merged bool
+}
+
+// populateRewrittenBlock fills the index and chunk writers with the relabeled
+// series of the block.
+func (c *LeveledCompactor) populateRewrittenBlock(b BlockReader, meta *BlockMeta, cfgs []*relabel.Config, indexw IndexWriter, chunkw ChunkWriter) error {
+	var closers []io.Closer
+	defer func() { closeAll(closers...) }()
+
+	indexr, err := b.Index()
+	if err != nil {
+		return errors.Wrapf(err, "open index reader for block %s", b)
+	}
+	closers = append(closers, indexr)
+
+	chunkr, err := b.Chunks()
+	if err != nil {
+		return errors.Wrapf(err, "open chunk reader for block %s", b)
+	}
+	closers = append(closers, chunkr)
+
+	tombsr, err := b.Tombstones()
+	if err != nil {
+		return errors.Wrapf(err, "open tombstone reader for block %s", b)
+	}
+	closers = append(closers, tombsr)
+
+	all, err := indexr.Postings(index.AllPostingsKey())
+	if err != nil {
+		return err
+	}
+	set := newCompactionSeriesSet(indexr, chunkr, tombsr, indexr.SortedPostings(all))
+
+	var (
+		series  []*rewrittenSeries
+		byHash  = map[uint64][]*rewrittenSeries{}
+		symbols = map[string]struct{}{}
+	)
+Outer:
+	for set.Next() {
+		lset, chks, dranges := set.At()
+
+		lset = relabel.Process(lset, cfgs...)
+		if lset == nil {
+			continue
+		}
+		// The series set reuses its chunks slice.
+		chks = append([]chunks.Meta(nil), chks...)
+
+		for i := range chks {
+			if err := removeDeleted(&chks[i], dranges); err != nil {
+				return err
+			}
+		}
+		h := lset.Hash()
+		for _, s := range byHash[h] {
+			if s.lset.Equals(lset) {
+				s.chks = append(s.chks, chks...)
+				s.merged = true
+				continue Outer
+			}
+		}
+		s := &rewrittenSeries{lset: lset, chks: chks}
+		byHash[h] = append(byHash[h], s)
+		series = append(series, s)
+
+		for _, l := range lset {
+			symbols[l.Name] = struct{}{}
+			symbols[l.Value] = struct{}{}
+		}
+	}
+	if set.Err() != nil {
+		return errors.Wrap(set.Err(), "iterate block series")
+	}
+	// Relabeling may change the order of the series.
+	sort.Slice(series, func(i, j int) bool {
+		return labels.Compare(series[i].lset, series[j].lset) < 0
+	})
+
+	if err := indexw.AddSymbols(symbols); err != nil {
+		return errors.Wrap(err, "add symbols")
+	}
+	var (
+		postings = index.NewMemPostings()
+		values   = map[string]stringset{}
+		ref      = uint64(0)
+	)
+	for _, s := range series {
+		chks := s.chks
+		if s.merged {
+			if chks, err = mergeChunks(chks); err != nil {
+				return errors.Wrapf(err, "merge chunks of series %s", s.lset)
+			}
+		}
+		if len(chks) == 0 {
+			continue
+		}
+		if err := chunkw.WriteChunks(chks...); err != nil {
+			return errors.Wrap(err, "write chunks")
+		}
+		if err := indexw.AddSeries(ref, s.lset, chks...); err != nil {
+			return errors.Wrap(err, "add series")
+		}
+
+		meta.Stats.NumChunks += uint64(len(chks))
+		meta.Stats.NumSeries++
+		for _, chk := range chks {
+			meta.Stats.NumSamples += uint64(chk.Chunk.NumSamples())
+
+			if err := c.chunkPool.Put(chk.Chunk); err != nil {
+				return errors.Wrap(err, "put chunk")
+			}
+		}
+
+		for _, l := range s.lset {
+			valset, ok := values[l.Name]
+			if !ok {
+				valset = stringset{}
+				values[l.Name] = valset
+			}
+			valset.set(l.Value)
+		}
+		postings.Add(ref, s.lset)
+
+		ref++
+	}
+	return writePostings(indexw, values, postings)
+}
+
+// mergeChunks sorts the chunks of series merged by relabeling by time.
+// Overlapping chunks are re-encoded. Of samples with the same timestamp
+// only the first one is kept.
+func mergeChunks(chks []chunks.Meta) ([]chunks.Meta, error) {
+	sort.SliceStable(chks, func(i, j int) bool {
+		return chks[i].MinTime < chks[j].MinTime
+	})
+	overlapping := false
+	for i := 1; i < len(chks); i++ {
+		if chks[i].MinTime <= chks[i-1].MaxTime {
+			overlapping = true
+			break
+		}
+	}
+	if !overlapping {
+		return chks, nil
+	}
+
+	var smpls []sample
+	for _, chk := range chks {
+		it := chk.Chunk.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			smpls = append(smpls, sample{t: t, v: v})
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(smpls, func(i, j int) bool {
+		return smpls[i].t < smpls[j].t
+	})
+
+	var (
+		res []chunks.Meta
+		app chunkenc.Appender
+		err error
+	)
+	for i, s := range smpls {
+		if i > 0 && s.t == smpls[i-1].t {
+			continue
+		}
+		if app == nil || res[len(res)-1].Chunk.NumSamples() >= DefaultSamplesPerChunk {
+			c := chunkenc.NewXORChunk()
+			if app, err = c.Appender(); err != nil {
+				return nil, err
+			}
+			res = append(res, chunks.Meta{Chunk: c, MinTime: s.t})
+		}
+		app.Append(s.t, s.v)
+		res[len(res)-1].MaxTime = s.t
+	}
+	return res, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/relabel"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/prometheus/tsdb/tsdbutil"
+)
+
+func TestLeveledCompactor_Rewrite(t *testing.T) {
+	db, closeFn := openTestDB(t, &Options{
+		BlockRanges:      []int64{1000},
+		NoAutoCompaction: true,
+	})
+	defer closeFn()
+
+	app := db.Appender()
+	for i := int64(0); i < 3000; i += 100 {
+		_, err := app.Add(labels.FromStrings("job", "api", "pod_id", "1"), i, 1)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("job", "api", "pod_id", "2"), i+50, 2)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("job", "noisy"), i, 3)
+		testutil.Ok(t, err)
+	}
+	// Collides with the sample of the first pod after relabeling.
+	_, err := app.Add(labels.FromStrings("job", "api", "pod_id", "2"), 0, 2)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.Compact())
+
+	blocks := db.Blocks()
+	testutil.Assert(t, len(blocks) > 0, "no block was compacted")
+	parent := blocks[0].Meta()
+
+	dir := db.Dir()
+	testutil.Ok(t, db.Close())
+
+	b, err := OpenBlock(blocks[0].Dir(), nil)
+	testutil.Ok(t, err)
+
+	c, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{1000}, nil)
+	testutil.Ok(t, err)
+
+	uid, err := c.Rewrite(dir, b, &parent,
+		&relabel.Config{
+			SourceLabels: []string{"job"},
+			Regex:        relabel.MustNewRegexp("noisy"),
+			Action:       relabel.Drop,
+		},
+		&relabel.Config{
+			Regex:  relabel.MustNewRegexp("pod_id"),
+			Action: relabel.LabelDrop,
+		},
+	)
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Close())
+
+	db, err = Open(dir, nil, nil, &Options{
+		BlockRanges:      []int64{1000},
+		NoAutoCompaction: true,
+	})
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	// The rewritten block replaces its parent.
+	for _, b := range db.Blocks() {
+		testutil.Assert(t, b.Meta().ULID != parent.ULID, "parent block was not deleted")
+	}
+	rewritten := db.Blocks()[0].Meta()
+	testutil.Equals(t, uid, rewritten.ULID)
+	testutil.Equals(t, parent.MinTime, rewritten.MinTime)
+	testutil.Equals(t, parent.MaxTime, rewritten.MaxTime)
+	testutil.Equals(t, uint64(1), rewritten.Stats.NumSeries)
+
+	q, err := db.Querier(parent.MinTime, parent.MaxTime-1)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	exp := []sample{{t: 0, v: 1}}
+	for i := int64(50); i < parent.MaxTime; i += 50 {
+		v := 1.0
+		if i%100 != 0 {
+			v = 2
+		}
+		exp = append(exp, sample{t: i, v: v})
+	}
+	res := query(t, q, labels.NewMustRegexpMatcher("job", ".*"))
+	testutil.Equals(t, map[string][]sample{`{job="api"}`: exp}, res)
+}
+
+func TestMergeChunks(t *testing.T) {
+	chk := func(smpls ...tsdbutil.Sample) chunks.Meta {
+		return tsdbutil.ChunkFromSamples(smpls)
+	}
+	// Chunks that do not overlap are only sorted.
+	a, b := chk(sample{t: 10, v: 1}, sample{t: 20, v: 1}), chk(sample{t: 0, v: 2}, sample{t: 5, v: 2})
+	res, err := mergeChunks([]chunks.Meta{a, b})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []chunks.Meta{b, a}, res)
+
+	res, err = mergeChunks([]chunks.Meta{
+		chk(sample{t: 0, v: 1}, sample{t: 20, v: 1}),
+		chk(sample{t: 0, v: 2}, sample{t: 10, v: 2}, sample{t: 30, v: 2}),
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(res))
+	testutil.Equals(t, int64(0), res[0].MinTime)
+	testutil.Equals(t, int64(30), res[0].MaxTime)
+
+	var got []sample
+	it := res[0].Chunk.Iterator()
+	for it.Next() {
+		t, v := it.At()
+		got = append(got, sample{t: t, v: v})
+	}
+	testutil.Ok(t, it.Err())
+	testutil.Equals(t, []sample{{0, 1}, {10, 2}, {20, 1}, {30, 2}}, got)
+}
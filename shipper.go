@@ -0,0 +1,175 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/objstore"
+)
+
+// shipperDirname is the directory within the DB directory that holds
+// hardlinked copies of blocks while they are being uploaded.
+const shipperDirname = "shipper"
+
+// Shipper uploads the persisted blocks of a DB to an object storage bucket.
+type Shipper struct {
+	db      *DB
+	bucket  objstore.Bucket
+	logger  log.Logger
+	metrics *shipperMetrics
+
+	mtx     sync.Mutex
+	shipped map[ulid.ULID]struct{}
+
+	notifyc chan struct{}
+}
+
+type shipperMetrics struct {
+	uploads        prometheus.Counter
+	uploadFailures prometheus.Counter
+}
+
+func newShipperMetrics(r prometheus.Registerer) *shipperMetrics {
+	m := &shipperMetrics{}
+
+	m.uploads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_shipper_uploads_total",
+		Help: "Total number of blocks uploaded to the bucket.",
+	})
+	m.uploadFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_shipper_upload_failures_total",
+		Help: "Total number of block uploads that failed.",
+	})
+
+	if r != nil {
+		r.MustRegister(
+			m.uploads,
+			m.uploadFailures,
+		)
+	}
+	return m
+}
+
+// NewShipper returns a new shipper that uploads the blocks of db to the bucket.
+// The shipper is notified whenever the DB reloads its blocks.
+func NewShipper(l log.Logger, r prometheus.Registerer, db *DB, bkt objstore.Bucket) *Shipper {
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+	s := &Shipper{
+		db:      db,
+		bucket:  bkt,
+		logger:  l,
+		metrics: newShipperMetrics(r),
+		shipped: map[ulid.ULID]struct{}{},
+		notifyc: make(chan struct{}, 1),
+	}
+	db.onReload(func() {
+		select {
+		case s.notifyc <- struct{}{}:
+		default:
+		}
+	})
+	return s
+}
+
+// Run uploads new blocks after each reload of the DB until the context is canceled.
+func (s *Shipper) Run(ctx context.Context) {
+	for {
+		if _, err := s.Sync(ctx); err != nil {
+			level.Error(s.logger).Log("msg", "shipping blocks failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.notifyc:
+		}
+	}
+}
+
+// Sync uploads all blocks of the DB that do not exist in the bucket yet.
+// It returns the number of uploaded blocks.
+func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var merr MultiError
+
+	for _, b := range s.db.Blocks() {
+		id := b.Meta().ULID
+
+		if _, ok := s.shipped[id]; ok {
+			continue
+		}
+		// A block without meta file was not uploaded completely.
+		_, err := s.bucket.ObjectSize(ctx, path.Join(id.String(), metaFilename))
+		if err == nil {
+			s.shipped[id] = struct{}{}
+			continue
+		}
+		if !s.bucket.IsObjNotFoundErr(err) {
+			merr.Add(errors.Wrapf(err, "check meta file of block %s", id))
+			continue
+		}
+		if err := s.upload(ctx, b); err != nil {
+			s.metrics.uploadFailures.Inc()
+			merr.Add(errors.Wrapf(err, "upload block %s", id))
+			continue
+		}
+		s.metrics.uploads.Inc()
+		s.shipped[id] = struct{}{}
+		uploaded++
+
+		level.Info(s.logger).Log("msg", "uploaded block", "ulid", id)
+	}
+	return uploaded, merr.Err()
+}
+
+// upload uploads a hardlinked snapshot of the block to the bucket. The meta file is
+// uploaded last, which marks the block as complete for readers.
+func (s *Shipper) upload(ctx context.Context, b *Block) error {
+	dir := filepath.Join(s.db.Dir(), shipperDirname)
+
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrap(err, "clean shipper dir")
+	}
+	defer os.RemoveAll(dir)
+
+	if err := b.Snapshot(dir); err != nil {
+		return errors.Wrap(err, "snapshot block")
+	}
+	var (
+		id       = b.Meta().ULID.String()
+		blockDir = filepath.Join(dir, id)
+	)
+	if err := objstore.UploadDir(ctx, s.bucket, chunkDir(blockDir), path.Join(id, "chunks")); err != nil {
+		return err
+	}
+	for _, fn := range []string{indexFilename, tombstoneFilename, metaFilename} {
+		if err := objstore.UploadFile(ctx, s.bucket, filepath.Join(blockDir, fn), path.Join(id, fn)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
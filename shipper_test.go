@@ -0,0 +1,205 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/objstore"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+// writeTestBlock writes a block with nSeries series of nSamples samples each into dir.
+func writeTestBlock(t testing.TB, dir string, nSeries, nSamples int) ulid.ULID {
+	head, err := NewHead(nil, nil, nil, 2*60*60*1000)
+	testutil.Ok(t, err)
+	defer head.Close()
+
+	app := head.Appender()
+	for i := 0; i < nSeries; i++ {
+		lset := labels.FromStrings("a", "b", "series", fmt.Sprintf("series-%05d", i))
+
+		for j := 0; j < nSamples; j++ {
+			_, err := app.Add(lset, int64(j*1000), float64(i*j))
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	compactor, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{1000000}, nil)
+	testutil.Ok(t, err)
+
+	id, err := compactor.Write(dir, head, head.MinTime(), head.MaxTime()+1, nil)
+	testutil.Ok(t, err)
+	return id
+}
+
+func TestShipper_Sync(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	ctx := context.Background()
+
+	dbDir := filepath.Join(tmpdir, "db")
+	testutil.Ok(t, os.MkdirAll(dbDir, 0777))
+	id := writeTestBlock(t, dbDir, 10, 100)
+
+	db, err := Open(dbDir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	bkt, err := objstore.NewFilesystemBucket(filepath.Join(tmpdir, "bucket"))
+	testutil.Ok(t, err)
+
+	s := NewShipper(nil, nil, db, bkt)
+
+	uploaded, err := s.Sync(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, uploaded)
+
+	for _, fn := range []string{metaFilename, indexFilename, tombstoneFilename, "chunks/000001"} {
+		_, err := bkt.ObjectSize(ctx, path.Join(id.String(), fn))
+		testutil.Ok(t, err)
+	}
+	// Blocks are not uploaded twice.
+	uploaded, err = s.Sync(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, uploaded)
+
+	// The temporary snapshot is removed after the upload.
+	_, err = os.Stat(filepath.Join(dbDir, shipperDirname))
+	testutil.Assert(t, os.IsNotExist(err), "shipper dir was not removed")
+
+	// A block without meta file is considered incomplete and uploaded again.
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(id.String(), metaFilename)))
+
+	s = NewShipper(nil, nil, db, bkt)
+	uploaded, err = s.Sync(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, uploaded)
+}
+
+func TestRemoteBlock(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	ctx := context.Background()
+
+	blockDir := filepath.Join(tmpdir, "blocks")
+	testutil.Ok(t, os.MkdirAll(blockDir, 0777))
+	// Write enough series for the index to span multiple pages.
+	id := writeTestBlock(t, blockDir, 1000, 150)
+
+	bkt, err := objstore.NewFilesystemBucket(filepath.Join(tmpdir, "bucket"))
+	testutil.Ok(t, err)
+	testutil.Ok(t, objstore.UploadDir(ctx, bkt, filepath.Join(blockDir, id.String()), id.String()))
+
+	local, err := OpenBlock(filepath.Join(blockDir, id.String()), nil)
+	testutil.Ok(t, err)
+	defer local.Close()
+
+	remote, err := OpenRemoteBlock(ctx, bkt, id, nil)
+	testutil.Ok(t, err)
+	defer remote.Close()
+
+	testutil.Equals(t, local.Meta(), remote.Meta())
+
+	for _, m := range []labels.Matcher{
+		labels.NewEqualMatcher("series", "series-00042"),
+		labels.NewMustRegexpMatcher("series", "series-009.*"),
+		labels.NewEqualMatcher("a", "b"),
+	} {
+		lq, err := NewBlockQuerier(local, 0, 150000)
+		testutil.Ok(t, err)
+		rq, err := NewBlockQuerier(remote, 0, 150000)
+		testutil.Ok(t, err)
+
+		exp := query(t, lq, m)
+		testutil.Assert(t, len(exp) > 0, "expected results for %v", m)
+		testutil.Equals(t, exp, query(t, rq, m))
+
+		testutil.Ok(t, lq.Close())
+		testutil.Ok(t, rq.Close())
+	}
+}
+
+// flakyBucket fails all range reads while fail is set.
+type flakyBucket struct {
+	objstore.Bucket
+	fail bool
+}
+
+func (b *flakyBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if b.fail {
+		return nil, errors.New("flaky bucket")
+	}
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+func TestRemoteBlock_FetchError(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	ctx := context.Background()
+
+	blockDir := filepath.Join(tmpdir, "blocks")
+	testutil.Ok(t, os.MkdirAll(blockDir, 0777))
+	id := writeTestBlock(t, blockDir, 1000, 150)
+
+	fs, err := objstore.NewFilesystemBucket(filepath.Join(tmpdir, "bucket"))
+	testutil.Ok(t, err)
+	testutil.Ok(t, objstore.UploadDir(ctx, fs, filepath.Join(blockDir, id.String()), id.String()))
+
+	bkt := &flakyBucket{Bucket: fs}
+	remote, err := OpenRemoteBlock(ctx, bkt, id, nil)
+	testutil.Ok(t, err)
+	defer remote.Close()
+
+	ir, err := remote.Index()
+	testutil.Ok(t, err)
+	defer ir.Close()
+
+	p, err := ir.Postings("series", "series-00800")
+	testutil.Ok(t, err)
+	testutil.Assert(t, p.Next(), "expected postings")
+	testutil.Ok(t, p.Err())
+
+	// Reading a series that was not fetched yet fails while the bucket does,
+	// but the failure must not stick to later reads of the block.
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	bkt.fail = true
+	testutil.NotOk(t, ir.Series(p.At(), &lset, &chks))
+
+	bkt.fail = false
+	testutil.Ok(t, ir.Series(p.At(), &lset, &chks))
+	testutil.Equals(t, labels.FromStrings("a", "b", "series", "series-00800"), lset)
+}
@@ -0,0 +1,266 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// CommittedSample is a committed sample of a series delivered to subscribers.
+type CommittedSample struct {
+	Ref    uint64
+	Labels labels.Labels
+	T      int64
+	V      float64
+}
+
+// SubscriptionPolicy defines how the head handles subscribers that do not
+// keep up with the committed samples.
+type SubscriptionPolicy int
+
+const (
+	// SubscriptionDrop drops the samples of a commit for a subscriber whose
+	// buffer is full. Appenders are never blocked by subscribers.
+	SubscriptionDrop SubscriptionPolicy = iota
+	// SubscriptionBlock blocks commits until all matching subscribers have
+	// buffer space again or cancel their subscription.
+	SubscriptionBlock
+)
+
+// DefaultSubscriptionBufferSize is the number of commits buffered for a
+// subscriber if no size is configured.
+const DefaultSubscriptionBufferSize = 256
+
+// subscriber receives the samples of the series matching its matchers.
+type subscriber struct {
+	matchers []labels.Matcher
+	ch       chan []CommittedSample
+	donec    chan struct{}
+
+	mtx  sync.RWMutex
+	refs map[uint64]struct{}
+}
+
+func (s *subscriber) addRef(ref uint64) {
+	s.mtx.Lock()
+	s.refs[ref] = struct{}{}
+	s.mtx.Unlock()
+}
+
+func (s *subscriber) removeRef(ref uint64) {
+	s.mtx.Lock()
+	delete(s.refs, ref)
+	s.mtx.Unlock()
+}
+
+func (s *subscriber) matches(ref uint64) bool {
+	s.mtx.RLock()
+	_, ok := s.refs[ref]
+	s.mtx.RUnlock()
+	return ok
+}
+
+// subscriptions are the subscribers of a head.
+type subscriptions struct {
+	policy     SubscriptionPolicy
+	bufferSize int
+	metrics    *headMetrics
+
+	mtx    sync.RWMutex
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+func newSubscriptions(policy SubscriptionPolicy, size int, m *headMetrics) *subscriptions {
+	if size <= 0 {
+		size = DefaultSubscriptionBufferSize
+	}
+	return &subscriptions{
+		policy:     policy,
+		bufferSize: size,
+		metrics:    m,
+		subs:       map[*subscriber]struct{}{},
+	}
+}
+
+func (s *subscriptions) empty() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return len(s.subs) == 0
+}
+
+// add registers a new subscriber. It returns nil if the subscriptions were closed.
+func (s *subscriptions) add(ms []labels.Matcher) *subscriber {
+	sub := &subscriber{
+		matchers: ms,
+		ch:       make(chan []CommittedSample, s.bufferSize),
+		donec:    make(chan struct{}),
+		refs:     map[uint64]struct{}{},
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.subs[sub] = struct{}{}
+	s.metrics.subscriptions.Inc()
+
+	return sub
+}
+
+// cancel unregisters the subscriber and closes its channel.
+func (s *subscriptions) cancel(sub *subscriber) {
+	// Unblock a commit waiting for the subscriber before acquiring the lock.
+	close(sub.donec)
+
+	s.mtx.Lock()
+	delete(s.subs, sub)
+	s.mtx.Unlock()
+
+	close(sub.ch)
+	s.metrics.subscriptions.Dec()
+}
+
+// seriesCreated registers a new series with all subscribers it matches.
+func (s *subscriptions) seriesCreated(ref uint64, lset labels.Labels) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for sub := range s.subs {
+		if matchLabels(sub.matchers, lset) {
+			sub.addRef(ref)
+		}
+	}
+}
+
+// seriesRemoved unregisters a removed series from all subscribers.
+func (s *subscriptions) seriesRemoved(ref uint64) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for sub := range s.subs {
+		sub.removeRef(ref)
+	}
+}
+
+// publish sends the committed samples to all subscribers of their series.
+func (s *subscriptions) publish(samples []RefSample) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for sub := range s.subs {
+		var batch []CommittedSample
+
+		for _, rs := range samples {
+			if !sub.matches(rs.Ref) {
+				continue
+			}
+			batch = append(batch, CommittedSample{
+				Ref:    rs.Ref,
+				Labels: rs.series.lset,
+				T:      rs.T,
+				V:      rs.V,
+			})
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if s.policy == SubscriptionBlock {
+			select {
+			case sub.ch <- batch:
+			case <-sub.donec:
+			}
+			continue
+		}
+		select {
+		case sub.ch <- batch:
+		default:
+			s.metrics.subscriptionSamplesDropped.Add(float64(len(batch)))
+		}
+	}
+}
+
+// closeAll cancels all subscriptions and rejects new ones.
+func (s *subscriptions) closeAll() {
+	s.mtx.Lock()
+	s.closed = true
+	subs := make([]*subscriber, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.mtx.Unlock()
+
+	for _, sub := range subs {
+		s.cancel(sub)
+	}
+}
+
+func matchLabels(ms []labels.Matcher, lset labels.Labels) bool {
+	for _, m := range ms {
+		if !m.Matches(lset.Get(m.Name())) {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe returns a channel receiving the samples of all series matching
+// the matchers right after they were committed. Without matchers all series
+// are matched. Samples of a single commit are delivered together, samples of
+// concurrent commits may arrive out of order.
+// If the subscriber falls behind, samples are dropped or commits are blocked
+// depending on the subscription policy of the head.
+// The returned function cancels the subscription and closes the channel.
+// The channel is closed right away if the head is closed.
+func (h *Head) Subscribe(ms ...labels.Matcher) (<-chan []CommittedSample, func()) {
+	// Register the subscriber before resolving the existing series so that
+	// series created in the meantime are not missed.
+	sub := h.subs.add(ms)
+	if sub == nil {
+		ch := make(chan []CommittedSample)
+		close(ch)
+		return ch, func() {}
+	}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { h.subs.cancel(sub) })
+	}
+
+	p, err := h.subscriptionPostings(ms)
+	if err == nil {
+		for p.Next() {
+			sub.addRef(p.At())
+		}
+		err = p.Err()
+	}
+	if err != nil {
+		level.Error(h.logger).Log("msg", "resolve series for subscription", "err", err)
+		cancel()
+	}
+	return sub.ch, cancel
+}
+
+func (h *Head) subscriptionPostings(ms []labels.Matcher) (index.Postings, error) {
+	if len(ms) == 0 {
+		return h.postings.Get(index.AllPostingsKey()), nil
+	}
+	return PostingsForMatchers(h.indexRange(math.MinInt64, math.MaxInt64), ms...)
+}
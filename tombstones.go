@@ -113,6 +113,12 @@ type Stone struct {
 	intervals Intervals
 }
 
+// Ref returns the series reference of the stone.
+func (s Stone) Ref() uint64 { return s.ref }
+
+// Intervals returns the deleted time ranges of the stone.
+func (s Stone) Intervals() Intervals { return s.intervals }
+
 func readTombstones(dir string) (*memTombstones, error) {
 	b, err := ioutil.ReadFile(filepath.Join(dir, tombstoneFilename))
 	if os.IsNotExist(err) {
@@ -120,7 +126,10 @@ func readTombstones(dir string) (*memTombstones, error) {
 	} else if err != nil {
 		return nil, err
 	}
+	return decodeTombstones(b)
+}
 
+func decodeTombstones(b []byte) (*memTombstones, error) {
 	if len(b) < 5 {
 		return nil, errors.Wrap(errInvalidSize, "tombstones header")
 	}
@@ -0,0 +1,29 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package value
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestStaleNaN(t *testing.T) {
+	testutil.Assert(t, IsStaleNaN(StaleMarker()), "stale marker not detected")
+	testutil.Assert(t, math.IsNaN(StaleMarker()), "stale marker is not a NaN")
+	testutil.Assert(t, !IsStaleNaN(math.NaN()), "normal NaN detected as stale marker")
+	testutil.Assert(t, !IsStaleNaN(1), "number detected as stale marker")
+	testutil.Equals(t, NormalNaN, math.Float64bits(math.NaN()))
+}
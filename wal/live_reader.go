@@ -0,0 +1,226 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// LiveReader reads WAL records from a segment that may still be written to.
+// Unlike Reader, running out of data is not an error. Next returns false
+// with a nil Err and may be called again once more data was written.
+type LiveReader struct {
+	rdr   io.Reader
+	err   error
+	rec   []byte // Fragments of the current record.
+	cur   []byte // rec or its decompressed form.
+	dec   []byte
+	data  []byte // Data read from rdr.
+	off   int    // Offset of the first unconsumed byte in data.
+	frags int    // Fragments of the current record read so far.
+	flags byte   // Compression flags of the current record.
+	total int64  // Total bytes consumed.
+	end   int64  // Offset after the last complete record.
+}
+
+// NewLiveReader returns a new live reader.
+func NewLiveReader(r io.Reader) *LiveReader {
+	return &LiveReader{rdr: r}
+}
+
+// NewLiveReaderAt returns a new live reader for data that starts at the given
+// offset of a segment. The offset must be the start of a record.
+func NewLiveReaderAt(r io.Reader, offset int64) *LiveReader {
+	return &LiveReader{rdr: r, total: offset, end: offset}
+}
+
+// Next advances the reader to the next record and returns true if it exists.
+// It returns false if no complete record is available yet or an error occurred.
+func (r *LiveReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	for {
+		ok, err := r.next()
+		if err != nil {
+			r.err = err
+			return false
+		}
+		if ok {
+			return true
+		}
+		n, err := r.fill()
+		if err != nil {
+			r.err = err
+			return false
+		}
+		if n == 0 {
+			return false
+		}
+	}
+}
+
+// fill reads more data from the underlying reader. It returns 0 if no data
+// is available at this time.
+func (r *LiveReader) fill() (int, error) {
+	if r.off > 0 {
+		r.data = r.data[:copy(r.data, r.data[r.off:])]
+		r.off = 0
+	}
+	if cap(r.data)-len(r.data) < pageSize {
+		data := make([]byte, len(r.data), len(r.data)+2*pageSize)
+		copy(data, r.data)
+		r.data = data
+	}
+	n, err := r.rdr.Read(r.data[len(r.data) : len(r.data)+pageSize])
+	r.data = r.data[:len(r.data)+n]
+
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *LiveReader) consume(n int) {
+	r.off += n
+	r.total += int64(n)
+}
+
+// next consumes record fragments from the read data and returns true
+// once a record is complete.
+func (r *LiveReader) next() (bool, error) {
+	for {
+		buf := r.data[r.off:]
+		if len(buf) == 0 {
+			return false, nil
+		}
+		// Gobble up zero bytes up to the page boundary. The writer only pads a page
+		// once it is complete, so they must all be present eventually.
+		if buf[0] == byte(recPageTerm) {
+			k := pageSize - int(r.total%pageSize)
+			if len(buf) < k {
+				return false, nil
+			}
+			for _, c := range buf[:k] {
+				if c != 0 {
+					return false, errors.New("unexpected non-zero byte in padded page")
+				}
+			}
+			r.consume(k)
+			continue
+		}
+		if len(buf) < recordHeaderSize {
+			return false, nil
+		}
+		var (
+			typ    = recType(buf[0] & recTypeMask)
+			flags  = buf[0] &^ recTypeMask
+			length = int(binary.BigEndian.Uint16(buf[1:]))
+			crc    = binary.BigEndian.Uint32(buf[3:])
+		)
+		if length > pageSize-recordHeaderSize {
+			return false, errors.Errorf("invalid record size %d", length)
+		}
+		if len(buf) < recordHeaderSize+length {
+			return false, nil
+		}
+		part := buf[recordHeaderSize : recordHeaderSize+length]
+
+		if c := crc32.Checksum(part, castagnoliTable); c != crc {
+			return false, errors.Errorf("unexpected checksum %x, expected %x", c, crc)
+		}
+		if r.frags == 0 {
+			r.rec = r.rec[:0]
+			r.flags = flags
+		} else if flags != r.flags {
+			return false, errors.New("mixed compression flags within record")
+		}
+		r.rec = append(r.rec, part...)
+		r.consume(recordHeaderSize + length)
+
+		switch typ {
+		case recFull:
+			if r.frags != 0 {
+				return false, errors.New("unexpected full record")
+			}
+		case recFirst:
+			if r.frags != 0 {
+				return false, errors.New("unexpected first record")
+			}
+			r.frags++
+			continue
+		case recMiddle:
+			if r.frags == 0 {
+				return false, errors.New("unexpected middle record")
+			}
+			r.frags++
+			continue
+		case recLast:
+			if r.frags == 0 {
+				return false, errors.New("unexpected last record")
+			}
+		default:
+			return false, errors.Errorf("unexpected record type %d", typ)
+		}
+		r.frags = 0
+		r.end = r.total
+
+		var err error
+		r.cur, r.dec, err = decompressRecord(r.flags, r.rec, r.dec)
+		return err == nil, err
+	}
+}
+
+// Err returns the last encountered error wrapped in a corruption error.
+func (r *LiveReader) Err() error {
+	if r.err == nil {
+		return nil
+	}
+	seg := -1
+	if s, ok := r.rdr.(*Segment); ok {
+		seg = s.Index()
+	}
+	return &CorruptionErr{
+		Err:     r.err,
+		Segment: seg,
+		Offset:  r.total,
+	}
+}
+
+// Record returns the current record. The returned byte slice is only
+// valid until the next call to Next.
+func (r *LiveReader) Record() []byte {
+	return r.cur
+}
+
+// Offset returns the number of bytes consumed from the underlying reader.
+func (r *LiveReader) Offset() int64 {
+	return r.total
+}
+
+// RecordEnd returns the offset after the last complete record. Unlike Offset,
+// it never points into a record, so a reader created at it with NewLiveReaderAt
+// continues with the following record.
+func (r *LiveReader) RecordEnd() int64 {
+	return r.end
+}
+
+// partial returns true if the reader holds data of an incomplete record.
+func (r *LiveReader) partial() bool {
+	return r.frags > 0 || len(r.data) > r.off
+}
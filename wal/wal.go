@@ -30,6 +30,8 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/tsdb/fileutil"
@@ -138,6 +140,9 @@ func OpenReadSegment(fn string) (*Segment, error) {
 	return &Segment{File: f, i: k, dir: filepath.Dir(fn)}, nil
 }
 
+// ErrClosed is returned when writing to or closing a closed WAL.
+var ErrClosed = errors.New("wal is closed")
+
 // WAL is a write ahead log that stores records in segment files.
 // It must be read from start to end once before logging new data.
 // If an error occurs during read, the repair procedure must be called
@@ -159,11 +164,77 @@ type WAL struct {
 	stopc       chan chan struct{}
 	actorc      chan func()
 
+	syncMode     SyncMode
+	syncInterval time.Duration
+	syncc        chan chan error // Pending commits in SyncCommit mode.
+	// Commits that wrote their records but have not queued their sync yet.
+	pendingSyncs sync.WaitGroup
+	closed       bool
+
+	compression CompressionType
+	compressBuf []byte
+	zstdEnc     *zstd.Encoder
+
+	repairStrategy RepairStrategy
+
 	fsyncDuration   prometheus.Summary
+	syncBatchSize   prometheus.Summary
 	pageFlushes     prometheus.Counter
 	pageCompletions prometheus.Counter
 	truncateFail    prometheus.Counter
 	truncateTotal   prometheus.Counter
+	salvagedBytes   prometheus.Counter
+	salvagedRecords prometheus.Counter
+}
+
+// SyncMode defines when data written to the WAL is synced to disk.
+type SyncMode string
+
+const (
+	// SyncSegment syncs segments once they are completed. Logged records may be
+	// lost on power loss until their segment is completed.
+	SyncSegment SyncMode = "segment"
+	// SyncInterval additionally syncs the active segment at a fixed interval.
+	SyncInterval SyncMode = "interval"
+	// SyncCommit syncs the active segment before Log returns. Concurrent calls to
+	// Log are batched into a single page flush and sync.
+	SyncCommit SyncMode = "commit"
+)
+
+// CompressionType is the compression applied to records before they are
+// written to pages.
+type CompressionType string
+
+const (
+	CompressionNone   CompressionType = "none"
+	CompressionSnappy CompressionType = "snappy"
+	CompressionZstd   CompressionType = "zstd"
+)
+
+// RepairStrategy defines how a corrupted WAL is repaired.
+type RepairStrategy string
+
+const (
+	// RepairTruncate drops all data from the first corruption onwards.
+	RepairTruncate RepairStrategy = "truncate"
+	// RepairSalvage only drops unreadable pages and keeps all valid records
+	// around them.
+	RepairSalvage RepairStrategy = "salvage"
+)
+
+// Options are parameters for a WAL.
+type Options struct {
+	// Size of new segments. Must be a multiple of the page size.
+	SegmentSize int
+	// When logged records are synced to disk. Defaults to SyncSegment.
+	SyncMode SyncMode
+	// Interval at which the active segment is synced in SyncInterval mode.
+	SyncInterval time.Duration
+	// Compression of newly written records. Defaults to CompressionNone.
+	// Records are readable regardless of the compression they were written with.
+	Compression CompressionType
+	// How Repair handles corruptions. Defaults to RepairTruncate.
+	RepairStrategy RepairStrategy
 }
 
 // New returns a new WAL over the given directory.
@@ -174,9 +245,43 @@ func New(logger log.Logger, reg prometheus.Registerer, dir string) (*WAL, error)
 // NewSize returns a new WAL over the given directory.
 // New segments are created with the specified size.
 func NewSize(logger log.Logger, reg prometheus.Registerer, dir string, segmentSize int) (*WAL, error) {
+	return NewWithOptions(logger, reg, dir, Options{SegmentSize: segmentSize})
+}
+
+// NewWithOptions returns a new WAL over the given directory.
+func NewWithOptions(logger log.Logger, reg prometheus.Registerer, dir string, opts Options) (*WAL, error) {
+	segmentSize := opts.SegmentSize
+	if segmentSize == 0 {
+		segmentSize = defaultSegmentSize
+	}
 	if segmentSize%pageSize != 0 {
 		return nil, errors.New("invalid segment size")
 	}
+	switch opts.SyncMode {
+	case "":
+		opts.SyncMode = SyncSegment
+	case SyncSegment, SyncCommit:
+	case SyncInterval:
+		if opts.SyncInterval <= 0 {
+			return nil, errors.Errorf("invalid sync interval %s", opts.SyncInterval)
+		}
+	default:
+		return nil, errors.Errorf("unknown sync mode %q", opts.SyncMode)
+	}
+	switch opts.RepairStrategy {
+	case "":
+		opts.RepairStrategy = RepairTruncate
+	case RepairTruncate, RepairSalvage:
+	default:
+		return nil, errors.Errorf("unknown repair strategy %q", opts.RepairStrategy)
+	}
+	switch opts.Compression {
+	case "":
+		opts.Compression = CompressionNone
+	case CompressionNone, CompressionSnappy, CompressionZstd:
+	default:
+		return nil, errors.Errorf("unknown compression %q", opts.Compression)
+	}
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return nil, errors.Wrap(err, "create dir")
 	}
@@ -190,11 +295,29 @@ func NewSize(logger log.Logger, reg prometheus.Registerer, dir string, segmentSi
 		page:        &page{},
 		actorc:      make(chan func(), 100),
 		stopc:       make(chan chan struct{}),
+
+		syncMode:     opts.SyncMode,
+		syncInterval: opts.SyncInterval,
+		syncc:        make(chan chan error, 100),
+
+		compression:    opts.Compression,
+		repairStrategy: opts.RepairStrategy,
+	}
+	if w.compression == CompressionZstd {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "create zstd encoder")
+		}
+		w.zstdEnc = enc
 	}
 	w.fsyncDuration = prometheus.NewSummary(prometheus.SummaryOpts{
 		Name: "prometheus_tsdb_wal_fsync_duration_seconds",
 		Help: "Duration of WAL fsync.",
 	})
+	w.syncBatchSize = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "prometheus_tsdb_wal_sync_batch_size",
+		Help: "Number of Log calls made durable by a single sync in commit sync mode.",
+	})
 	w.pageFlushes = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "prometheus_tsdb_wal_page_flushes_total",
 		Help: "Total number of page flushes.",
@@ -211,8 +334,17 @@ func NewSize(logger log.Logger, reg prometheus.Registerer, dir string, segmentSi
 		Name: "prometheus_tsdb_wal_truncations_total",
 		Help: "Total number of WAL truncations attempted.",
 	})
+	w.salvagedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_salvage_lost_bytes_total",
+		Help: "Total number of bytes dropped when salvaging corrupted segments.",
+	})
+	w.salvagedRecords = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_salvage_lost_records_total",
+		Help: "Total number of records dropped when salvaging corrupted segments.",
+	})
 	if reg != nil {
-		reg.MustRegister(w.fsyncDuration, w.pageFlushes, w.pageCompletions, w.truncateFail, w.truncateTotal)
+		reg.MustRegister(w.fsyncDuration, w.syncBatchSize, w.pageFlushes, w.pageCompletions, w.truncateFail, w.truncateTotal,
+			w.salvagedBytes, w.salvagedRecords)
 	}
 
 	_, j, err := w.Segments()
@@ -245,13 +377,47 @@ func (w *WAL) Dir() string {
 	return w.dir
 }
 
+// RepairStrategy returns how the WAL repairs corruptions.
+func (w *WAL) RepairStrategy() RepairStrategy {
+	return w.repairStrategy
+}
+
+// Compression returns the compression applied to newly written records.
+func (w *WAL) Compression() CompressionType {
+	return w.compression
+}
+
 func (w *WAL) run() {
+	var tickc <-chan time.Time
+
+	if w.syncMode == SyncInterval {
+		ticker := time.NewTicker(w.syncInterval)
+		defer ticker.Stop()
+		tickc = ticker.C
+	}
 Loop:
 	for {
 		select {
 		case f := <-w.actorc:
 			f()
+		case errc := <-w.syncc:
+			w.syncCommits(errc)
+		case <-tickc:
+			w.mtx.Lock()
+			seg := w.segment
+			w.mtx.Unlock()
+
+			if err := w.fdatasync(seg); err != nil {
+				level.Error(w.logger).Log("msg", "sync active segment", "err", err)
+			}
 		case donec := <-w.stopc:
+			// No further commits are queued once the WAL is closed. Sync the
+			// ones that were queued before.
+			select {
+			case errc := <-w.syncc:
+				w.syncCommits(errc)
+			default:
+			}
 			close(w.actorc)
 			defer close(donec)
 			break Loop
@@ -263,6 +429,47 @@ Loop:
 	}
 }
 
+// syncCommits flushes the active page and syncs the active segment on behalf of
+// the given commit and all other pending ones. It runs in the actor goroutine.
+func (w *WAL) syncCommits(errc chan error) {
+	batch := []chan error{errc}
+	for more := true; more; {
+		select {
+		case errc := <-w.syncc:
+			batch = append(batch, errc)
+		default:
+			more = false
+		}
+	}
+	// Previous segments may hold data of the batch. Their sync was enqueued before
+	// the commits and must complete first.
+	for more := true; more; {
+		select {
+		case f := <-w.actorc:
+			f()
+		default:
+			more = false
+		}
+	}
+
+	w.mtx.Lock()
+	var err error
+	if w.page.alloc > w.page.flushed {
+		err = w.flushPage(false)
+	}
+	seg := w.segment
+	w.mtx.Unlock()
+
+	if err == nil {
+		err = w.fdatasync(seg)
+	}
+	w.syncBatchSize.Observe(float64(len(batch)))
+
+	for _, errc := range batch {
+		errc <- err
+	}
+}
+
 // Repair attempts to repair the WAL based on the error.
 // It discards all data after the corruption.
 func (w *WAL) Repair(origErr error) error {
@@ -280,6 +487,10 @@ func (w *WAL) Repair(origErr error) error {
 	if cerr.Segment < 0 {
 		return errors.New("corruption error does not specify position")
 	}
+	if w.repairStrategy == RepairSalvage {
+		_, err := w.Salvage(cerr.Segment)
+		return err
+	}
 
 	level.Warn(w.logger).Log("msg", "starting corruption repair",
 		"segment", cerr.Segment, "offset", cerr.Offset)
@@ -353,6 +564,114 @@ func (w *WAL) Repair(origErr error) error {
 	return nil
 }
 
+// Salvage rewrites all corrupted segments starting at segment from with the
+// records that can still be read from them. It returns the data that was lost.
+// It must not be called concurrently with Log.
+func (w *WAL) Salvage(from int) ([]SegmentLoss, error) {
+	segs, err := listSegments(w.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	var losses []SegmentLoss
+
+	for _, s := range segs {
+		if s.index < from {
+			continue
+		}
+		active := w.segment != nil && w.segment.i == s.index
+		if active {
+			// The active segment is replaced, close it first (Windows!).
+			if err := w.segment.Close(); err != nil {
+				return nil, errors.Wrap(err, "close active segment")
+			}
+		}
+		loss, err := w.salvageSegment(s.index)
+		if err != nil {
+			return nil, errors.Wrapf(err, "salvage segment %d", s.index)
+		}
+		if active {
+			if w.segment, err = OpenWriteSegment(w.dir, s.index); err != nil {
+				return nil, errors.Wrap(err, "reopen active segment")
+			}
+			stat, err := w.segment.Stat()
+			if err != nil {
+				return nil, err
+			}
+			w.donePages = int(stat.Size() / pageSize)
+		}
+		if loss == nil {
+			continue
+		}
+		level.Warn(w.logger).Log("msg", "salvaged corrupted segment", "segment", s.index,
+			"lost_bytes", loss.Bytes, "lost_records", loss.Records)
+
+		w.salvagedBytes.Add(float64(loss.Bytes))
+		w.salvagedRecords.Add(float64(loss.Records))
+		losses = append(losses, *loss)
+	}
+	return losses, nil
+}
+
+// salvageSegment rewrites segment i with its readable records if it is corrupted.
+// It returns nil if the segment was intact.
+func (w *WAL) salvageSegment(i int) (*SegmentLoss, error) {
+	fn := SegmentName(w.dir, i)
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "open segment")
+	}
+	defer f.Close()
+
+	var (
+		r    = NewSalvageReader(bufio.NewReader(f))
+		recs [][]byte
+	)
+	for r.Next() {
+		recs = append(recs, append([]byte(nil), r.Record()...))
+	}
+	loss := &SegmentLoss{Segment: i}
+	for _, l := range r.Losses() {
+		loss.Bytes += l.Bytes
+		loss.Records += l.Records
+	}
+	if loss.Bytes == 0 {
+		return nil, nil
+	}
+
+	// Write the records into a new WAL with a single segment, which replaces
+	// the corrupted one. Its segments are large enough to hold the records
+	// regardless of how they are split into pages.
+	tmpdir := fn + ".salvage"
+	if err := os.RemoveAll(tmpdir); err != nil {
+		return nil, err
+	}
+	repl, err := NewWithOptions(nil, nil, tmpdir, Options{
+		SegmentSize: 2 * w.segmentSize,
+		Compression: w.compression,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range recs {
+		if err := repl.Log(rec); err != nil {
+			repl.Close()
+			return nil, errors.Wrap(err, "insert record")
+		}
+	}
+	if err := repl.Close(); err != nil {
+		return nil, err
+	}
+	// Close explicitly for Windows to be able to replace the file.
+	if err := f.Close(); err != nil {
+		return nil, errors.Wrap(err, "close corrupted segment")
+	}
+	if err := fileutil.Rename(SegmentName(tmpdir, 0), fn); err != nil {
+		return nil, err
+	}
+	return loss, os.RemoveAll(tmpdir)
+}
+
 // SegmentName builds a segment name for the directory.
 func SegmentName(dir string, i int) string {
 	return filepath.Join(dir, fmt.Sprintf("%08d", i))
@@ -428,6 +747,14 @@ const (
 	recLast     recType = 4 // Final fragment of a record.
 )
 
+// Flags in the type byte of a record fragment marking the compression of the
+// record it belongs to. All fragments of a record carry the same flag.
+const (
+	snappyMask  = 1 << 3
+	zstdMask    = 1 << 4
+	recTypeMask = snappyMask - 1
+)
+
 func (t recType) String() string {
 	switch t {
 	case recPageTerm:
@@ -451,22 +778,60 @@ func (w *WAL) pagesPerSegment() int {
 
 // Log writes the records into the log.
 // Multiple records can be passed at once to reduce writes and increase throughput.
+//
+// In SyncCommit mode, Log returns once the records are synced to disk. The final page
+// flush is left to the sync, which is shared with concurrent calls.
 func (w *WAL) Log(recs ...[]byte) error {
+	commit := w.syncMode == SyncCommit
+
 	w.mtx.Lock()
-	defer w.mtx.Unlock()
+	if w.closed {
+		w.mtx.Unlock()
+		return ErrClosed
+	}
 	// Callers could just implement their own list record format but adding
 	// a bit of extra logic here frees them from that overhead.
 	for i, r := range recs {
-		if err := w.log(r, i == len(recs)-1); err != nil {
+		if err := w.log(r, i == len(recs)-1 && !commit); err != nil {
+			w.mtx.Unlock()
 			return err
 		}
 	}
-	return nil
+	if commit {
+		w.pendingSyncs.Add(1)
+	}
+	w.mtx.Unlock()
+
+	if !commit {
+		return nil
+	}
+	errc := make(chan error, 1)
+	w.syncc <- errc
+	w.pendingSyncs.Done()
+
+	return <-errc
 }
 
 // log writes rec to the log and forces a flush of the current page if its
 // the final record of a batch.
 func (w *WAL) log(rec []byte, final bool) error {
+	// Compress the record if it makes it smaller. Otherwise it is written
+	// as is, which the reader tells apart by the missing compression flag.
+	var flag byte
+
+	switch w.compression {
+	case CompressionSnappy:
+		w.compressBuf = snappy.Encode(w.compressBuf[:cap(w.compressBuf)], rec)
+		if len(w.compressBuf) < len(rec) {
+			rec, flag = w.compressBuf, snappyMask
+		}
+	case CompressionZstd:
+		w.compressBuf = w.zstdEnc.EncodeAll(rec, w.compressBuf[:0])
+		if len(w.compressBuf) < len(rec) {
+			rec, flag = w.compressBuf, zstdMask
+		}
+	}
+
 	// If the record is too big to fit within pages in the current
 	// segment, terminate the active segment and advance to the next one.
 	// This ensures that records do not cross segment boundaries.
@@ -503,7 +868,7 @@ func (w *WAL) log(rec []byte, final bool) error {
 			typ = recMiddle
 		}
 
-		buf[0] = byte(typ)
+		buf[0] = byte(typ) | flag
 		crc := crc32.Checksum(part, castagnoliTable)
 		binary.BigEndian.PutUint16(buf[1:], uint16(len(part)))
 		binary.BigEndian.PutUint32(buf[3:], crc)
@@ -526,14 +891,7 @@ func (w *WAL) log(rec []byte, final bool) error {
 // Segments returns the range [first, n] of currently existing segments.
 // If no segments are found, first and n are -1.
 func (w *WAL) Segments() (first, last int, err error) {
-	refs, err := listSegments(w.dir)
-	if err != nil {
-		return 0, 0, err
-	}
-	if len(refs) == 0 {
-		return -1, -1, nil
-	}
-	return refs[0].index, refs[len(refs)-1].index, nil
+	return segmentRange(w.dir)
 }
 
 // Truncate drops all segments before i.
@@ -566,8 +924,32 @@ func (w *WAL) fsync(f *Segment) error {
 	return err
 }
 
+func (w *WAL) fdatasync(f *Segment) error {
+	start := time.Now()
+	err := fileutil.Fdatasync(f.File)
+	w.fsyncDuration.Observe(time.Since(start).Seconds())
+	return err
+}
+
 // Close flushes all writes and closes active segment.
 func (w *WAL) Close() (err error) {
+	w.mtx.Lock()
+	if w.closed {
+		w.mtx.Unlock()
+		return ErrClosed
+	}
+	w.closed = true
+	w.mtx.Unlock()
+
+	// Commits in flight must queue their sync before the actor goroutine stops.
+	w.pendingSyncs.Wait()
+
+	// Stop the actor goroutine first as it acquires the lock itself
+	// to sync the active segment.
+	donec := make(chan struct{})
+	w.stopc <- donec
+	<-donec
+
 	w.mtx.Lock()
 	defer w.mtx.Unlock()
 
@@ -580,17 +962,15 @@ func (w *WAL) Close() (err error) {
 		}
 	}
 
-	donec := make(chan struct{})
-	w.stopc <- donec
-	<-donec
-
 	if err = w.fsync(w.segment); err != nil {
 		level.Error(w.logger).Log("msg", "sync previous segment", "err", err)
 	}
 	if err := w.segment.Close(); err != nil {
 		level.Error(w.logger).Log("msg", "close previous segment", "err", err)
 	}
-
+	if w.zstdEnc != nil {
+		w.zstdEnc.Close()
+	}
 	return nil
 }
 
@@ -707,8 +1087,42 @@ type Reader struct {
 	rdr   io.Reader
 	err   error
 	rec   []byte
+	cur   []byte // rec or its decompressed form.
+	dec   []byte
 	buf   [pageSize]byte
 	total int64 // total bytes processed.
+
+	salvage     bool
+	recStart    int64 // Offset of the current record.
+	tailPending bool  // Whether fragments of a lost record may follow.
+	losses      []SegmentLoss
+}
+
+// SegmentLoss describes the data of a segment that a salvaging reader skipped.
+type SegmentLoss struct {
+	Segment int // -1 if the reader does not read from segments.
+	Bytes   int64
+	// Records that were lost partially or entirely. Records within
+	// unreadable pages cannot be counted and are not included.
+	Records int
+}
+
+// The zstd decoder is shared by all readers and created on first use. It is
+// safe for concurrent use.
+var (
+	zstdDecOnce sync.Once
+	zstdDec     *zstd.Decoder
+	zstdDecErr  error
+)
+
+func getZstdDecoder() (*zstd.Decoder, error) {
+	zstdDecOnce.Do(func() {
+		zstdDec, zstdDecErr = zstd.NewReader(nil)
+		if zstdDecErr != nil {
+			zstdDecErr = errors.Wrap(zstdDecErr, "create zstd decoder")
+		}
+	})
+	return zstdDec, zstdDecErr
 }
 
 // NewReader returns a new reader.
@@ -716,15 +1130,63 @@ func NewReader(r io.Reader) *Reader {
 	return &Reader{rdr: r}
 }
 
+// NewSalvageReader returns a new reader that skips corrupted data instead of
+// failing. It drops the pages holding unreadable data and resynchronizes on
+// the next valid record in a following page. The skipped data is reported by Losses.
+// The data must start at a page boundary.
+func NewSalvageReader(r io.Reader) *Reader {
+	return &Reader{rdr: r, salvage: true}
+}
+
 // Next advances the reader to the next records and returns true if it exists.
 // It must not be called again after it returned false.
 func (r *Reader) Next() bool {
-	err := r.next()
-	if errors.Cause(err) == io.EOF {
-		return false
+	for {
+		err := r.next()
+		if errors.Cause(err) == io.EOF {
+			return false
+		}
+		if err != nil && r.salvage {
+			if r.resync() {
+				continue
+			}
+			return false
+		}
+		r.err = err
+		return r.err == nil
+	}
+}
+
+// resync skips the remainder of the current page after the reader failed to read
+// the current record. It returns false if the end of the data was reached.
+func (r *Reader) resync() bool {
+	k := (pageSize - r.total%pageSize) % pageSize
+
+	n, err := io.ReadFull(r.rdr, r.buf[:k])
+	r.total += int64(n)
+	r.lose(r.total-r.recStart, 1)
+	r.tailPending = true
+
+	return err == nil
+}
+
+// lose accounts for skipped data of the current segment.
+func (r *Reader) lose(bytes int64, records int) {
+	seg := -1
+	if b, ok := r.rdr.(*segmentBufReader); ok && b.cur >= 0 && b.cur < len(b.segs) {
+		seg = b.segs[b.cur].Index()
+	}
+	if n := len(r.losses); n > 0 && r.losses[n-1].Segment == seg {
+		r.losses[n-1].Bytes += bytes
+		r.losses[n-1].Records += records
+		return
 	}
-	r.err = err
-	return r.err == nil
+	r.losses = append(r.losses, SegmentLoss{Segment: seg, Bytes: bytes, Records: records})
+}
+
+// Losses returns the data skipped by a salvaging reader by segment.
+func (r *Reader) Losses() []SegmentLoss {
+	return r.losses
 }
 
 func (r *Reader) next() (err error) {
@@ -734,17 +1196,25 @@ func (r *Reader) next() (err error) {
 	buf := r.buf[recordHeaderSize:]
 
 	r.rec = r.rec[:0]
+	r.cur = r.rec
+
+	var (
+		i     = 0
+		flags byte
+	)
+	r.recStart = r.total
 
-	i := 0
 	for {
+		fragStart := r.total
+
 		if _, err = io.ReadFull(r.rdr, hdr[:1]); err != nil {
 			return errors.Wrap(err, "read first header byte")
 		}
 		r.total++
-		typ := recType(hdr[0])
+		typ := recType(hdr[0] & recTypeMask)
 
 		// Gobble up zero bytes.
-		if typ == recPageTerm {
+		if hdr[0] == byte(recPageTerm) {
 			// We are pedantic and check whether the zeros are actually up
 			// to a page boundary.
 			// It's not strictly necessary but may catch sketchy state early.
@@ -765,6 +1235,9 @@ func (r *Reader) next() (err error) {
 			}
 			continue
 		}
+		if f := hdr[0] &^ recTypeMask; f != 0 && f != snappyMask && f != zstdMask {
+			return errors.Errorf("unexpected compression flags %x", f)
+		}
 		n, err := io.ReadFull(r.rdr, hdr[1:])
 		if err != nil {
 			return errors.Wrap(err, "read remaining header")
@@ -779,6 +1252,11 @@ func (r *Reader) next() (err error) {
 		if length > pageSize-recordHeaderSize {
 			return errors.Errorf("invalid record size %d", length)
 		}
+		// Fragments never cross page boundaries. When salvaging we rely on it
+		// to not read into the next page, which we want to resynchronize on.
+		if r.salvage && int64(length) > (pageSize-r.total%pageSize)%pageSize {
+			return errors.Errorf("record size %d exceeds page", length)
+		}
 		n, err = io.ReadFull(r.rdr, buf[:length])
 		if err != nil {
 			return err
@@ -791,14 +1269,46 @@ func (r *Reader) next() (err error) {
 		if c := crc32.Checksum(buf[:length], castagnoliTable); c != crc {
 			return errors.Errorf("unexpected checksum %x, expected %x", c, crc)
 		}
+		if r.salvage {
+			// Fragments that are valid on their own but do not continue the current
+			// record belong to records that were partially lost. Drop the parts we
+			// have and continue with the next record.
+			switch {
+			case (typ == recFull || typ == recFirst) && i != 0:
+				r.lose(fragStart-r.recStart, 1)
+				r.rec, i = r.rec[:0], 0
+			case typ == recFull || typ == recFirst:
+				r.tailPending = false
+			case (typ == recMiddle || typ == recLast) && i == 0:
+				// The record was already accounted for if we dropped its head.
+				lost := 0
+				if typ == recLast && !r.tailPending {
+					lost = 1
+				}
+				if typ == recLast {
+					r.tailPending = false
+				}
+				r.lose(r.total-fragStart, lost)
+				continue
+			}
+		}
+		if i == 0 {
+			r.recStart = fragStart
+		}
 		r.rec = append(r.rec, buf[:length]...)
 
+		if f := hdr[0] &^ recTypeMask; i == 0 {
+			flags = f
+		} else if f != flags {
+			return errors.New("mixed compression flags within record")
+		}
+
 		switch typ {
 		case recFull:
 			if i != 0 {
 				return errors.New("unexpected full record")
 			}
-			return nil
+			return r.decompress(flags)
 		case recFirst:
 			if i != 0 {
 				return errors.New("unexpected first record")
@@ -811,7 +1321,7 @@ func (r *Reader) next() (err error) {
 			if i == 0 {
 				return errors.New("unexpected last record")
 			}
-			return nil
+			return r.decompress(flags)
 		default:
 			return errors.Errorf("unexpected record type %d", typ)
 		}
@@ -821,6 +1331,40 @@ func (r *Reader) next() (err error) {
 	}
 }
 
+// decompress sets the current record to the decompressed form of the
+// read record according to the given compression flags.
+func (r *Reader) decompress(flags byte) (err error) {
+	r.cur, r.dec, err = decompressRecord(flags, r.rec, r.dec)
+	return err
+}
+
+// decompressRecord returns rec in its decompressed form according to the given
+// compression flags. Decompressed data is written into dec, which is returned
+// for reuse.
+func decompressRecord(flags byte, rec, dec []byte) (res, _ []byte, err error) {
+	switch flags {
+	case 0:
+		return rec, dec, nil
+	case snappyMask:
+		dec, err = snappy.Decode(dec[:cap(dec)], rec)
+		if err != nil {
+			return nil, dec, errors.Wrap(err, "decompress snappy record")
+		}
+	case zstdMask:
+		var zd *zstd.Decoder
+		if zd, err = getZstdDecoder(); err != nil {
+			return nil, dec, err
+		}
+		dec, err = zd.DecodeAll(rec, dec[:0])
+		if err != nil {
+			return nil, dec, errors.Wrap(err, "decompress zstd record")
+		}
+	default:
+		return nil, dec, errors.Errorf("unexpected compression flags %x", flags)
+	}
+	return dec, dec, nil
+}
+
 // Err returns the last encountered error wrapped in a corruption error.
 // If the reader does not allow to infer a segment index and offset, a total
 // offset in the reader stream will be provided.
@@ -845,7 +1389,7 @@ func (r *Reader) Err() error {
 // Record returns the current record. The returned byte slice is only
 // valid until the next call to Next.
 func (r *Reader) Record() []byte {
-	return r.rec
+	return r.cur
 }
 
 func min(i, j int) int {
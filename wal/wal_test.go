@@ -18,10 +18,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/tsdb/testutil"
@@ -215,8 +218,9 @@ func TestWAL_FuzzWriteRead(t *testing.T) {
 	testutil.Ok(t, rdr.Err())
 }
 
-func TestWAL_Repair(t *testing.T) {
-	for name, cf := range map[string]func(f *os.File){
+// corruptions returns functions corrupting the record at the start of the second page of a segment.
+func corruptions(t *testing.T) map[string]func(f *os.File) {
+	return map[string]func(f *os.File){
 		"bad_fragment_sequence": func(f *os.File) {
 			_, err := f.Seek(pageSize, 0)
 			testutil.Ok(t, err)
@@ -247,7 +251,11 @@ func TestWAL_Repair(t *testing.T) {
 			_, err = f.Write([]byte("beef"))
 			testutil.Ok(t, err)
 		},
-	} {
+	}
+}
+
+func TestWAL_Repair(t *testing.T) {
+	for name, cf := range corruptions(t) {
 		t.Run(name, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "wal_repair")
 			testutil.Ok(t, err)
@@ -367,3 +375,230 @@ func BenchmarkWAL_Log(b *testing.B) {
 	// do not show burst throughput well.
 	b.StopTimer()
 }
+
+func TestWAL_SyncCommit(t *testing.T) {
+	const (
+		writers = 8
+		count   = 500
+	)
+	dir, err := ioutil.TempDir("", "walsync")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWithOptions(nil, nil, dir, Options{SegmentSize: 4 * pageSize, SyncMode: SyncCommit})
+	testutil.Ok(t, err)
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				id := make([]byte, 2)
+				binary.BigEndian.PutUint16(id, uint16(i<<12|j))
+				testutil.Ok(t, w.Log(id, make([]byte, 3+rand.Intn(pageSize/2))))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// All records must be readable without closing the WAL and appear in the
+	// order they were logged by each writer.
+	m, n, err := w.Segments()
+	testutil.Ok(t, err)
+
+	rc, err := NewSegmentsRangeReader(dir, m, n)
+	testutil.Ok(t, err)
+	defer rc.Close()
+
+	var (
+		rdr  = NewReader(rc)
+		next = make([]int, writers)
+		recs int
+	)
+	for rdr.Next() {
+		rec := rdr.Record()
+		if len(rec) != 2 {
+			continue
+		}
+		v := binary.BigEndian.Uint16(rec)
+		i, j := int(v>>12), int(v&0xfff)
+		testutil.Equals(t, next[i], j)
+		next[i]++
+		recs++
+	}
+	testutil.Ok(t, rdr.Err())
+	testutil.Equals(t, writers*count, recs)
+}
+
+func TestWAL_SyncCommitClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walsync")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWithOptions(nil, nil, dir, Options{SyncMode: SyncCommit})
+	testutil.Ok(t, err)
+
+	// Commits racing with Close either complete or fail, but never block.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := w.Log([]byte("a")); err != nil {
+					testutil.Equals(t, ErrClosed, err)
+					return
+				}
+			}
+		}()
+	}
+	testutil.Ok(t, w.Close())
+	wg.Wait()
+
+	testutil.Equals(t, ErrClosed, w.Log([]byte("a")))
+	testutil.Equals(t, ErrClosed, w.Close())
+}
+
+func TestWAL_InvalidSyncMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walsync")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewWithOptions(nil, nil, dir, Options{SyncMode: "always"})
+	testutil.NotOk(t, err)
+
+	_, err = NewWithOptions(nil, nil, dir, Options{SyncMode: SyncInterval})
+	testutil.NotOk(t, err)
+
+	w, err := NewWithOptions(nil, nil, dir, Options{SyncMode: SyncInterval, SyncInterval: time.Millisecond})
+	testutil.Ok(t, err)
+	testutil.Ok(t, w.Log([]byte("a")))
+	time.Sleep(10 * time.Millisecond)
+	testutil.Ok(t, w.Close())
+}
+
+func TestWAL_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walcompress")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	var input [][]byte
+
+	// Write segments with different compressions, including records that
+	// do not compress and records spanning multiple pages.
+	for _, c := range []CompressionType{CompressionSnappy, CompressionNone, CompressionZstd} {
+		w, err := NewWithOptions(nil, nil, dir, Options{SegmentSize: 16 * pageSize, Compression: c})
+		testutil.Ok(t, err)
+		testutil.Equals(t, c, w.Compression())
+
+		for i := 0; i < 20; i++ {
+			zeros := make([]byte, rand.Intn(3*pageSize))
+			random := make([]byte, rand.Intn(3*pageSize))
+			_, err := rand.Read(random)
+			testutil.Ok(t, err)
+
+			testutil.Ok(t, w.Log(zeros, random, nil))
+			input = append(input, zeros, random, nil)
+		}
+		testutil.Ok(t, w.Close())
+	}
+
+	// The first record of the first segment is compressible and must be flagged.
+	b, err := ioutil.ReadFile(SegmentName(dir, 0))
+	testutil.Ok(t, err)
+	testutil.Equals(t, byte(snappyMask), b[0]&^recTypeMask)
+
+	sr, err := NewSegmentsReader(dir)
+	testutil.Ok(t, err)
+	defer sr.Close()
+
+	r := NewReader(sr)
+	i := 0
+	for ; r.Next(); i++ {
+		testutil.Assert(t, i < len(input), "read too many records")
+		testutil.Assert(t, bytes.Equal(input[i], r.Record()), "record %d does not match", i)
+	}
+	testutil.Ok(t, r.Err())
+	testutil.Equals(t, len(input), i)
+
+	_, err = NewWithOptions(nil, nil, dir, Options{Compression: "lz4"})
+	testutil.NotOk(t, err)
+}
+
+func TestWAL_Salvage(t *testing.T) {
+	for name, cf := range corruptions(t) {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_salvage")
+			testutil.Ok(t, err)
+			defer os.RemoveAll(dir)
+
+			// We create 3 segments with 3 records each and then corrupt the 2nd record
+			// of the 2nd segment. Only that record must be lost.
+			w, err := NewSize(nil, nil, dir, 3*pageSize)
+			testutil.Ok(t, err)
+
+			var records [][]byte
+
+			for i := 1; i <= 9; i++ {
+				b := make([]byte, pageSize-recordHeaderSize)
+				b[0] = byte(i)
+				records = append(records, b)
+				testutil.Ok(t, w.Log(b))
+			}
+			testutil.Ok(t, w.Close())
+
+			f, err := os.OpenFile(SegmentName(dir, 1), os.O_RDWR, 0666)
+			testutil.Ok(t, err)
+			cf(f)
+			testutil.Ok(t, f.Close())
+
+			expected := append(append([][]byte{}, records[:4]...), records[5:]...)
+			expLoss := []SegmentLoss{{Segment: 1, Bytes: pageSize, Records: 1}}
+
+			readAll := func(newReader func(io.Reader) *Reader) ([][]byte, *Reader) {
+				sr, err := NewSegmentsReader(dir)
+				testutil.Ok(t, err)
+				defer sr.Close()
+
+				var (
+					r      = newReader(sr)
+					result [][]byte
+				)
+				for r.Next() {
+					result = append(result, append([]byte(nil), r.Record()...))
+				}
+				return result, r
+			}
+			// The salvage reader skips the corrupted record.
+			result, r := readAll(NewSalvageReader)
+			testutil.Ok(t, r.Err())
+			testutil.Equals(t, expected, result)
+			testutil.Equals(t, expLoss, r.Losses())
+
+			w, err = NewWithOptions(nil, nil, dir, Options{SegmentSize: 3 * pageSize, RepairStrategy: RepairSalvage})
+			testutil.Ok(t, err)
+
+			_, r = readAll(NewReader)
+			testutil.NotOk(t, r.Err())
+			testutil.Ok(t, w.Repair(r.Err()))
+
+			// The segments are intact after the repair and the WAL can be written to.
+			testutil.Ok(t, w.Log(records[0]))
+			testutil.Ok(t, w.Close())
+			expected = append(expected, records[0])
+
+			result, r = readAll(NewReader)
+			testutil.Ok(t, r.Err())
+			testutil.Equals(t, expected, result)
+
+			w, err = NewWithOptions(nil, nil, dir, Options{RepairStrategy: RepairSalvage})
+			testutil.Ok(t, err)
+			losses, err := w.Salvage(0)
+			testutil.Ok(t, err)
+			testutil.Equals(t, 0, len(losses))
+			testutil.Ok(t, w.Close())
+		})
+	}
+}
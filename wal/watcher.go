@@ -0,0 +1,241 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// checkpointPrefix matches the directories written by tsdb.Checkpoint.
+	checkpointPrefix = "checkpoint."
+
+	watcherPollInterval = 100 * time.Millisecond
+)
+
+// RecordHandler processes a record read by a Watcher. The record is only
+// valid for the duration of the call.
+type RecordHandler func(rec []byte) error
+
+// Watcher follows a WAL directory as it is written to and passes all records
+// to a handler. It first reads the most recent checkpoint, followed by all
+// segments after it. At the end of the last segment it waits for more data
+// until a new segment is cut.
+//
+// If segments are truncated before the watcher read them, it continues with
+// the checkpoint that replaced them. Records may thus be passed to the handler
+// more than once.
+type Watcher struct {
+	dir     string
+	logger  log.Logger
+	handler RecordHandler
+
+	recordsRead    prometheus.Counter
+	currentSegment prometheus.Gauge
+}
+
+// NewWatcher returns a new watcher for the WAL in dir.
+func NewWatcher(logger log.Logger, reg prometheus.Registerer, dir string, handler RecordHandler) *Watcher {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	w := &Watcher{
+		dir:     dir,
+		logger:  logger,
+		handler: handler,
+	}
+	w.recordsRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_watcher_records_read_total",
+		Help: "Total number of records read by the WAL watcher.",
+	})
+	w.currentSegment = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_wal_watcher_current_segment",
+		Help: "Index of the WAL segment the watcher is currently reading.",
+	})
+	if reg != nil {
+		reg.MustRegister(w.recordsRead, w.currentSegment)
+	}
+	return w
+}
+
+// Run follows the WAL until the context is canceled or an error occurs.
+// Errors returned by the handler abort the watcher.
+func (w *Watcher) Run(ctx context.Context) error {
+	next := 0
+
+	for {
+		first, last, err := segmentRange(w.dir)
+		if err != nil {
+			return errors.Wrap(err, "list segments")
+		}
+		if last < 0 || next > last {
+			if err := w.wait(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		// The segments we are about to read were truncated. Their data is in
+		// a checkpoint unless we read it already.
+		if next < first {
+			if next, err = w.readCheckpoint(next); err != nil {
+				return err
+			}
+			if next < first {
+				level.Warn(w.logger).Log("msg", "WAL segments were truncated without checkpoint", "from", next, "to", first-1)
+				next = first
+			}
+			continue
+		}
+		if err := w.watchSegment(ctx, next); err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			}
+			return err
+		}
+		next++
+	}
+}
+
+func (w *Watcher) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(watcherPollInterval):
+		return nil
+	}
+}
+
+// readCheckpoint reads the most recent checkpoint if it covers segment next
+// or later and returns the segment to continue with.
+func (w *Watcher) readCheckpoint(next int) (int, error) {
+	dir, idx, err := lastCheckpoint(w.dir)
+	if err != nil {
+		return 0, errors.Wrap(err, "find last checkpoint")
+	}
+	if dir == "" || idx < next {
+		return next, nil
+	}
+	level.Debug(w.logger).Log("msg", "reading checkpoint", "dir", dir)
+
+	sr, err := NewSegmentsReader(filepath.Join(w.dir, dir))
+	if err != nil {
+		return 0, errors.Wrap(err, "open checkpoint")
+	}
+	defer sr.Close()
+
+	r := NewReader(sr)
+	for r.Next() {
+		if err := w.handle(r.Record()); err != nil {
+			return 0, err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return 0, errors.Wrapf(err, "read checkpoint %s", dir)
+	}
+	return idx + 1, nil
+}
+
+// watchSegment reads segment i until a later segment exists and all its
+// records were read.
+func (w *Watcher) watchSegment(ctx context.Context, i int) error {
+	seg, err := OpenReadSegment(SegmentName(w.dir, i))
+	if err != nil {
+		return err
+	}
+	defer seg.Close()
+
+	w.currentSegment.Set(float64(i))
+	r := NewLiveReader(seg)
+
+	for {
+		// A later segment is only created after this one was written completely.
+		// Check for it before reading so that we do not miss trailing records.
+		_, last, err := segmentRange(w.dir)
+		if err != nil {
+			return errors.Wrap(err, "list segments")
+		}
+		for r.Next() {
+			if err := w.handle(r.Record()); err != nil {
+				return err
+			}
+		}
+		if err := r.Err(); err != nil {
+			return err
+		}
+		if last > i {
+			if r.partial() {
+				return &CorruptionErr{
+					Err:     errors.New("unexpected end of segment"),
+					Segment: i,
+					Offset:  r.Offset(),
+				}
+			}
+			return nil
+		}
+		if err := w.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *Watcher) handle(rec []byte) error {
+	w.recordsRead.Inc()
+	return w.handler(rec)
+}
+
+// segmentRange returns the range [first, last] of segments in dir.
+// If no segments are found, first and last are -1.
+func segmentRange(dir string) (first, last int, err error) {
+	refs, err := listSegments(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(refs) == 0 {
+		return -1, -1, nil
+	}
+	return refs[0].index, refs[len(refs)-1].index, nil
+}
+
+// lastCheckpoint returns the directory name and index of the most recent
+// complete checkpoint in dir. The name is empty if there is none.
+func lastCheckpoint(dir string) (string, int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", 0, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		fi := files[i]
+
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), checkpointPrefix) {
+			continue
+		}
+		idx, err := strconv.Atoi(fi.Name()[len(checkpointPrefix):])
+		if err != nil {
+			continue
+		}
+		return fi.Name(), idx, nil
+	}
+	return "", 0, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestLiveReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "live_reader")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWithOptions(nil, nil, dir, Options{Compression: CompressionSnappy})
+	testutil.Ok(t, err)
+
+	var input [][]byte
+	for i := 0; i < 500; i++ {
+		rec := make([]byte, rand.Intn(2*pageSize))
+		if i%2 == 0 {
+			_, err := rand.Read(rec)
+			testutil.Ok(t, err)
+		}
+		input = append(input, rec)
+		testutil.Ok(t, w.Log(rec))
+	}
+	testutil.Ok(t, w.Close())
+
+	data, err := ioutil.ReadFile(SegmentName(dir, 0))
+	testutil.Ok(t, err)
+
+	// Hand the segment to the reader in random increments as if it was
+	// being written to.
+	var (
+		buf bytes.Buffer
+		r   = NewLiveReader(&buf)
+		i   int
+	)
+	for len(data) > 0 {
+		n := rand.Intn(3 * pageSize)
+		if n > len(data) {
+			n = len(data)
+		}
+		buf.Write(data[:n])
+		data = data[n:]
+
+		for r.Next() {
+			testutil.Assert(t, i < len(input), "read too many records")
+			testutil.Assert(t, bytes.Equal(input[i], r.Record()), "record %d does not match", i)
+			i++
+		}
+		testutil.Ok(t, r.Err())
+	}
+	testutil.Equals(t, len(input), i)
+	testutil.Assert(t, !r.partial(), "unexpected partial record")
+
+	// Corrupted data is reported.
+	buf.Write([]byte{byte(recFull), 0, 1, 0, 0, 0, 0, 1})
+	testutil.Assert(t, !r.Next(), "unexpected record")
+	testutil.NotOk(t, r.Err())
+}
+
+// recorder collects records passed to a watcher.
+type recorder struct {
+	mtx  sync.Mutex
+	recs []string
+}
+
+func (r *recorder) handle(rec []byte) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.recs = append(r.recs, string(rec))
+	return nil
+}
+
+func (r *recorder) waitFor(t *testing.T, exp []string) {
+	for i := 0; ; i++ {
+		r.mtx.Lock()
+		n := len(r.recs)
+		r.mtx.Unlock()
+
+		if n >= len(exp) || i == 100 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	testutil.Equals(t, exp, r.recs)
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWithOptions(nil, nil, dir, Options{SegmentSize: pageSize})
+	testutil.Ok(t, err)
+	defer w.Close()
+
+	// Each record fills most of a page and thus a segment.
+	rec := func(i int) string {
+		b := make([]byte, pageSize/2)
+		copy(b, fmt.Sprintf("record-%d", i))
+		return string(b)
+	}
+	var exp []string
+	for i := 0; i < 10; i++ {
+		testutil.Ok(t, w.Log([]byte(rec(i))))
+		exp = append(exp, rec(i))
+	}
+
+	// Replace the first segments with a checkpoint. The watcher must start
+	// with it and continue with the remaining segments.
+	cp, err := New(nil, nil, filepath.Join(dir, "checkpoint.000004"))
+	testutil.Ok(t, err)
+	testutil.Ok(t, cp.Log([]byte("checkpoint")))
+	testutil.Ok(t, cp.Close())
+	testutil.Ok(t, w.Truncate(5))
+
+	exp = append([]string{"checkpoint"}, exp[5:]...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		rc   recorder
+		errc = make(chan error, 1)
+	)
+	go func() {
+		errc <- NewWatcher(nil, nil, dir, rc.handle).Run(ctx)
+	}()
+	rc.waitFor(t, exp)
+
+	// Records written later are picked up, in the active segment as well as
+	// in newly cut ones.
+	for i := 10; i < 20; i++ {
+		testutil.Ok(t, w.Log([]byte(rec(i))))
+		exp = append(exp, rec(i))
+	}
+	rc.waitFor(t, exp)
+
+	cancel()
+	testutil.Equals(t, context.Canceled, <-errc)
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/wal"
+)
+
+// WALWatcherCallbacks receive the decoded records read by a WAL watcher.
+// Records of a type whose callback is nil are skipped. The passed slices
+// are only valid for the duration of the call.
+type WALWatcherCallbacks struct {
+	Series     func([]RefSeries) error
+	Samples    func([]RefSample) error
+	Tombstones func([]Stone) error
+}
+
+// NewWALWatcher returns a watcher that follows the WAL in dir, as written by
+// the head block, and passes the decoded records to the callbacks.
+func NewWALWatcher(l log.Logger, r prometheus.Registerer, dir string, cb WALWatcherCallbacks) *wal.Watcher {
+	var (
+		dec     RecordDecoder
+		series  []RefSeries
+		samples []RefSample
+		tstones []Stone
+	)
+	return wal.NewWatcher(l, r, dir, func(rec []byte) (err error) {
+		switch dec.Type(rec) {
+		case RecordSeries:
+			if cb.Series == nil {
+				return nil
+			}
+			if series, err = dec.Series(rec, series[:0]); err != nil {
+				return errors.Wrap(err, "decode series")
+			}
+			return cb.Series(series)
+		case RecordSamples:
+			if cb.Samples == nil {
+				return nil
+			}
+			if samples, err = dec.Samples(rec, samples[:0]); err != nil {
+				return errors.Wrap(err, "decode samples")
+			}
+			return cb.Samples(samples)
+		case RecordTombstones:
+			if cb.Tombstones == nil {
+				return nil
+			}
+			if tstones, err = dec.Tombstones(rec, tstones[:0]); err != nil {
+				return errors.Wrap(err, "decode tombstones")
+			}
+			return cb.Tombstones(tstones)
+		default:
+			return errors.Errorf("invalid record type %v", dec.Type(rec))
+		}
+	})
+}
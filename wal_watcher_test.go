@@ -0,0 +1,108 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/prometheus/tsdb/wal"
+)
+
+func TestWALWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_wal_watcher")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := wal.New(nil, nil, dir)
+	testutil.Ok(t, err)
+
+	h, err := NewHead(nil, nil, w, 1000)
+	testutil.Ok(t, err)
+	defer h.Close()
+	testutil.Ok(t, h.Init())
+
+	var (
+		mtx     sync.Mutex
+		series  = map[uint64]labels.Labels{}
+		samples []RefSample
+		tstones []Stone
+	)
+	watcher := NewWALWatcher(nil, nil, dir, WALWatcherCallbacks{
+		Series: func(s []RefSeries) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			for _, s := range s {
+				series[s.Ref] = s.Labels
+			}
+			return nil
+		},
+		Samples: func(s []RefSample) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			samples = append(samples, s...)
+			return nil
+		},
+		Tombstones: func(s []Stone) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			tstones = append(tstones, s...)
+			return nil
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- watcher.Run(ctx)
+	}()
+
+	for i := 0; i < 10; i++ {
+		app := h.Appender()
+		for _, v := range []string{"1", "2"} {
+			_, err := app.Add(labels.FromStrings("a", v), int64(i), float64(i))
+			testutil.Ok(t, err)
+		}
+		testutil.Ok(t, app.Commit())
+	}
+	testutil.Ok(t, h.Delete(0, 3, labels.NewEqualMatcher("a", "1")))
+
+	for i := 0; i < 100; i++ {
+		mtx.Lock()
+		done := len(tstones) > 0
+		mtx.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	testutil.Equals(t, context.Canceled, <-errc)
+
+	testutil.Equals(t, 2, len(series))
+	testutil.Equals(t, 20, len(samples))
+	for _, s := range samples {
+		testutil.Equals(t, s.T, int64(s.V))
+		testutil.Assert(t, series[s.Ref] != nil, "sample for unknown series %d", s.Ref)
+	}
+	testutil.Equals(t, 1, len(tstones))
+	testutil.Equals(t, labels.FromStrings("a", "1"), series[tstones[0].ref])
+}